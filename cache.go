@@ -0,0 +1,300 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+const (
+	defaultCacheEntries    = 10000
+	defaultCacheVersionTTL = time.Minute
+	defaultCacheMaxMemory  = 10 * 1024 * 1024
+)
+
+// CacheEntry is a cached scan verdict
+type CacheEntry struct {
+	Responses []*Response
+	// DatabaseVersion is the signature database version
+	// the content was scanned with
+	DatabaseVersion int
+}
+
+// Cache stores scan verdicts by the SHA-256 hex digest
+// of the scanned content, it must be safe for
+// concurrent use
+type Cache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, e *CacheEntry)
+	Delete(key string)
+}
+
+// CacheConfig holds the verdict cache settings
+type CacheConfig struct {
+	// Cache is the backend, zero uses an LRUCache
+	// of 10000 entries
+	Cache Cache
+	// VersionTTL is how long the database version is used
+	// before VERSION is sent again, zero means the
+	// default of 1m
+	VersionTTL time.Duration
+	// MaxMemory is the size of a stream that is kept in
+	// memory while it is hashed, larger streams are kept in
+	// a temporary file, zero means the default of 10MB
+	MaxMemory int64
+}
+
+// A CachedScanner is a Scanner that returns cached verdicts
+// for content it has already scanned. Clean verdicts are
+// invalidated when the signature database version changes,
+// infected verdicts are kept
+type CachedScanner struct {
+	Scanner
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	version int
+	checked time.Time
+}
+
+// NewCachedScanner returns a CachedScanner that scans with s
+func NewCachedScanner(s Scanner, cfg CacheConfig) *CachedScanner {
+	if cfg.Cache == nil {
+		cfg.Cache = NewLRUCache(defaultCacheEntries)
+	}
+
+	if cfg.VersionTTL <= 0 {
+		cfg.VersionTTL = defaultCacheVersionTTL
+	}
+
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = defaultCacheMaxMemory
+	}
+
+	return &CachedScanner{
+		Scanner: s,
+		cfg:     cfg,
+	}
+}
+
+// ScanReader scans i, a cached verdict is returned when
+// the content has been scanned before
+func (cs *CachedScanner) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
+	var key string
+	var version int
+
+	if version, err = cs.dbVersion(ctx); err != nil {
+		// The verdicts can not be validated
+		r, err = cs.Scanner.ScanReader(ctx, i)
+		return
+	}
+
+	// The content is hashed while it is spooled, the reader
+	// is read once and never seeked so pipes can be scanned
+	sp := spool.New(cs.cfg.MaxMemory)
+	defer sp.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(sp, io.TeeReader(i, h)); err != nil {
+		return
+	}
+	if err = sp.Rewind(); err != nil {
+		return
+	}
+	key = hex.EncodeToString(h.Sum(nil))
+
+	if e, ok := cs.cfg.Cache.Get(key); ok {
+		if NewVerdict(e.Responses).Infected() || e.DatabaseVersion == version {
+			r = copyResponses(e.Responses)
+			return
+		}
+		cs.cfg.Cache.Delete(key)
+	}
+
+	if r, err = cs.Scanner.ScanReader(ctx, sp); err != nil {
+		return
+	}
+
+	if v := NewVerdict(r); v.Clean() || v.Infected() {
+		cs.cfg.Cache.Set(key, &CacheEntry{
+			Responses:       copyResponses(r),
+			DatabaseVersion: version,
+		})
+	}
+
+	return
+}
+
+// InStream scans the file p with ScanReader
+func (cs *CachedScanner) InStream(ctx context.Context, p string) (r []*Response, err error) {
+	var f *os.File
+
+	if f, err = os.Open(p); err != nil {
+		return
+	}
+	defer f.Close()
+
+	r, err = cs.ScanReader(ctx, f)
+
+	return
+}
+
+// ScanAndStore scans i with ScanReader and persists it to s
+func (cs *CachedScanner) ScanAndStore(ctx context.Context, i io.Reader, s Sink) (r []*Response, err error) {
+	r, err = scanAndStore(ctx, cs.ScanReader, i, s)
+	return
+}
+
+// Reload reloads the database, the database version is
+// checked again by the next scan
+func (cs *CachedScanner) Reload(ctx context.Context) (b bool, err error) {
+	if b, err = cs.Scanner.Reload(ctx); err != nil {
+		return
+	}
+
+	cs.mu.Lock()
+	cs.checked = time.Time{}
+	cs.mu.Unlock()
+
+	return
+}
+
+// dbVersion returns the signature database version
+func (cs *CachedScanner) dbVersion(ctx context.Context) (version int, err error) {
+	var v *VersionInfo
+
+	cs.mu.Lock()
+	if !cs.checked.IsZero() && time.Since(cs.checked) < cs.cfg.VersionTTL {
+		version = cs.version
+		cs.mu.Unlock()
+		return
+	}
+	cs.mu.Unlock()
+
+	if v, err = cs.Scanner.VersionInfo(ctx); err != nil {
+		return
+	}
+
+	cs.mu.Lock()
+	cs.version = v.DatabaseVersion
+	cs.checked = time.Now()
+	cs.mu.Unlock()
+
+	version = v.DatabaseVersion
+
+	return
+}
+
+func copyResponses(r []*Response) (c []*Response) {
+	if r == nil {
+		return
+	}
+
+	c = make([]*Response, len(r))
+	for n, rs := range r {
+		v := *rs
+		c[n] = &v
+	}
+
+	return
+}
+
+// An LRUCache is an in-memory Cache that holds a fixed
+// number of entries, the least recently used entry is
+// removed when it is full
+type LRUCache struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// NewLRUCache returns an LRUCache of max entries
+func NewLRUCache(max int) *LRUCache {
+	if max <= 0 {
+		max = defaultCacheEntries
+	}
+
+	return &LRUCache{
+		max:     max,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry of key
+func (c *LRUCache) Get(key string) (e *CacheEntry, ok bool) {
+	var el *list.Element
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok = c.entries[key]; !ok {
+		return
+	}
+
+	c.ll.MoveToFront(el)
+	e = el.Value.(*lruItem).entry
+
+	return
+}
+
+// Set stores the entry of key
+func (c *LRUCache) Set(key string, e *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruItem).entry = e
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&lruItem{key: key, entry: e})
+
+	for c.ll.Len() > c.max {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.entries, el.Value.(*lruItem).key)
+	}
+}
+
+// Delete removes the entry of key
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// Len returns the number of entries
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
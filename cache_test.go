@@ -0,0 +1,173 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestCachedScanner(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	eicar, e := ioutil.ReadFile("examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	ctx := context.Background()
+	cache := NewLRUCache(10)
+	cs := NewCachedScanner(c, CacheConfig{Cache: cache, MaxMemory: 16})
+
+	scan := func(r io.Reader, status Status, scans int) {
+		t.Helper()
+		rs, err := cs.ScanReader(ctx, r)
+		if err != nil {
+			t.Fatalf("An error should not be returned: %s", err)
+		}
+		if len(rs) != 1 || rs[0].Status != status {
+			t.Errorf("Expected %s got %v", status, rs)
+		}
+		if n := srv.Commands("INSTREAM"); n != scans {
+			t.Errorf("Expected %d scans got %d", scans, n)
+		}
+	}
+
+	// Seekable and plain readers of the same content share
+	// the verdict
+	scan(strings.NewReader("clean content"), "OK", 1)
+	scan(&plainReader{bytes.NewReader([]byte("clean content"))}, "OK", 1)
+	scan(&plainReader{bytes.NewReader(eicar)}, "FOUND", 2)
+	scan(bytes.NewReader(eicar), "FOUND", 2)
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries got %d", cache.Len())
+	}
+	if n := srv.Commands("VERSION"); n != 1 {
+		t.Errorf("Expected the version to be cached got %d", n)
+	}
+
+	// Returned responses do not share the cached ones
+	rs, _ := cs.ScanReader(ctx, strings.NewReader("clean content"))
+	rs[0].Status = "FOUND"
+	scan(strings.NewReader("clean content"), "OK", 2)
+
+	// A new database invalidates clean verdicts only
+	if _, e = cs.Reload(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	srv.InjectFault("VERSION", clamdtest.Fault{Reply: "ClamAV 1.0.1/26851/Tue Mar 14 08:20:43 2023"})
+	scan(strings.NewReader("clean content"), "OK", 3)
+	scan(strings.NewReader("clean content"), "OK", 3)
+	scan(bytes.NewReader(eicar), "FOUND", 3)
+
+	// The rest of a seekable reader is scanned
+	r := strings.NewReader("xx" + string(eicar))
+	r.Seek(2, io.SeekStart)
+	scan(r, "FOUND", 3)
+
+	// Pipes that can not seek are scanned and cached
+	pr, pw, e := os.Pipe()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	go func() {
+		pw.Write(eicar)
+		pw.Close()
+	}()
+	scan(pr, "FOUND", 3)
+	pr.Close()
+
+	// ScanAndStore and InStream use the cache
+	var buf bytes.Buffer
+	if rs, e = cs.ScanAndStore(ctx, strings.NewReader("clean content"), NewWriterSink(&buf, nil, nil)); e != nil || len(rs) != 1 || buf.String() != "clean content" {
+		t.Errorf("Unexpected result %v %v %q", rs, e, buf.String())
+	}
+	if rs, e = cs.InStream(ctx, "examples/eicar.txt"); e != nil || len(rs) != 1 || rs[0].Status != "FOUND" {
+		t.Errorf("Unexpected result %v %v", rs, e)
+	}
+	if n := srv.Commands("INSTREAM"); n != 3 {
+		t.Errorf("Expected 3 scans got %d", n)
+	}
+
+	// Errors are not cached
+	srv.InjectFault("INSTREAM", clamdtest.Fault{Reply: "INSTREAM size limit exceeded. ERROR", Times: 1})
+	if _, e = cs.ScanReader(ctx, strings.NewReader("other content")); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	scan(strings.NewReader("other content"), "OK", 5)
+}
+
+func TestCachedScannerVersionError(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	cache := NewLRUCache(10)
+	cs := NewCachedScanner(c, CacheConfig{Cache: cache})
+
+	// Content is scanned without the cache when the
+	// database version is unknown
+	srv.InjectFault("VERSION", clamdtest.Fault{Reset: true})
+	for i := 0; i < 2; i++ {
+		if rs, e := cs.ScanReader(context.Background(), strings.NewReader("content")); e != nil || len(rs) != 1 {
+			t.Errorf("Unexpected result %v %v", rs, e)
+		}
+	}
+	if n := srv.Commands("INSTREAM"); n != 2 || cache.Len() != 0 {
+		t.Errorf("Expected 2 uncached scans got %d %d", n, cache.Len())
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2)
+
+	c.Set("a", &CacheEntry{DatabaseVersion: 1})
+	c.Set("b", &CacheEntry{DatabaseVersion: 2})
+	if e, ok := c.Get("a"); !ok || e.DatabaseVersion != 1 {
+		t.Errorf("Expected the entry of a got %v %v", e, ok)
+	}
+
+	// b is the least recently used
+	c.Set("c", &CacheEntry{DatabaseVersion: 3})
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries got %d", c.Len())
+	}
+
+	c.Set("a", &CacheEntry{DatabaseVersion: 4})
+	if e, _ := c.Get("a"); e.DatabaseVersion != 4 {
+		t.Errorf("Expected the entry to be replaced got %d", e.DatabaseVersion)
+	}
+
+	c.Delete("a")
+	c.Delete("missing")
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("Expected a to be deleted")
+	}
+}
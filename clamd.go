@@ -10,16 +10,16 @@ Clamd - Golang clamd client
 package clamd
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"os"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/baruwa-enterprise/clamd/protocol"
@@ -29,6 +29,7 @@ const (
 	defaultTimeout      = 15 * time.Second
 	defaultSleep        = 1 * time.Second
 	defaultCmdTimeout   = 1 * time.Minute
+	endStreamTimeout    = 1 * time.Second
 	defaultSock         = "/var/run/clamav/clamd.sock"
 	invalidRespErr      = "Invalid server response: %s"
 	unsupportedProtoErr = "Protocol: %s is not supported"
@@ -39,20 +40,20 @@ const (
 	reloadResp          = "RELOADING"
 	pingResp            = "PONG"
 	versionCmdsResp     = "COMMANDS: "
-	// ChunkSize the size for chunking INSTREAM files
-	ChunkSize = 1024
+	replyDelims         = "\n\x00"
+	// ChunkSize the default size for chunking INSTREAM files
+	ChunkSize = 64 * 1024
 )
 
-var (
-	responseRe = regexp.MustCompile(`^(?P<filename>[^:]+):\s+(?:(?P<signature>[^:]+)\s+)?(?P<status>(FOUND|OK|ERROR))$`)
-)
-
-// Response is the response from the server
+// Response is the response from the server, a file that
+// could not be scanned has the ERROR Status and the
+// message of the server in Error
 type Response struct {
-	Filename  string
-	Signature string
-	Status    string
-	Raw       string
+	Filename  string `json:"filename"`
+	Signature string `json:"signature,omitempty"`
+	Status    Status `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Raw       string `json:"raw,omitempty"`
 }
 
 // A Client represents a Clamd client.
@@ -63,6 +64,13 @@ type Client struct {
 	connRetries int
 	connSleep   time.Duration
 	cmdTimeout  time.Duration
+	pool        *pool
+
+	chunkSize       int
+	streamMaxLength int64
+	bufs            *sync.Pool
+	zMode           bool
+	allMatch        bool
 }
 
 // SetConnTimeout sets the connection timeout
@@ -96,6 +104,23 @@ func (c *Client) SetConnSleep(s time.Duration) {
 	}
 }
 
+// SetZMode sets the use of the z command prefix, commands
+// and replies are then terminated by NUL instead of newline
+// so filenames may contain newlines. It should be called
+// before the client is used.
+func (c *Client) SetZMode(z bool) {
+	c.zMode = z
+}
+
+// SetAllMatch tells the client that clamd runs with
+// AllMatchScan, a reply may then report a file several
+// times. Sessions can not tell where such a reply ends so
+// the pool is not used. It should be called before the
+// client is used.
+func (c *Client) SetAllMatch(b bool) {
+	c.allMatch = b
+}
+
 // Ping sends a ping to the server
 func (c *Client) Ping(ctx context.Context) (b bool, err error) {
 	var r string
@@ -114,12 +139,13 @@ func (c *Client) Ping(ctx context.Context) (b bool, err error) {
 
 // Version returns the server version
 func (c *Client) Version(ctx context.Context) (v string, err error) {
-	if v, err = c.basicCmd(ctx, protocol.Version); err != nil {
+	v, err = c.basicCmd(ctx, protocol.Version)
+	if v == "" && (err == nil || errors.Is(err, io.ErrUnexpectedEOF)) {
+		err = emptyReply(versionErr, err)
 		return
 	}
 
-	if v == "" && err == nil {
-		err = fmt.Errorf(versionErr)
+	if err != nil {
 		return
 	}
 
@@ -190,12 +216,13 @@ func (c *Client) Fildes(ctx context.Context, p string) (r []*Response, err error
 
 // Stats returns server stats
 func (c *Client) Stats(ctx context.Context) (s string, err error) {
-	if s, err = c.basicCmd(ctx, protocol.Stats); err != nil {
+	s, err = c.basicCmd(ctx, protocol.Stats)
+	if s == "" && (err == nil || errors.Is(err, io.ErrUnexpectedEOF)) {
+		err = emptyReply(statsErr, err)
 		return
 	}
 
-	if s == "" && err == nil {
-		err = fmt.Errorf(statsErr)
+	if err != nil {
 		return
 	}
 
@@ -206,28 +233,19 @@ func (c *Client) Stats(ctx context.Context) (s string, err error) {
 	return
 }
 
-// IDSession starts a session
-// func (c *Client) IDSession() {
-// }
-
-// End closes a session
-// func (c *Client) End() {
-// }
-
-// VersionCmds returns the supported cmds
-func (c *Client) VersionCmds(ctx context.Context) (r []string, err error) {
+// VersionCmds returns the supported cmds and the server version
+func (c *Client) VersionCmds(ctx context.Context) (r []string, v *VersionInfo, err error) {
 	var s string
 	if s, err = c.basicCmd(ctx, protocol.VersionCmds); err != nil {
 		return
 	}
 
-	p := strings.Split(s, versionCmdsResp)
-	if len(p) != 2 {
-		err = fmt.Errorf(invalidRespErr, s)
+	if err = checkError(s); err != nil {
 		return
 	}
-	s = p[1]
-	r = strings.Split(s, " ")
+
+	r, v, err = parseVersionCmds(s)
+
 	return
 }
 
@@ -238,12 +256,20 @@ func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
 
 	for i := 0; i <= c.connRetries; i++ {
 		conn, err = d.DialContext(ctx, c.network, c.address)
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			time.Sleep(c.connSleep)
-			continue
+		if err == nil || !IsRetryable(err) || i == c.connRetries {
+			break
 		}
-		break
+		time.Sleep(c.connSleep)
 	}
+
+	if err != nil {
+		err = &DialError{
+			Network: c.network,
+			Address: c.address,
+			Err:     err,
+		}
+	}
+
 	return
 }
 
@@ -253,6 +279,14 @@ func (c *Client) basicCmd(ctx context.Context, cmd protocol.Command) (r string,
 	var b strings.Builder
 	var tc *textproto.Conn
 
+	if c.pooled(cmd) {
+		err = c.pool.do(ctx, func(s *Session) (e error) {
+			r, e = s.send(ctx, cmd, "", nil)
+			return
+		})
+		return
+	}
+
 	conn, err = c.dial(ctx)
 	if err != nil {
 		return
@@ -260,11 +294,15 @@ func (c *Client) basicCmd(ctx context.Context, cmd protocol.Command) (r string,
 
 	tc = textproto.NewConn(conn)
 	defer tc.Close()
+	defer watch(ctx, conn).stop()
+	defer func() {
+		err = ctxError(ctx, err)
+	}()
 
 	id := tc.Next()
 	tc.StartRequest(id)
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	fmt.Fprintf(tc.W, "n%s\n", cmd)
+	conn.SetDeadline(c.deadline(ctx))
+	c.writeCmd(tc.W, cmd)
 	tc.W.Flush()
 	tc.EndRequest(id)
 
@@ -276,17 +314,17 @@ func (c *Client) basicCmd(ctx context.Context, cmd protocol.Command) (r string,
 	}
 
 	for {
-		conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if l, err = tc.R.ReadBytes('\n'); err != nil {
+		conn.SetDeadline(c.deadline(ctx))
+		if l, err = tc.R.ReadBytes(c.delimiter()); err != nil {
 			if err == io.EOF {
-				err = nil
+				err = replyEOF(len(l) > 0 || b.Len() == 0)
 			}
 			break
 		}
 		fmt.Fprintf(&b, "%s", l)
 	}
 
-	r = strings.TrimRight(b.String(), "\n")
+	r = strings.TrimRight(b.String(), replyDelims)
 
 	return
 }
@@ -303,7 +341,15 @@ func (c *Client) fileCmd(ctx context.Context, cmd protocol.Command, p string) (r
 	}
 
 	if cmd == protocol.Fildes && c.network != "unix" && c.network != "unixpacket" {
-		err = fmt.Errorf(fldesErr)
+		err = ErrFildesUnsupported
+		return
+	}
+
+	if c.pooled(cmd) {
+		err = c.pool.do(ctx, func(s *Session) (e error) {
+			r, e = s.fileCmd(ctx, cmd, p)
+			return
+		})
 		return
 	}
 
@@ -314,23 +360,29 @@ func (c *Client) fileCmd(ctx context.Context, cmd protocol.Command, p string) (r
 
 	tc = textproto.NewConn(conn)
 	defer tc.Close()
+	wt := watch(ctx, conn)
+	defer wt.stop()
+	defer func() {
+		err = ctxError(ctx, err)
+	}()
 
 	id = tc.Next()
 	tc.StartRequest(id)
 
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	conn.SetDeadline(c.deadline(ctx))
 	if cmd == protocol.Instream {
-		if err = c.instreamScan(tc, conn, p); err != nil {
+		if err = c.instreamScan(ctx, tc.W, conn, wt, p); err != nil {
 			tc.EndRequest(id)
+			err = c.streamError(ctx, tc, conn, err)
 			return
 		}
 	} else if cmd == protocol.Fildes {
-		if err = c.fildesScan(tc, conn, p); err != nil {
+		if err = c.fildesScan(tc.W, conn, p); err != nil {
 			tc.EndRequest(id)
 			return
 		}
 	} else {
-		fmt.Fprintf(tc.W, "n%s %s\n", cmd, p)
+		c.writeCmd(tc.W, cmd, p)
 	}
 	tc.W.Flush()
 	tc.EndRequest(id)
@@ -338,7 +390,7 @@ func (c *Client) fileCmd(ctx context.Context, cmd protocol.Command, p string) (r
 	tc.StartResponse(id)
 	defer tc.EndResponse(id)
 
-	r, err = c.processResponse(tc, conn)
+	r, err = c.processResponse(ctx, tc, conn)
 
 	return
 }
@@ -347,18 +399,32 @@ func (c *Client) readerCmd(ctx context.Context, i io.Reader) (r []*Response, err
 	var conn net.Conn
 	var tc *textproto.Conn
 
+	if c.pooled(protocol.Instream) {
+		err = c.pool.do(ctx, func(s *Session) (e error) {
+			r, e = s.cmd(ctx, protocol.Instream, "", i)
+			return
+		})
+		return
+	}
+
 	if conn, err = c.dial(ctx); err != nil {
 		return
 	}
 
 	tc = textproto.NewConn(conn)
 	defer tc.Close()
+	wt := watch(ctx, conn)
+	defer wt.stop()
+	defer func() {
+		err = ctxError(ctx, err)
+	}()
 
 	id := tc.Next()
 	tc.StartRequest(id)
 
-	if err = c.streamCmd(tc, protocol.Instream, i, conn); err != nil {
+	if err = c.streamCmd(ctx, tc.W, protocol.Instream, i, conn, wt); err != nil {
 		tc.EndRequest(id)
+		err = c.streamError(ctx, tc, conn, err)
 		return
 	}
 
@@ -367,83 +433,73 @@ func (c *Client) readerCmd(ctx context.Context, i io.Reader) (r []*Response, err
 	tc.StartResponse(id)
 	defer tc.EndResponse(id)
 
-	r, err = c.processResponse(tc, conn)
+	r, err = c.processResponse(ctx, tc, conn)
 
 	return
 }
 
-func (c *Client) streamCmd(tc *textproto.Conn, cmd protocol.Command, f io.Reader, conn net.Conn) (err error) {
-	var n int
-	var eof bool
-
-	fmt.Fprintf(tc.W, "n%s\n", cmd)
-	b := make([]byte, 4)
-
-	for !eof {
-		buf := make([]byte, ChunkSize)
-		if n, err = f.Read(buf); err != nil {
-			if err != io.EOF {
-				return
-			}
-
-			err = nil
-			eof = true
-		}
-		if n > 0 {
-			conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-			binary.BigEndian.PutUint32(b, uint32(n))
-			if _, err = tc.W.Write(b); err != nil {
-				return
-			}
-			if _, err = tc.W.Write(buf[0:n]); err != nil {
-				return
-			}
-			tc.W.Flush()
-		}
+// streamCmd sends f in INSTREAM chunks, when ctx is done
+// the stream is terminated and ctx.Err() is returned. The
+// watcher wt of conn, if any, is kept from closing conn
+// until the stream has ended.
+func (c *Client) streamCmd(ctx context.Context, w *bufio.Writer, cmd protocol.Command, f io.Reader, conn net.Conn, wt *watcher) (err error) {
+	cw := c.newChunkWriter(ctx, w, conn)
+	if wt != nil {
+		cw.wt = wt
+		wt.streaming(true)
+		defer wt.streaming(false)
 	}
-	if _, err = tc.W.Write([]byte{0, 0, 0, 0}); err != nil {
-		return
-	}
-	tc.W.Flush()
+
+	err = cw.stream(cmd, f)
 
 	return
 }
 
-func (c *Client) processResponse(tc *textproto.Conn, conn net.Conn) (r []*Response, err error) {
+func (c *Client) processResponse(ctx context.Context, tc *textproto.Conn, conn net.Conn) (r []*Response, err error) {
 	var lineb []byte
+	var rs *Response
 
 	for {
-		conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		rs := Response{}
-		if lineb, err = tc.R.ReadBytes('\n'); err != nil {
+		conn.SetDeadline(c.deadline(ctx))
+		if lineb, err = tc.R.ReadBytes(c.delimiter()); err != nil {
 			if err == io.EOF {
-				err = nil
+				err = replyEOF(len(lineb) > 0 || len(r) == 0)
 			}
 			break
 		}
 
-		mb := responseRe.FindSubmatch(bytes.TrimRight(lineb, "\n"))
-		if mb == nil {
-			if bytes.HasSuffix(lineb, []byte("ERROR\n")) {
-				err = fmt.Errorf("%s", bytes.TrimRight(lineb, " ERROR\n"))
-			} else {
-				err = fmt.Errorf(invalidRespErr, lineb)
-			}
+		// Per-file errors are responses, other
+		// errors end the reply
+		if rs, err = ParseResponse(string(lineb)); err != nil {
 			break
 		}
 
-		rs.Filename = string(mb[1])
-		rs.Signature = string(mb[2])
-		rs.Status = string(mb[3])
-		rs.Raw = string(mb[0])
-
-		r = append(r, &rs)
+		r = append(r, rs)
 	}
 
 	return
 }
 
-func (c *Client) instreamScan(tc *textproto.Conn, conn net.Conn, p string) (err error) {
+// streamError returns the reply sent by the server when it
+// stopped reading a stream, clamd replies before it closes a
+// stream that exceeds StreamMaxLength
+func (c *Client) streamError(ctx context.Context, tc *textproto.Conn, conn net.Conn, err error) error {
+	var l string
+
+	if !writeFailed(err) {
+		return err
+	}
+
+	conn.SetDeadline(c.deadline(ctx))
+	l, _ = tc.R.ReadString(c.delimiter())
+	if l = strings.TrimRight(l, replyDelims); l != "" && isServerError(l) {
+		return newServerError(l)
+	}
+
+	return err
+}
+
+func (c *Client) instreamScan(ctx context.Context, w *bufio.Writer, conn net.Conn, wt *watcher, p string) (err error) {
 	var f *os.File
 
 	if f, err = os.Open(p); err != nil {
@@ -451,13 +507,49 @@ func (c *Client) instreamScan(tc *textproto.Conn, conn net.Conn, p string) (err
 	}
 	defer f.Close()
 
-	if err = c.streamCmd(tc, protocol.Instream, f, conn); err != nil {
+	if err = c.streamCmd(ctx, w, protocol.Instream, f, conn, wt); err != nil {
 		return
 	}
 
 	return
 }
 
+// writeCmd writes cmd and its argument with the
+// prefix and delimiter of the client
+func (c *Client) writeCmd(w io.Writer, cmd protocol.Command, arg ...string) {
+	prefix := 'n'
+	if c.zMode {
+		prefix = 'z'
+	}
+
+	if len(arg) > 0 {
+		fmt.Fprintf(w, "%c%s %s%c", prefix, cmd, arg[0], c.delimiter())
+		return
+	}
+
+	fmt.Fprintf(w, "%c%s%c", prefix, cmd, c.delimiter())
+}
+
+// delimiter returns the delimiter of commands and replies
+func (c *Client) delimiter() byte {
+	if c.zMode {
+		return 0
+	}
+
+	return '\n'
+}
+
+// deadline returns the cmd timeout deadline or the
+// ctx deadline when it is earlier
+func (c *Client) deadline(ctx context.Context) (t time.Time) {
+	t = time.Now().Add(c.cmdTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
+	}
+
+	return
+}
+
 // NewClient returns a new Clamd client.
 func NewClient(network, address string) (c *Client, err error) {
 	if network == "" && address == "" {
@@ -466,13 +558,13 @@ func NewClient(network, address string) (c *Client, err error) {
 	}
 
 	if network != "unix" && network != "unixpacket" && network != "tcp" && network != "tcp4" && network != "tcp6" {
-		err = fmt.Errorf(unsupportedProtoErr, network)
+		err = errorf(ErrUnsupportedNetwork, unsupportedProtoErr, network)
 		return
 	}
 
 	if network == "unix" || network == "unixpacket" {
 		if _, err = os.Stat(address); os.IsNotExist(err) {
-			err = fmt.Errorf(unixSockErr, address)
+			err = errorf(ErrSocketNotFound, unixSockErr, address)
 			return
 		}
 	}
@@ -483,13 +575,128 @@ func NewClient(network, address string) (c *Client, err error) {
 		connTimeout: defaultTimeout,
 		connSleep:   defaultSleep,
 		cmdTimeout:  defaultCmdTimeout,
+		chunkSize:   ChunkSize,
+		bufs:        newBufPool(ChunkSize),
+	}
+	return
+}
+
+// A watcher aborts blocked reads and writes on conn when ctx
+// is done by closing it. While a stream is sent an expired
+// write deadline is set instead so the stream can still be
+// terminated, conn is then closed when the stream ends.
+type watcher struct {
+	conn   net.Conn
+	done   chan struct{}
+	mu     sync.Mutex
+	stream bool
+	fired  bool
+}
+
+// watch watches ctx until stop is called
+func watch(ctx context.Context, conn net.Conn) (w *watcher) {
+	w = &watcher{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	if ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.fire()
+		case <-w.done:
+		}
+	}()
+
+	return
+}
+
+func (w *watcher) fire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.fired = true
+	if w.stream {
+		w.conn.SetWriteDeadline(time.Now())
+		return
 	}
+
+	w.conn.Close()
+}
+
+// streaming sets whether a stream is being sent
+func (w *watcher) streaming(b bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stream = b
+	if !b && w.fired {
+		w.conn.Close()
+	}
+}
+
+// hold keeps the watcher from acting on conn until
+// the returned function is called
+func (w *watcher) hold() (release func()) {
+	w.mu.Lock()
+	return w.mu.Unlock
+}
+
+// stop stops watching
+func (w *watcher) stop() {
+	close(w.done)
+}
+
+// ctxError returns ctx.Err() in place of err when ctx
+// is done, err is then due to the closed connection or
+// the socket deadline set to the ctx deadline
+func ctxError(ctx context.Context, err error) error {
+	var ne net.Error
+
+	if err == nil {
+		return err
+	}
+
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) && errors.As(err, &ne) && ne.Timeout() {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// replyEOF returns the error for a connection closed by the
+// server, partial is true when the reply was cut short
+func replyEOF(partial bool) (err error) {
+	if partial {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+// writeFailed reports whether err was returned writing to the
+// connection as opposed to reading the source of a stream
+func writeFailed(err error) (b bool) {
+	var oe *net.OpError
+
+	if errors.As(err, &oe) {
+		b = (oe.Op == "write" || oe.Op == "writev" || oe.Op == "readfrom") && !oe.Timeout()
+	}
+
 	return
 }
 
 func checkError(s string) (err error) {
-	if strings.HasSuffix(s, "ERROR") {
-		err = fmt.Errorf("%s", strings.TrimRight(s, " ERROR"))
+	if isServerError(s) {
+		err = newServerError(s)
 		return
 	}
 
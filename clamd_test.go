@@ -10,17 +10,24 @@ Clamd - Golang clamd client
 package clamd
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/iotest"
 	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
 )
 
 type checkErrorTestKey struct {
@@ -57,6 +64,12 @@ func getaddr() (address, network string, err error) {
 	return
 }
 
+func isDialError(e error) bool {
+	var de *DialError
+	var oe *net.OpError
+	return errors.As(e, &de) && errors.As(e, &oe)
+}
+
 func TestCheckErrors(t *testing.T) {
 	for _, tt := range TestcheckErrors {
 		if e := checkError(tt.in); e != tt.out {
@@ -80,6 +93,9 @@ func TestBasics(t *testing.T) {
 	if e.Error() != expected {
 		t.Errorf("Expected %q want %q", expected, e)
 	}
+	if !errors.Is(e, ErrSocketNotFound) {
+		t.Errorf("Expected ErrSocketNotFound got %q", e)
+	}
 
 	// Test defaults
 	_, e = NewClient("", "")
@@ -101,6 +117,9 @@ func TestBasics(t *testing.T) {
 	if e.Error() != expected {
 		t.Errorf("Got %q want %q", expected, e)
 	}
+	if !errors.Is(e, ErrUnsupportedNetwork) {
+		t.Errorf("Expected ErrUnsupportedNetwork got %q", e)
+	}
 
 	// Test tcp
 	network := "tcp"
@@ -120,10 +139,9 @@ func TestBasics(t *testing.T) {
 	if _, e = c.Fildes(ctx, "/tmp"); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if e.Error() != fldesErr {
-		t.Errorf("Got %q want %q", e, fldesErr)
+	if e != ErrFildesUnsupported {
+		t.Errorf("Got %q want %q", e, ErrFildesUnsupported)
 	}
-
 }
 
 func TestSettings(t *testing.T) {
@@ -180,64 +198,64 @@ func TestMethodsErrors(t *testing.T) {
 	if _, e = c.Ping(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.Version(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.Reload(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if e = c.Shutdown(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.Stats(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
-	if _, e = c.VersionCmds(ctx); e == nil {
+	if _, _, e = c.VersionCmds(ctx); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.Scan(ctx, "/tmp/bxx.syx"); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.ContScan(ctx, "/tmp/bxx.syx"); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	if _, e = c.MultiScan(ctx, "/tmp/bxx.syx"); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	if !isDialError(e) {
+		t.Errorf("Expected *DialError want %q", e)
 	}
 
 	expected := "stat /tmp/bxx.syx: no such file or directory"
@@ -276,6 +294,7 @@ func TestMethods(t *testing.T) {
 	var f *os.File
 	var result []*Response
 	var vcmds []string
+	var vi *VersionInfo
 	var network, address, rs, dir string
 
 	if address, network, e = getaddr(); e != nil {
@@ -326,9 +345,12 @@ func TestMethods(t *testing.T) {
 		t.Errorf("Expected version starting with POOLS:, got %q", rs)
 	}
 
-	if vcmds, e = c.VersionCmds(ctx); e != nil {
+	if vcmds, vi, e = c.VersionCmds(ctx); e != nil {
 		t.Fatalf("An error should not be returned")
 	}
+	if vi.Product != "ClamAV" || vi.Raw != rs {
+		t.Errorf("Expected the version %q, got %q", rs, vi.Raw)
+	}
 	if len(vcmds) == 0 {
 		t.Fatalf("Expected a slice of strings:, got %q", vcmds)
 	}
@@ -495,6 +517,263 @@ func TestMethods(t *testing.T) {
 	})
 }
 
+func TestContext(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	t.Run("cancel upload", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		if _, e := c.ScanReader(ctx, &slowReader{}); e != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, e)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Expected the upload to be aborted promptly took %s", d)
+		}
+	})
+
+	t.Run("terminate upload", func(t *testing.T) {
+		l, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		defer l.Close()
+
+		// terminated receives true when the zero-length
+		// chunk is received
+		terminated := make(chan bool, 1)
+		go func() {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if _, e = r.ReadString('\n'); e != nil {
+				terminated <- false
+				return
+			}
+			hdr := make([]byte, 4)
+			for {
+				if _, e = io.ReadFull(r, hdr); e != nil {
+					terminated <- false
+					return
+				}
+				n := binary.BigEndian.Uint32(hdr)
+				if n == 0 {
+					terminated <- true
+					return
+				}
+				if _, e = io.CopyN(ioutil.Discard, r, int64(n)); e != nil {
+					terminated <- false
+					return
+				}
+			}
+		}()
+
+		sc, e := NewClient("tcp", l.Addr().String())
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		sc.SetChunkSize(1024)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		if _, e := sc.ScanReader(ctx, &slowReader{}); e != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, e)
+		}
+		if !<-terminated {
+			t.Errorf("The stream should be terminated with a zero-length chunk")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		srv.InjectFault("SCAN", clamdtest.Fault{Stall: true})
+		defer srv.ClearFaults()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if _, e := c.Scan(ctx, "/tmp"); e != context.DeadlineExceeded {
+			t.Errorf("Expected %v got %v", context.DeadlineExceeded, e)
+		}
+	})
+
+	t.Run("cancel reply", func(t *testing.T) {
+		srv.InjectFault("PING", clamdtest.Fault{Stall: true})
+		defer srv.ClearFaults()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		if _, e := c.Ping(ctx); e != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, e)
+		}
+	})
+
+	t.Run("session", func(t *testing.T) {
+		ss, e := c.IDSession(context.Background())
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		defer ss.End()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		if _, e = ss.ScanReader(ctx, &slowReader{}); e != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, e)
+		}
+		if b, e := ss.Ping(context.Background()); e != nil || !b {
+			t.Errorf("Expected the session to be usable after the stream was terminated got %t, %v", b, e)
+		}
+	})
+}
+
+func TestZMode(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetZMode(true)
+
+	eicar, e := ioutil.ReadFile("examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	dir, e := ioutil.TempDir("", "clamd")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "a\nb.txt")
+	if e = ioutil.WriteFile(fn, eicar, 0644); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	ctx := context.Background()
+	check := func(r []*Response, e error, name string, status Status) {
+		t.Helper()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(r) != 1 || r[0].Filename != name || r[0].Status != status {
+			t.Errorf("Unexpected result %v", r)
+		}
+	}
+
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Unexpected result %t %v", b, e)
+	}
+	if v, e := c.Version(ctx); e != nil || v != clamdtest.DefaultVersion {
+		t.Errorf("Unexpected result %q %v", v, e)
+	}
+	if s, e := c.Stats(ctx); e != nil || !strings.HasSuffix(s, "END") || !strings.Contains(s, "\nTHREADS:") {
+		t.Errorf("Unexpected result %q %v", s, e)
+	}
+
+	r, e := c.Scan(ctx, fn)
+	check(r, e, fn, "FOUND")
+	r, e = c.ContScan(ctx, dir)
+	check(r, e, fn, "FOUND")
+	r, e = c.ScanReader(ctx, bytes.NewReader(eicar))
+	check(r, e, "stream", "FOUND")
+
+	sw, e := c.NewStreamWriter(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sw.Write([]byte("clean"))
+	if e = sw.Close(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	r, e = sw.Result()
+	check(r, e, "stream", "OK")
+
+	t.Run("session", func(t *testing.T) {
+		ss, e := c.IDSession(ctx)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		defer ss.End()
+
+		if s, e := ss.Stats(ctx); e != nil || !strings.HasSuffix(s, "END") {
+			t.Errorf("Unexpected result %q %v", s, e)
+		}
+		r, e := ss.Scan(ctx, fn)
+		check(r, e, fn, "FOUND")
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		c.SetPool(PoolConfig{})
+		defer c.Close()
+
+		if v, e := c.Version(ctx); e != nil || v != clamdtest.DefaultVersion {
+			t.Errorf("Unexpected result %q %v", v, e)
+		}
+		r, e := c.Scan(ctx, fn)
+		check(r, e, fn, "FOUND")
+	})
+
+	t.Run("wire", func(t *testing.T) {
+		l, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		defer l.Close()
+
+		cmd := make(chan string, 1)
+		go func() {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			defer conn.Close()
+			b := make([]byte, 16)
+			n, _ := conn.Read(b)
+			cmd <- string(b[:n])
+			conn.Write([]byte("PONG\x00"))
+		}()
+
+		zc, e := NewClient("tcp", l.Addr().String())
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		zc.SetZMode(true)
+		if b, e := zc.Ping(ctx); e != nil || !b {
+			t.Errorf("Unexpected result %t %v", b, e)
+		}
+		if s := <-cmd; s != "zPING\x00" {
+			t.Errorf("Expected %q got %q", "zPING\x00", s)
+		}
+	})
+}
+
+// slowReader returns a chunk of data every 10ms without end
+type slowReader struct{}
+
+func (r *slowReader) Read(p []byte) (n int, err error) {
+	time.Sleep(10 * time.Millisecond)
+	for n = range p {
+		p[n] = 'a'
+	}
+	n = len(p)
+	return
+}
+
 func copyFile(src, dst string, mode os.FileMode) error {
 	var err error
 	var srcfd *os.File
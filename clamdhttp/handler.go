@@ -0,0 +1,338 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdhttp provides net/http middleware and a
+RoundTripper that scan request and response bodies with clamd.
+*/
+package clamdhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+const (
+	// DefaultMaxMemory is the size of a request body that is
+	// kept in memory for the downstream handler
+	DefaultMaxMemory = 10 * 1024 * 1024
+	infectedErr      = "The request contains a virus"
+	scanErr          = "The request could not be scanned"
+	badRequestErr    = "The request body could not be read"
+	spoolErr         = "The request body could not be stored"
+)
+
+var (
+	// ErrPartTooLarge is returned when a part exceeds MaxPartSize
+	ErrPartTooLarge = errors.New("The part exceeds the size limit")
+	// ErrTooManyParts is returned when a request has more
+	// than MaxParts file parts
+	ErrTooManyParts = errors.New("The request has too many parts")
+	// ErrMalformed is returned when a multipart body can
+	// not be parsed
+	ErrMalformed = errors.New("Malformed multipart body")
+	// ErrScanFailed is returned when clamd replies that
+	// the content could not be scanned
+	ErrScanFailed = errors.New("The content could not be scanned")
+)
+
+type ctxKey struct{}
+
+// Config holds the handler settings
+type Config struct {
+	// Status is the status of the response to an infected
+	// request, the default is 422 Unprocessable Entity
+	Status int
+	// Body returns the value sent as the JSON body of the
+	// response to an infected request
+	Body func(rep *Report) interface{}
+	// PassInfected passes infected requests to the downstream
+	// handler instead of rejecting them
+	PassInfected bool
+	// MaxPartSize is the size limit of a part, zero means
+	// no limit. Larger parts are rejected with 413.
+	MaxPartSize int64
+	// MaxParts is the maximum number of file parts, zero means
+	// no limit. Requests with more are rejected with 413.
+	MaxParts int
+	// FailOpen passes requests that could not be scanned to the
+	// downstream handler, the error is set in the Report
+	FailOpen bool
+	// ErrorStatus is the status of the response to a request that
+	// could not be scanned, the default is 503 Service Unavailable
+	ErrorStatus int
+	// MaxMemory is the size of a request body that is kept in
+	// memory, larger bodies are kept in a temporary file
+	MaxMemory int64
+}
+
+// A Part is the result of scanning a file part or a
+// request body that is not multipart
+type Part struct {
+	Field     string            `json:"field,omitempty"`
+	Filename  string            `json:"filename,omitempty"`
+	Size      int64             `json:"size"`
+	Signature string            `json:"signature,omitempty"`
+	Responses []*clamd.Response `json:"-"`
+}
+
+// A Report holds the results of scanning a request, it is
+// added to the context of the downstream request
+type Report struct {
+	Parts    []*Part `json:"parts"`
+	Infected bool    `json:"infected"`
+	// Err is the scan error of a request passed
+	// downstream with FailOpen
+	Err error `json:"-"`
+}
+
+type errorBody struct {
+	Error string  `json:"error"`
+	Parts []*Part `json:"parts,omitempty"`
+}
+
+// A Handler scans request bodies before they are
+// passed to the downstream handler
+type Handler struct {
+	s    clamd.Scanner
+	next http.Handler
+	cfg  Config
+}
+
+// NewHandler returns a Handler that scans requests with s
+func NewHandler(s clamd.Scanner, next http.Handler, cfg Config) (h *Handler) {
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusUnprocessableEntity
+	}
+
+	if cfg.ErrorStatus == 0 {
+		cfg.ErrorStatus = http.StatusServiceUnavailable
+	}
+
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = DefaultMaxMemory
+	}
+
+	if cfg.Body == nil {
+		cfg.Body = infectedBody
+	}
+
+	h = &Handler{
+		s:    s,
+		next: next,
+		cfg:  cfg,
+	}
+
+	return
+}
+
+// Middleware returns a function that wraps a handler
+// with a Handler
+func Middleware(s clamd.Scanner, cfg Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return NewHandler(s, next, cfg)
+	}
+}
+
+// FromContext returns the Report added by a Handler
+func FromContext(ctx context.Context) (rep *Report, ok bool) {
+	rep, ok = ctx.Value(ctxKey{}).(*Report)
+	return
+}
+
+// ServeHTTP scans the request body, the downstream handler
+// gets a copy of the body and the Report in the context
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	sp := spool.New(h.cfg.MaxMemory)
+	defer sp.Close()
+
+	t := &teeReader{r: r.Body, w: sp}
+	rep := &Report{}
+
+	if err = h.scan(r, t, rep); err == nil {
+		_, err = io.Copy(ioutil.Discard, t)
+	}
+
+	switch {
+	case t.rerr != nil:
+		writeError(w, http.StatusBadRequest, badRequestErr)
+		return
+	case t.werr != nil:
+		writeError(w, http.StatusInternalServerError, spoolErr)
+		return
+	case errors.Is(err, ErrMalformed):
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, ErrPartTooLarge), errors.Is(err, ErrTooManyParts), errors.Is(err, clamd.ErrSizeLimitExceeded):
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case err != nil && !h.cfg.FailOpen:
+		writeError(w, h.cfg.ErrorStatus, scanErr)
+		return
+	case err != nil:
+		rep.Err = err
+		if _, err = io.Copy(ioutil.Discard, t); err != nil {
+			writeError(w, http.StatusBadRequest, badRequestErr)
+			return
+		}
+	}
+
+	if rep.Infected && !h.cfg.PassInfected {
+		writeJSON(w, h.cfg.Status, h.cfg.Body(rep))
+		return
+	}
+
+	if err = sp.Rewind(); err != nil {
+		writeError(w, http.StatusInternalServerError, spoolErr)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, rep))
+	r.Body = sp
+
+	h.next.ServeHTTP(w, r)
+}
+
+// scan scans the file parts of a multipart body or
+// the whole body
+func (h *Handler) scan(r *http.Request, t io.Reader, rep *Report) (err error) {
+	var n int
+	var part *multipart.Part
+
+	mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" || params["boundary"] == "" {
+		err = h.scanPart(r.Context(), rep, &Part{}, t)
+		return
+	}
+
+	mr := multipart.NewReader(t, params["boundary"])
+	for {
+		if part, err = mr.NextPart(); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			return
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		if n++; h.cfg.MaxParts > 0 && n > h.cfg.MaxParts {
+			err = ErrTooManyParts
+			return
+		}
+
+		p := &Part{
+			Field:    part.FormName(),
+			Filename: part.FileName(),
+		}
+		if err = h.scanPart(r.Context(), rep, p, part); err != nil {
+			return
+		}
+	}
+}
+
+func (h *Handler) scanPart(ctx context.Context, rep *Report, p *Part, i io.Reader) (err error) {
+	lr := &limitReader{r: i, max: h.cfg.MaxPartSize}
+	rep.Parts = append(rep.Parts, p)
+
+	p.Responses, err = h.s.ScanReader(ctx, lr)
+	p.Size = lr.n
+	if lr.exceeded {
+		err = ErrPartTooLarge
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, rs := range p.Responses {
+		if rs.Infected() {
+			p.Signature = rs.Signature
+			rep.Infected = true
+		}
+	}
+
+	err = scanError(p.Responses)
+
+	return
+}
+
+// scanError returns ErrScanFailed when the
+// verdict of r is a failure
+func scanError(r []*clamd.Response) (err error) {
+	if v := clamd.NewVerdict(r); v.Failed() {
+		err = fmt.Errorf("%w: %s", ErrScanFailed, v.Error)
+	}
+
+	return
+}
+
+// limitReader fails with ErrPartTooLarge when
+// more than max bytes are read
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	max      int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n += int64(n)
+
+	if l.max > 0 && l.n > l.max {
+		l.exceeded = true
+		n, err = 0, ErrPartTooLarge
+	}
+
+	return
+}
+
+func infectedBody(rep *Report) interface{} {
+	var parts []*Part
+
+	for _, p := range rep.Parts {
+		if p.Signature != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return &errorBody{
+		Error: infectedErr,
+		Parts: parts,
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &errorBody{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdhttp provides net/http middleware and a
+RoundTripper that scan request and response bodies with clamd.
+*/
+package clamdhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+type upload struct {
+	field, filename, content string
+}
+
+func multipartBody(t *testing.T, uploads ...upload) (body *bytes.Buffer, ct string) {
+	body = &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("comment", "not scanned")
+	for _, u := range uploads {
+		w, e := mw.CreateFormFile(u.field, u.filename)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		w.Write([]byte(u.content))
+	}
+	mw.Close()
+	ct = mw.FormDataContentType()
+
+	return
+}
+
+// downstream records the report and the body it received
+type downstream struct {
+	called bool
+	rep    *Report
+	body   []byte
+	form   map[string][]string
+}
+
+func (d *downstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.called = true
+	d.rep, _ = FromContext(r.Context())
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if e := r.ParseMultipartForm(1 << 20); e == nil {
+			d.form = r.MultipartForm.Value
+			for k, v := range r.MultipartForm.File {
+				d.form[k] = []string{v[0].Filename}
+			}
+		}
+	} else {
+		d.body, _ = ioutil.ReadAll(r.Body)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func testHandler(t *testing.T, cfg Config) (h *Handler, d *downstream, srv *clamdtest.Server) {
+	srv = clamdtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	c, e := clamd.NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	d = &downstream{}
+	h = NewHandler(c, d, cfg)
+
+	return
+}
+
+func serve(h http.Handler, body *bytes.Buffer, ct string) (rr *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", ct)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	return
+}
+
+func TestHandlerMultipart(t *testing.T) {
+	eicar, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	big := strings.Repeat("clean ", 1<<18)
+
+	h, d, _ := testHandler(t, Config{MaxMemory: 1024})
+
+	// Clean uploads are passed downstream intact
+	body, ct := multipartBody(t, upload{"a", "a.txt", "hello"}, upload{"b", "b.bin", big})
+	rr := serve(h, body, ct)
+	if rr.Code != http.StatusNoContent || !d.called {
+		t.Fatalf("Expected the request to be passed got %d", rr.Code)
+	}
+	if len(d.rep.Parts) != 2 || d.rep.Infected {
+		t.Fatalf("Unexpected report %+v", d.rep)
+	}
+	if p := d.rep.Parts[1]; p.Field != "b" || p.Filename != "b.bin" || p.Size != int64(len(big)) || len(p.Responses) != 1 {
+		t.Errorf("Unexpected part %+v", p)
+	}
+	if d.form["comment"][0] != "not scanned" || d.form["b"][0] != "b.bin" {
+		t.Errorf("Expected the downstream handler to get the form got %v", d.form)
+	}
+
+	// Infected uploads are rejected
+	*d = downstream{}
+	body, ct = multipartBody(t, upload{"a", "a.txt", "hello"}, upload{"v", "eicar.com", string(eicar)})
+	rr = serve(h, body, ct)
+	if rr.Code != http.StatusUnprocessableEntity || d.called {
+		t.Fatalf("Expected the request to be rejected got %d", rr.Code)
+	}
+	var eb errorBody
+	if e = json.NewDecoder(rr.Body).Decode(&eb); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if eb.Error != infectedErr || len(eb.Parts) != 1 || eb.Parts[0].Signature != clamdtest.EicarSignature || eb.Parts[0].Filename != "eicar.com" {
+		t.Errorf("Unexpected body %+v", eb)
+	}
+}
+
+func TestHandlerConfig(t *testing.T) {
+	eicar, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	h, d, _ := testHandler(t, Config{
+		Status:       http.StatusForbidden,
+		Body:         func(rep *Report) interface{} { return rep },
+		PassInfected: false,
+	})
+	rr := serve(h, bytes.NewBuffer(eicar), "application/octet-stream")
+	if rr.Code != http.StatusForbidden || d.called {
+		t.Fatalf("Expected the request to be rejected got %d", rr.Code)
+	}
+	var rep Report
+	if e = json.NewDecoder(rr.Body).Decode(&rep); e != nil || !rep.Infected || len(rep.Parts) != 1 {
+		t.Errorf("Unexpected body %+v, %v", rep, e)
+	}
+
+	// Infected requests are annotated
+	h, d, _ = testHandler(t, Config{PassInfected: true})
+	rr = serve(h, bytes.NewBuffer(eicar), "application/octet-stream")
+	if rr.Code != http.StatusNoContent || !d.rep.Infected || !bytes.Equal(d.body, eicar) {
+		t.Errorf("Expected the request to be passed got %d %+v", rr.Code, d.rep)
+	}
+	if p := d.rep.Parts[0]; p.Signature != clamdtest.EicarSignature || p.Size != int64(len(eicar)) {
+		t.Errorf("Unexpected part %+v", p)
+	}
+
+	// Requests without a body are not scanned
+	*d = downstream{}
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !d.called || d.rep != nil {
+		t.Errorf("Expected the request to be passed without a report")
+	}
+}
+
+func TestHandlerLimits(t *testing.T) {
+	h, d, _ := testHandler(t, Config{MaxPartSize: 10, MaxParts: 2})
+
+	body, ct := multipartBody(t, upload{"a", "a.txt", "0123456789"}, upload{"b", "b.txt", "01234567890"})
+	if rr := serve(h, body, ct); rr.Code != http.StatusRequestEntityTooLarge || d.called {
+		t.Errorf("Expected 413 got %d", rr.Code)
+	}
+
+	body, ct = multipartBody(t, upload{"a", "a.txt", "1"}, upload{"b", "b.txt", "2"}, upload{"c", "c.txt", "3"})
+	rr := serve(h, body, ct)
+	if rr.Code != http.StatusRequestEntityTooLarge || d.called {
+		t.Errorf("Expected 413 got %d", rr.Code)
+	}
+	var eb errorBody
+	if json.NewDecoder(rr.Body).Decode(&eb); eb.Error != ErrTooManyParts.Error() {
+		t.Errorf("Expected %q got %q", ErrTooManyParts, eb.Error)
+	}
+
+	body, ct = multipartBody(t, upload{"a", "a.txt", "0123456789"}, upload{"b", "b.txt", "1"})
+	if rr := serve(h, body, ct); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected the request to be passed got %d", rr.Code)
+	}
+
+	body, _ = multipartBody(t, upload{"a", "a.txt", "1"})
+	if rr := serve(h, body, "multipart/form-data; boundary=wrong"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 got %d", rr.Code)
+	}
+}
+
+func TestHandlerFailure(t *testing.T) {
+	h, d, srv := testHandler(t, Config{})
+	srv.Close()
+
+	if rr := serve(h, bytes.NewBufferString("data"), "text/plain"); rr.Code != http.StatusServiceUnavailable || d.called {
+		t.Errorf("Expected 503 got %d", rr.Code)
+	}
+
+	h.cfg.FailOpen = true
+	body, ct := multipartBody(t, upload{"a", "a.txt", "data"}, upload{"b", "b.txt", "more"})
+	if rr := serve(h, body, ct); rr.Code != http.StatusNoContent || !d.called {
+		t.Fatalf("Expected the request to be passed got %d", rr.Code)
+	}
+	if d.rep.Err == nil {
+		t.Errorf("Expected the scan error to be reported")
+	}
+	if d.form["b"][0] != "b.txt" {
+		t.Errorf("Expected the downstream handler to get the whole body got %v", d.form)
+	}
+}
+
+func TestHandlerScanError(t *testing.T) {
+	h, d, srv := testHandler(t, Config{})
+	srv.InjectFault("INSTREAM", clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"})
+
+	if rr := serve(h, bytes.NewBufferString("data"), "text/plain"); rr.Code != http.StatusServiceUnavailable || d.called {
+		t.Errorf("Expected 503 got %d", rr.Code)
+	}
+
+	h.cfg.FailOpen = true
+	if rr := serve(h, bytes.NewBufferString("data"), "text/plain"); rr.Code != http.StatusNoContent || !d.called {
+		t.Fatalf("Expected the request to be passed got %d", rr.Code)
+	}
+	if !errors.Is(d.rep.Err, ErrScanFailed) || !strings.Contains(d.rep.Err.Error(), "Can't allocate memory") {
+		t.Errorf("Expected %v got %v", ErrScanFailed, d.rep.Err)
+	}
+	if string(d.body) != "data" {
+		t.Errorf("Expected the downstream handler to get the body got %q", d.body)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdhttp provides net/http middleware and a
+RoundTripper that scan request and response bodies with clamd.
+*/
+package clamdhttp
+
+import (
+	"io"
+
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+// teeReader writes what it reads to the spool, it keeps
+// the read and write errors apart
+type teeReader struct {
+	r    io.Reader
+	w    *spool.Spool
+	rerr error
+	werr error
+}
+
+func (t *teeReader) Read(p []byte) (n int, err error) {
+	n, err = t.r.Read(p)
+	if n > 0 {
+		if _, e := t.w.Write(p[:n]); e != nil {
+			t.werr = e
+			err = e
+			return
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		t.rerr = err
+	}
+
+	return
+}
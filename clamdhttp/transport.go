@@ -0,0 +1,186 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdhttp provides net/http middleware and a
+RoundTripper that scan request and response bodies with clamd.
+*/
+package clamdhttp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+const (
+	virusErr = "Virus %s found in %s"
+)
+
+// A VirusError is returned by a Transport when
+// a response body is infected
+type VirusError struct {
+	URL       string
+	Signature string
+	Responses []*clamd.Response
+}
+
+func (e *VirusError) Error() string {
+	return fmt.Sprintf(virusErr, e.Signature, e.URL)
+}
+
+// TransportConfig holds the Transport settings
+type TransportConfig struct {
+	// MaxMemory is the size of a response body that is kept in
+	// memory, larger bodies are kept in a temporary file
+	MaxMemory int64
+	// BypassSize is the size above which response bodies are
+	// returned without being scanned, zero scans every body
+	BypassSize int64
+	// BypassTypes are the media types that are not scanned,
+	// a type of the form "image/*" matches every subtype
+	BypassTypes []string
+	// Bypass returns true for the responses that
+	// should not be scanned
+	Bypass func(resp *http.Response) bool
+	// FailOpen returns the response when the body could
+	// not be scanned instead of the scan error
+	FailOpen bool
+}
+
+// A Transport is an http.RoundTripper that scans response
+// bodies before they are returned, a response with an
+// infected body is replaced by a VirusError
+type Transport struct {
+	s    clamd.Scanner
+	base http.RoundTripper
+	cfg  TransportConfig
+}
+
+// NewTransport returns a Transport that makes requests with
+// base and scans the responses with s, http.DefaultTransport
+// is used when base is nil
+func NewTransport(s clamd.Scanner, base http.RoundTripper, cfg TransportConfig) (t *Transport) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = DefaultMaxMemory
+	}
+
+	t = &Transport{
+		s:    s,
+		base: base,
+		cfg:  cfg,
+	}
+
+	return
+}
+
+// RoundTrip makes the request and scans the response body,
+// the body returned is the spooled copy of the original
+func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	var r []*clamd.Response
+
+	if resp, err = t.base.RoundTrip(req); err != nil || t.bypass(req, resp) {
+		return
+	}
+
+	body := resp.Body
+	sp := spool.New(t.cfg.MaxMemory)
+	tee := &teeReader{r: body, w: sp}
+	lr := &limitReader{r: tee, max: t.cfg.BypassSize}
+
+	r, err = t.s.ScanReader(req.Context(), lr)
+
+	switch {
+	case tee.rerr != nil:
+		err = tee.rerr
+	case tee.werr != nil:
+		err = tee.werr
+	case lr.exceeded:
+		err = nil
+	case err != nil:
+		if t.cfg.FailOpen {
+			err = nil
+		}
+	default:
+		for _, rs := range r {
+			if rs.Infected() {
+				err = &VirusError{
+					URL:       req.URL.String(),
+					Signature: rs.Signature,
+					Responses: r,
+				}
+				break
+			}
+		}
+		if err == nil && !t.cfg.FailOpen {
+			err = scanError(r)
+		}
+	}
+
+	if err == nil {
+		err = sp.Rewind()
+	}
+
+	if err != nil {
+		sp.Close()
+		body.Close()
+		resp = nil
+		return
+	}
+
+	resp.Body = &spoolBody{
+		Reader: io.MultiReader(sp, body),
+		sp:     sp,
+		body:   body,
+	}
+
+	return
+}
+
+// bypass returns true when resp is not scanned
+func (t *Transport) bypass(req *http.Request, resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody || req.Method == http.MethodHead {
+		return true
+	}
+
+	if t.cfg.BypassSize > 0 && resp.ContentLength > t.cfg.BypassSize {
+		return true
+	}
+
+	if len(t.cfg.BypassTypes) > 0 {
+		mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		for _, bt := range t.cfg.BypassTypes {
+			if mt == bt || (strings.HasSuffix(bt, "/*") && strings.HasPrefix(mt, bt[:len(bt)-1])) {
+				return true
+			}
+		}
+	}
+
+	return t.cfg.Bypass != nil && t.cfg.Bypass(resp)
+}
+
+// spoolBody returns the spooled part of a response body
+// followed by the part that was not read
+type spoolBody struct {
+	io.Reader
+	sp   *spool.Spool
+	body io.ReadCloser
+}
+
+func (b *spoolBody) Close() (err error) {
+	b.sp.Close()
+	err = b.body.Close()
+
+	return
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdhttp provides net/http middleware and a
+RoundTripper that scan request and response bodies with clamd.
+*/
+package clamdhttp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func testTransport(t *testing.T, cfg TransportConfig) (hc *http.Client, srv *clamdtest.Server, url string) {
+	eicar, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	files := map[string]struct {
+		ct, body string
+	}{
+		"/clean":  {"text/plain", strings.Repeat("clean ", 1<<16)},
+		"/sized":  {"text/plain", strings.Repeat("clean ", 1<<16)},
+		"/eicar":  {"application/octet-stream", string(eicar)},
+		"/image":  {"image/png; x=y", string(eicar)},
+		"/script": {"text/x-sh", string(eicar)},
+	}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", f.ct)
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(f.body)))
+		}
+		w.Write([]byte(f.body))
+	}))
+	t.Cleanup(hs.Close)
+
+	srv = clamdtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	c, e := clamd.NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	hc = &http.Client{Transport: NewTransport(c, nil, cfg)}
+	url = hs.URL
+
+	return
+}
+
+func get(t *testing.T, hc *http.Client, url string) (body string, err error) {
+	var b []byte
+	var resp *http.Response
+
+	if resp, err = hc.Get(url); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	body = string(b)
+
+	return
+}
+
+func TestTransport(t *testing.T) {
+	hc, srv, url := testTransport(t, TransportConfig{
+		MaxMemory:   1024,
+		BypassTypes: []string{"image/*"},
+		Bypass:      func(resp *http.Response) bool { return resp.Request.URL.Path == "/script" },
+	})
+
+	body, e := get(t, hc, url+"/clean")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if body != strings.Repeat("clean ", 1<<16) {
+		t.Errorf("Expected the body to be returned intact got %d bytes", len(body))
+	}
+
+	_, e = get(t, hc, url+"/eicar")
+	var ve *VirusError
+	if !errors.As(e, &ve) {
+		t.Fatalf("Expected a VirusError got %v", e)
+	}
+	if ve.Signature != clamdtest.EicarSignature || ve.URL != url+"/eicar" || len(ve.Responses) != 1 {
+		t.Errorf("Unexpected error %+v", ve)
+	}
+
+	for _, p := range []string{"/image", "/script"} {
+		if body, e = get(t, hc, url+p); e != nil || !strings.Contains(body, "EICAR") {
+			t.Errorf("Expected %s to be bypassed got %v", p, e)
+		}
+	}
+	if n := srv.Commands("INSTREAM"); n != 2 {
+		t.Errorf("Expected 2 scans got %d", n)
+	}
+
+	if _, e = get(t, hc, url+"/missing"); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+}
+
+func TestTransportBypassSize(t *testing.T) {
+	hc, srv, url := testTransport(t, TransportConfig{BypassSize: 1000})
+
+	body, e := get(t, hc, url+"/sized")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if body != strings.Repeat("clean ", 1<<16) {
+		t.Errorf("Expected the body to be returned intact got %d bytes", len(body))
+	}
+	if n := srv.Commands("INSTREAM"); n != 0 {
+		t.Errorf("Expected a large Content-Length not to be scanned got %d", n)
+	}
+
+	// The body is chunked, scanning stops at the bypass size
+	if body, e = get(t, hc, url+"/clean"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if body != strings.Repeat("clean ", 1<<16) {
+		t.Errorf("Expected the body to be returned intact got %d bytes", len(body))
+	}
+
+	if _, e = get(t, hc, url+"/eicar"); e == nil {
+		t.Errorf("Expected a small body to be scanned")
+	}
+}
+
+func TestTransportFailure(t *testing.T) {
+	hc, srv, url := testTransport(t, TransportConfig{})
+	srv.Close()
+
+	if _, e := get(t, hc, url+"/clean"); e == nil {
+		t.Errorf("Expected the scan error to be returned")
+	}
+
+	hc.Transport.(*Transport).cfg.FailOpen = true
+	if body, e := get(t, hc, url+"/clean"); e != nil || len(body) != 6<<16 {
+		t.Errorf("Expected the response to be returned got %d bytes, %v", len(body), e)
+	}
+}
+
+func TestTransportScanError(t *testing.T) {
+	hc, srv, url := testTransport(t, TransportConfig{})
+	srv.InjectFault("INSTREAM", clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"})
+
+	if _, e := get(t, hc, url+"/clean"); !errors.Is(e, ErrScanFailed) {
+		t.Errorf("Expected %v got %v", ErrScanFailed, e)
+	}
+
+	hc.Transport.(*Transport).cfg.FailOpen = true
+	if body, e := get(t, hc, url+"/clean"); e != nil || len(body) != 6<<16 {
+		t.Errorf("Expected the response to be returned got %d bytes, %v", len(body), e)
+	}
+}
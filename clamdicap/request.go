@@ -0,0 +1,278 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdicap provides an ICAP (RFC 3507) server that
+scans the messages of HTTP proxies with clamd.
+*/
+package clamdicap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	icapProto   = "ICAP/1.0"
+	reqHdr      = "req-hdr"
+	resHdr      = "res-hdr"
+	reqBody     = "req-body"
+	resBody     = "res-body"
+	nullBody    = "null-body"
+	optBody     = "opt-body"
+	maxChunkLen = 1 << 31
+	// MaxHeaderSize is the largest size of the encapsulated
+	// HTTP headers that is accepted
+	MaxHeaderSize = 64 * 1024
+)
+
+var (
+	// ErrMalformed is returned when an ICAP request
+	// can not be parsed
+	ErrMalformed = errors.New("Malformed ICAP request")
+)
+
+// section is an entry of the Encapsulated header
+type section struct {
+	name   string
+	offset int
+}
+
+// Request is an ICAP request, the body is read
+// from the connection by the handler
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	// ReqHdr and ResHdr are the encapsulated HTTP headers
+	ReqHdr []byte
+	ResHdr []byte
+	// Body is the name of the body section, it is
+	// empty for null-body
+	Body string
+	// Preview is the size of the preview, -1 means
+	// the request has no preview
+	Preview  int
+	Allow204 bool
+}
+
+// readRequest reads the ICAP headers and the encapsulated
+// HTTP headers of a request
+func readRequest(br *bufio.Reader) (req *Request, err error) {
+	var line string
+	var sections []section
+
+	tr := textproto.NewReader(br)
+	if line, err = tr.ReadLine(); err != nil {
+		return
+	}
+
+	parts := strings.Fields(line)
+	if len(parts) != 3 || parts[2] != icapProto {
+		err = malformed("request line %q", line)
+		return
+	}
+
+	req = &Request{
+		Method:  parts[0],
+		Preview: -1,
+	}
+
+	if req.URL, err = url.Parse(parts[1]); err != nil {
+		err = malformed("URI %q", parts[1])
+		return
+	}
+
+	if req.Header, err = tr.ReadMIMEHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if v := req.Header.Get("Preview"); v != "" {
+		if req.Preview, err = strconv.Atoi(v); err != nil || req.Preview < 0 {
+			err = malformed("Preview %q", v)
+			return
+		}
+	}
+
+	for _, v := range strings.Split(req.Header.Get("Allow"), ",") {
+		if strings.TrimSpace(v) == "204" {
+			req.Allow204 = true
+		}
+	}
+
+	if sections, err = parseEncapsulated(req.Header.Get("Encapsulated")); err != nil {
+		return
+	}
+
+	err = req.readSections(br, sections)
+
+	return
+}
+
+// readSections reads the encapsulated headers, the body
+// section is always the last one
+func (req *Request) readSections(br *bufio.Reader, sections []section) (err error) {
+	for i, s := range sections {
+		if i == len(sections)-1 {
+			switch s.name {
+			case reqBody, resBody, optBody:
+				req.Body = s.name
+				return
+			case nullBody:
+				return
+			}
+		}
+
+		b := make([]byte, sections[i+1].offset-s.offset)
+		if _, err = io.ReadFull(br, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		switch s.name {
+		case reqHdr:
+			req.ReqHdr = b
+		case resHdr:
+			req.ResHdr = b
+		default:
+			err = malformed("Encapsulated section %q", s.name)
+			return
+		}
+	}
+
+	return
+}
+
+// parseEncapsulated parses the Encapsulated header, a missing
+// header is treated as a request without a body
+func parseEncapsulated(v string) (sections []section, err error) {
+	if v == "" {
+		return
+	}
+
+	for _, e := range strings.Split(v, ",") {
+		var s section
+
+		kv := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		if len(kv) != 2 {
+			err = malformed("Encapsulated %q", v)
+			return
+		}
+
+		s.name = kv[0]
+		if s.offset, err = strconv.Atoi(kv[1]); err != nil || s.offset < 0 {
+			err = malformed("Encapsulated %q", v)
+			return
+		}
+
+		sections = append(sections, s)
+	}
+
+	if !sort.SliceIsSorted(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset }) {
+		err = malformed("Encapsulated %q", v)
+		return
+	}
+
+	last := sections[len(sections)-1]
+	if last.name != reqBody && last.name != resBody && last.name != nullBody && last.name != optBody {
+		err = malformed("Encapsulated %q", v)
+		return
+	}
+
+	// The body starts after the headers
+	if last.offset > MaxHeaderSize {
+		err = malformed("Encapsulated headers of %d bytes exceed the limit", last.offset)
+	}
+
+	return
+}
+
+// requestURL returns the URL of the encapsulated
+// HTTP request, it is empty when there is none
+func (req *Request) requestURL() string {
+	if len(req.ReqHdr) == 0 {
+		return ""
+	}
+
+	line := string(req.ReqHdr)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	if f := strings.Fields(line); len(f) == 3 {
+		return f[1]
+	}
+
+	return ""
+}
+
+// readChunks copies a chunked body to w, ieof is set when
+// the last chunk has the ieof extension
+func readChunks(br *bufio.Reader, w io.Writer) (ieof bool, err error) {
+	var line string
+	var n int64
+
+	tr := textproto.NewReader(br)
+	for {
+		if line, err = tr.ReadLine(); err != nil {
+			break
+		}
+
+		size, ext := line, ""
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			size, ext = line[:i], line[i+1:]
+		}
+
+		if n, err = strconv.ParseInt(strings.TrimSpace(size), 16, 64); err != nil || n < 0 || n > maxChunkLen {
+			err = malformed("chunk size %q", line)
+			return
+		}
+
+		if n == 0 {
+			ieof = strings.TrimSpace(ext) == "ieof"
+			// Trailers are not used by ICAP clients
+			for line != "" {
+				if line, err = tr.ReadLine(); err != nil {
+					break
+				}
+			}
+			break
+		}
+
+		if _, err = io.CopyN(w, br, n); err != nil {
+			break
+		}
+
+		if line, err = tr.ReadLine(); err != nil {
+			break
+		}
+		if line != "" {
+			err = malformed("chunk terminator %q", line)
+			return
+		}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+func malformed(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdicap provides an ICAP (RFC 3507) server that
+scans the messages of HTTP proxies with clamd.
+*/
+package clamdicap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseEncapsulated(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []section
+		err bool
+	}{
+		{"", nil, false},
+		{"null-body=0", []section{{nullBody, 0}}, false},
+		{"req-hdr=0, res-hdr=137, res-body=296", []section{{reqHdr, 0}, {resHdr, 137}, {resBody, 296}}, false},
+		{"req-hdr=0,req-body=20", []section{{reqHdr, 0}, {reqBody, 20}}, false},
+		{"req-hdr=0", nil, true},
+		{"req-hdr=10, req-body=5", nil, true},
+		{"req-hdr=x, req-body=5", nil, true},
+		{"req-body", nil, true},
+		{"res-hdr=0, null-body=65536", []section{{resHdr, 0}, {nullBody, 65536}}, false},
+		{"res-hdr=0, null-body=65537", nil, true},
+		{"res-hdr=0, null-body=4000000000", nil, true},
+		{"res-hdr=0, null-body=9000000000000000000", nil, true},
+		{"res-hdr=0, null-body=99999999999999999999", nil, true},
+	}
+
+	for _, tt := range tests {
+		s, e := parseEncapsulated(tt.in)
+		if tt.err {
+			if !errors.Is(e, ErrMalformed) {
+				t.Errorf("%q: expected %v got %v", tt.in, ErrMalformed, e)
+			}
+			continue
+		}
+		if e != nil || len(s) != len(tt.out) {
+			t.Errorf("%q: got %v, %v", tt.in, s, e)
+			continue
+		}
+		for i := range s {
+			if s[i] != tt.out[i] {
+				t.Errorf("%q: expected %v got %v", tt.in, tt.out, s)
+			}
+		}
+	}
+}
+
+func TestReadChunks(t *testing.T) {
+	tests := []struct {
+		in   string
+		out  string
+		ieof bool
+		err  error
+	}{
+		{"5\r\nhello\r\n0\r\n\r\n", "hello", false, nil},
+		{"5\r\nhello\r\n6\r\n world\r\n0; ieof\r\n\r\n", "hello world", true, nil},
+		{"A;name=x\r\n0123456789\r\n0\r\n\r\n", "0123456789", false, nil},
+		{"0; ieof\r\n\r\n", "", true, nil},
+		{"5\r\nhel", "hel", false, io.ErrUnexpectedEOF},
+		{"zz\r\n", "", false, ErrMalformed},
+		{"2\r\nhello\r\n0\r\n\r\n", "he", false, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		ieof, e := readChunks(bufio.NewReader(strings.NewReader(tt.in)), &buf)
+		if !errors.Is(e, tt.err) || (tt.err == nil && (buf.String() != tt.out || ieof != tt.ieof)) {
+			t.Errorf("%q: got %q, %t, %v", tt.in, buf.String(), ieof, e)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	in := "RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\n" +
+		"Host: 127.0.0.1\r\nAllow: 204, trailers\r\nPreview: 10\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(testReqHdr)) + ", res-body=" + strconv.Itoa(len(testReqHdr+testResHdr)) + "\r\n\r\n" +
+		testReqHdr + testResHdr + "0\r\n\r\n"
+
+	req, e := readRequest(bufio.NewReader(strings.NewReader(in)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if req.Method != "RESPMOD" || req.URL.Path != "/respmod" || !req.Allow204 || req.Preview != 10 || req.Body != resBody {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if string(req.ReqHdr) != testReqHdr || string(req.ResHdr) != testResHdr {
+		t.Errorf("Unexpected headers %q %q", req.ReqHdr, req.ResHdr)
+	}
+	if u := req.requestURL(); u != "http://example.com/file.bin" {
+		t.Errorf("Unexpected URL %q", u)
+	}
+
+	for _, in := range []string{
+		"RESPMOD icap://127.0.0.1/respmod\r\n\r\n",
+		"RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\nPreview: -1\r\n\r\n",
+		"RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\nEncapsulated: foo=0, res-body=5\r\n\r\n12345",
+		"RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\nEncapsulated: res-hdr=0, null-body=4000000000\r\n\r\n",
+		"RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\nEncapsulated: res-hdr=0, null-body=9000000000000000000\r\n\r\n",
+	} {
+		if _, e = readRequest(bufio.NewReader(strings.NewReader(in))); !errors.Is(e, ErrMalformed) {
+			t.Errorf("%q: expected %v got %v", in, ErrMalformed, e)
+		}
+	}
+}
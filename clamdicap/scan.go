@@ -0,0 +1,73 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdicap provides an ICAP (RFC 3507) server that
+scans the messages of HTTP proxies with clamd.
+*/
+package clamdicap
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/baruwa-enterprise/clamd"
+)
+
+var errScanDone = errors.New("The scan has ended")
+
+// scanWriter streams what is written to it to the server
+// with ScanReader, writes are accepted after the scan has
+// failed so the rest of the body can still be read
+type scanWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	werr error
+	r    []*clamd.Response
+	err  error
+}
+
+func newScanWriter(ctx context.Context, s clamd.Scanner) (sw *scanWriter) {
+	pr, pw := io.Pipe()
+	sw = &scanWriter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		sw.r, sw.err = s.ScanReader(ctx, pr)
+		pr.CloseWithError(errScanDone)
+		close(sw.done)
+	}()
+
+	return
+}
+
+func (sw *scanWriter) Write(p []byte) (n int, err error) {
+	if sw.werr == nil {
+		_, sw.werr = sw.pw.Write(p)
+	}
+
+	n = len(p)
+
+	return
+}
+
+// result ends the stream and returns the scan result
+func (sw *scanWriter) result() (r []*clamd.Response, err error) {
+	sw.pw.Close()
+	<-sw.done
+
+	r, err = sw.r, sw.err
+
+	return
+}
+
+// abort ends the scan without waiting for a result
+func (sw *scanWriter) abort(err error) {
+	sw.pw.CloseWithError(err)
+	<-sw.done
+}
@@ -0,0 +1,547 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdicap provides an ICAP (RFC 3507) server that
+scans the messages of HTTP proxies with clamd.
+*/
+package clamdicap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+const (
+	// DefaultPreview is the preview size requested by the server
+	DefaultPreview = 1024
+	// DefaultMaxMemory is the size of a body that is kept in
+	// memory when it has to be returned to the client
+	DefaultMaxMemory   = 10 * 1024 * 1024
+	defaultService     = "clamd ICAP service"
+	defaultIdleTimeout = 2 * time.Minute
+	defaultOptionsTTL  = time.Hour
+	istagTTL           = time.Minute
+	istagTimeout       = 5 * time.Second
+	bodyChunkSize      = 32 * 1024
+
+	statusContinue       = "100 Continue"
+	statusOK             = "200 OK"
+	statusNoContent      = "204 No Content"
+	statusBadRequest     = "400 Bad Request"
+	statusMethodNotAllow = "405 Method Not Allowed"
+	statusServerError    = "500 Server Error"
+	statusNotImplemented = "501 Method Not Implemented"
+
+	blockPage = `<html><head><title>Access denied</title></head><body>` +
+		`<h1>Access denied</h1><p>The content at %s was blocked ` +
+		`because the virus %s was found.</p></body></html>`
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close
+	ErrServerClosed = errors.New("The ICAP server is closed")
+	errScanFailed   = errors.New("The message could not be scanned")
+)
+
+// Config holds the server settings
+type Config struct {
+	// Service is the value of the Service header
+	Service string
+	// Preview is the preview size sent in OPTIONS responses,
+	// zero uses DefaultPreview and a negative value disables it
+	Preview int
+	// MaxMemory is the size of a body that is kept in memory,
+	// larger bodies are kept in a temporary file
+	MaxMemory int64
+	// FailOpen treats messages that could not be scanned as
+	// clean, they are rejected with 500 otherwise
+	FailOpen bool
+	// HeaderOnly returns infected messages unchanged with the
+	// X-Infection-Found header instead of a block page
+	HeaderOnly bool
+	// BlockPage returns the HTML body of the 403 response sent
+	// in place of an infected message
+	BlockPage func(signature, url string) []byte
+	// IdleTimeout is how long a connection waits for a request
+	IdleTimeout time.Duration
+	// OptionsTTL is the Options-TTL sent in OPTIONS responses
+	OptionsTTL time.Duration
+}
+
+// A Server is an ICAP server that scans REQMOD and
+// RESPMOD bodies with clamd
+type Server struct {
+	s      clamd.Scanner
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+
+	tagMu   sync.Mutex
+	istag   string
+	tagTime time.Time
+}
+
+// NewServer returns a Server that scans with s
+func NewServer(s clamd.Scanner, cfg Config) (srv *Server) {
+	if cfg.Service == "" {
+		cfg.Service = defaultService
+	}
+
+	if cfg.Preview == 0 {
+		cfg.Preview = DefaultPreview
+	}
+
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = DefaultMaxMemory
+	}
+
+	if cfg.BlockPage == nil {
+		cfg.BlockPage = defaultBlockPage
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+
+	if cfg.OptionsTTL <= 0 {
+		cfg.OptionsTTL = defaultOptionsTTL
+	}
+
+	srv = &Server{
+		s:         s,
+		cfg:       cfg,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+
+	return
+}
+
+// ListenAndServe listens on the TCP address addr and
+// serves the connections
+func (srv *Server) ListenAndServe(addr string) (err error) {
+	var l net.Listener
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+
+	err = srv.Serve(l)
+
+	return
+}
+
+// Serve serves the connections accepted on l, it
+// returns ErrServerClosed after Close
+func (srv *Server) Serve(l net.Listener) (err error) {
+	var conn net.Conn
+
+	if !srv.track(l, nil) {
+		l.Close()
+		err = ErrServerClosed
+		return
+	}
+	defer srv.untrack(l, nil)
+
+	for {
+		if conn, err = l.Accept(); err != nil {
+			if srv.isClosed() {
+				err = ErrServerClosed
+			}
+			return
+		}
+
+		if !srv.track(nil, conn) {
+			conn.Close()
+			continue
+		}
+
+		srv.wg.Add(1)
+		go func(conn net.Conn) {
+			defer srv.wg.Done()
+			defer srv.untrack(nil, conn)
+			srv.serveConn(conn)
+		}(conn)
+	}
+}
+
+// Close closes the listeners and the connections and
+// waits for the connections to be released
+func (srv *Server) Close() (err error) {
+	srv.mu.Lock()
+	srv.closed = true
+	srv.cancel()
+	for l := range srv.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+
+	return
+}
+
+func (srv *Server) track(l net.Listener, conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return false
+	}
+
+	if l != nil {
+		srv.listeners[l] = struct{}{}
+	}
+
+	if conn != nil {
+		srv.conns[conn] = struct{}{}
+	}
+
+	return true
+}
+
+func (srv *Server) untrack(l net.Listener, conn net.Conn) {
+	srv.mu.Lock()
+	delete(srv.listeners, l)
+	delete(srv.conns, conn)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+// serveConn serves the requests sent on a connection
+func (srv *Server) serveConn(conn net.Conn) {
+	var err error
+	var req *Request
+
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	for keep := true; keep; {
+		conn.SetReadDeadline(time.Now().Add(srv.cfg.IdleTimeout))
+		if req, err = readRequest(br); err != nil {
+			if errors.Is(err, ErrMalformed) {
+				srv.writeResponse(bw, statusBadRequest, nil, nil)
+				bw.Flush()
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if keep, err = srv.handle(req, br, bw); err != nil {
+			if errors.Is(err, ErrMalformed) {
+				srv.writeResponse(bw, statusBadRequest, nil, nil)
+			}
+			keep = false
+		}
+
+		if bw.Flush() != nil {
+			return
+		}
+
+		if strings.EqualFold(req.Header.Get("Connection"), "close") {
+			keep = false
+		}
+	}
+}
+
+// handle responds to a request, keep is false when
+// the connection can not be used again
+func (srv *Server) handle(req *Request, br *bufio.Reader, bw *bufio.Writer) (keep bool, err error) {
+	switch req.Method {
+	case "OPTIONS":
+		if req.Body != "" {
+			if _, err = readChunks(br, ioutil.Discard); err != nil {
+				return
+			}
+		}
+		srv.options(req, bw)
+		keep = true
+	case "REQMOD", "RESPMOD":
+		if !srv.allowed(req) {
+			// The body is not read, the connection is closed
+			srv.writeResponse(bw, statusMethodNotAllow, nil, nil)
+			return
+		}
+		keep, err = srv.modify(req, br, bw)
+	default:
+		srv.writeResponse(bw, statusNotImplemented, nil, nil)
+	}
+
+	return
+}
+
+// methods returns the methods of the service of a
+// request, it is set by the last path element
+func methods(req *Request) string {
+	p := strings.ToLower(req.URL.Path)
+	switch {
+	case strings.HasSuffix(p, "reqmod"):
+		return "REQMOD"
+	case strings.HasSuffix(p, "respmod"):
+		return "RESPMOD"
+	default:
+		return "REQMOD, RESPMOD"
+	}
+}
+
+func (srv *Server) allowed(req *Request) bool {
+	return strings.Contains(methods(req), req.Method)
+}
+
+func (srv *Server) options(req *Request, bw *bufio.Writer) {
+	hdr := []string{
+		"Methods: " + methods(req),
+		"Service: " + srv.cfg.Service,
+		"Allow: 204",
+		fmt.Sprintf("Options-TTL: %d", int(srv.cfg.OptionsTTL/time.Second)),
+	}
+
+	if srv.cfg.Preview > 0 {
+		hdr = append(hdr, fmt.Sprintf("Preview: %d", srv.cfg.Preview), "Transfer-Preview: *")
+	}
+
+	srv.writeResponse(bw, statusOK, hdr, nil)
+}
+
+// modify scans the body of a REQMOD or RESPMOD request
+func (srv *Server) modify(req *Request, br *bufio.Reader, bw *bufio.Writer) (keep bool, err error) {
+	var ieof bool
+	var r []*clamd.Response
+	var sp *spool.Spool
+
+	m := &message{req: req}
+	if req.Method == "REQMOD" {
+		m.hdrName, m.hdr, m.bodyName = reqHdr, req.ReqHdr, reqBody
+	} else {
+		m.hdrName, m.hdr, m.bodyName = resHdr, req.ResHdr, resBody
+	}
+
+	if req.Body == "" {
+		srv.clean(bw, m, req.Allow204 || req.Preview >= 0)
+		keep = true
+		return
+	}
+
+	// The body is kept when it may have to be returned
+	var w io.Writer
+	sw := newScanWriter(srv.ctx, srv.s)
+	if !req.Allow204 || srv.cfg.HeaderOnly {
+		sp = spool.New(srv.cfg.MaxMemory)
+		defer sp.Close()
+		m.body = sp
+		w = io.MultiWriter(sw, sp)
+	} else {
+		w = sw
+	}
+
+	if ieof, err = readChunks(br, w); err != nil {
+		sw.abort(err)
+		return
+	}
+
+	preview := req.Preview >= 0 && ieof
+	if req.Preview >= 0 && !ieof {
+		srv.writeResponse(bw, statusContinue, nil, nil)
+		if err = bw.Flush(); err != nil {
+			sw.abort(err)
+			return
+		}
+		if _, err = readChunks(br, w); err != nil {
+			sw.abort(err)
+			return
+		}
+	}
+
+	keep = true
+	if r, err = sw.result(); err == nil && clamd.NewVerdict(r).Failed() {
+		err = errScanFailed
+	}
+	if err != nil {
+		err = nil
+		if !srv.cfg.FailOpen {
+			srv.writeResponse(bw, statusServerError, nil, nil)
+			return
+		}
+	}
+
+	if sp != nil {
+		if err = sp.Rewind(); err != nil {
+			err = nil
+			srv.writeResponse(bw, statusServerError, nil, nil)
+			return
+		}
+	}
+
+	for _, rs := range r {
+		if rs.Infected() {
+			srv.infected(bw, m, rs.Signature)
+			return
+		}
+	}
+
+	srv.clean(bw, m, req.Allow204 || preview)
+
+	return
+}
+
+// message is the encapsulated message of a request
+type message struct {
+	req      *Request
+	hdrName  string
+	hdr      []byte
+	bodyName string
+	body     io.Reader
+}
+
+// clean returns the message unchanged or 204
+func (srv *Server) clean(bw *bufio.Writer, m *message, allow204 bool) {
+	if allow204 {
+		srv.writeResponse(bw, statusNoContent, nil, nil)
+		return
+	}
+
+	srv.writeResponse(bw, statusOK, nil, m)
+}
+
+// infected returns the block page, or the message
+// unchanged with the infection headers
+func (srv *Server) infected(bw *bufio.Writer, m *message, sig string) {
+	resolution := 2
+	if srv.cfg.HeaderOnly {
+		resolution = 0
+	}
+
+	hdr := []string{
+		fmt.Sprintf("X-Infection-Found: Type=0; Resolution=%d; Threat=%s;", resolution, sig),
+		"X-Virus-ID: " + sig,
+	}
+
+	if srv.cfg.HeaderOnly {
+		srv.writeResponse(bw, statusOK, hdr, m)
+		return
+	}
+
+	body := srv.cfg.BlockPage(sig, m.req.requestURL())
+	page := &message{
+		hdrName: resHdr,
+		hdr: []byte(fmt.Sprintf("HTTP/1.1 403 Forbidden\r\n"+
+			"Content-Type: text/html; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Cache-Control: no-store\r\n\r\n", len(body))),
+		bodyName: resBody,
+		body:     strings.NewReader(string(body)),
+	}
+
+	srv.writeResponse(bw, statusOK, hdr, page)
+}
+
+// writeResponse writes an ICAP response, m is the
+// encapsulated message when it is not nil
+func (srv *Server) writeResponse(bw *bufio.Writer, status string, hdr []string, m *message) {
+	fmt.Fprintf(bw, "%s %s\r\n", icapProto, status)
+	if status == statusContinue {
+		bw.WriteString("\r\n")
+		return
+	}
+
+	fmt.Fprintf(bw, "ISTag: \"%s\"\r\n", srv.tag())
+	fmt.Fprintf(bw, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123))
+	for _, h := range hdr {
+		bw.WriteString(h + "\r\n")
+	}
+
+	switch {
+	case m == nil:
+		bw.WriteString("Encapsulated: null-body=0\r\n\r\n")
+	case m.body == nil:
+		fmt.Fprintf(bw, "Encapsulated: %s=0, null-body=%d\r\n\r\n", m.hdrName, len(m.hdr))
+		bw.Write(m.hdr)
+	case len(m.hdr) == 0:
+		fmt.Fprintf(bw, "Encapsulated: %s=0\r\n\r\n", m.bodyName)
+		writeChunks(bw, m.body)
+	default:
+		fmt.Fprintf(bw, "Encapsulated: %s=0, %s=%d\r\n\r\n", m.hdrName, m.bodyName, len(m.hdr))
+		bw.Write(m.hdr)
+		writeChunks(bw, m.body)
+	}
+}
+
+// writeChunks writes r as a chunked body
+func writeChunks(bw *bufio.Writer, r io.Reader) {
+	buf := make([]byte, bodyChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	bw.WriteString("0\r\n\r\n")
+}
+
+// tag returns the ISTag, it changes when the
+// signature database is updated
+func (srv *Server) tag() string {
+	srv.tagMu.Lock()
+	defer srv.tagMu.Unlock()
+
+	if srv.istag != "" && time.Since(srv.tagTime) < istagTTL {
+		return srv.istag
+	}
+
+	ctx, cancel := context.WithTimeout(srv.ctx, istagTimeout)
+	defer cancel()
+
+	if v, err := srv.s.VersionInfo(ctx); err == nil {
+		srv.istag = fmt.Sprintf("clamd-%d", v.DatabaseVersion)
+	} else if srv.istag == "" {
+		srv.istag = "clamd"
+	}
+	srv.tagTime = time.Now()
+
+	return srv.istag
+}
+
+func defaultBlockPage(sig, url string) []byte {
+	return []byte(fmt.Sprintf(blockPage, html.EscapeString(url), html.EscapeString(sig)))
+}
@@ -0,0 +1,383 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdicap provides an ICAP (RFC 3507) server that
+scans the messages of HTTP proxies with clamd.
+*/
+package clamdicap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+const (
+	testReqHdr = "GET http://example.com/file.bin HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	testResHdr = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+)
+
+type icapResponse struct {
+	status string
+	header textproto.MIMEHeader
+	hdr    string
+	body   []byte
+}
+
+type icapClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func testServer(t *testing.T, cfg Config) (srv *Server, cs *clamdtest.Server, addr string) {
+	cs = clamdtest.NewServer()
+	t.Cleanup(cs.Close)
+
+	c, e := clamd.NewClient(cs.Network, cs.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	srv = NewServer(c, cfg)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	addr = l.Addr().String()
+
+	return
+}
+
+func dial(t *testing.T, addr string) (ic *icapClient) {
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	ic = &icapClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+
+	return
+}
+
+func chunked(b []byte, ieof bool) string {
+	var s strings.Builder
+	if len(b) > 0 {
+		fmt.Fprintf(&s, "%x\r\n%s\r\n", len(b), b)
+	}
+	if ieof {
+		s.WriteString("0; ieof\r\n\r\n")
+	} else {
+		s.WriteString("0\r\n\r\n")
+	}
+	return s.String()
+}
+
+// request sends a request with a preview of preview bytes
+// when preview is not negative
+func (ic *icapClient) request(method, uri string, hdr []string, body []byte, preview int) (r *icapResponse) {
+	var enc string
+	var encap string
+
+	switch method {
+	case "REQMOD":
+		encap = testReqHdr
+		if body == nil {
+			enc = fmt.Sprintf("req-hdr=0, null-body=%d", len(testReqHdr))
+		} else {
+			enc = fmt.Sprintf("req-hdr=0, req-body=%d", len(testReqHdr))
+		}
+	case "RESPMOD":
+		encap = testReqHdr + testResHdr
+		if body == nil {
+			enc = fmt.Sprintf("req-hdr=0, res-hdr=%d, null-body=%d", len(testReqHdr), len(encap))
+		} else {
+			enc = fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(testReqHdr), len(encap))
+		}
+	default:
+		enc = "null-body=0"
+	}
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "%s icap://%s%s ICAP/1.0\r\nHost: test\r\nEncapsulated: %s\r\n", method, ic.conn.RemoteAddr(), uri, enc)
+	if preview >= 0 {
+		fmt.Fprintf(&s, "Preview: %d\r\n", preview)
+	}
+	for _, h := range hdr {
+		s.WriteString(h + "\r\n")
+	}
+	s.WriteString("\r\n")
+	s.WriteString(encap)
+
+	if body != nil {
+		if preview >= 0 && len(body) > preview {
+			s.WriteString(chunked(body[:preview], false))
+			ic.write(s.String())
+			if r = ic.response(); r.status != "100 Continue" {
+				return
+			}
+			ic.write(chunked(body[preview:], false))
+			r = ic.response()
+			return
+		}
+		s.WriteString(chunked(body, preview >= 0))
+	}
+
+	ic.write(s.String())
+	r = ic.response()
+
+	return
+}
+
+func (ic *icapClient) write(s string) {
+	if _, e := ic.conn.Write([]byte(s)); e != nil {
+		ic.t.Fatalf("An error should not be returned: %s", e)
+	}
+}
+
+func (ic *icapClient) response() (r *icapResponse) {
+	tr := textproto.NewReader(ic.br)
+	line, e := tr.ReadLine()
+	if e != nil {
+		ic.t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !strings.HasPrefix(line, "ICAP/1.0 ") {
+		ic.t.Fatalf("Unexpected status line %q", line)
+	}
+
+	r = &icapResponse{status: line[len("ICAP/1.0 "):]}
+	if r.header, e = tr.ReadMIMEHeader(); e != nil {
+		ic.t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r.status == "100 Continue" {
+		return
+	}
+
+	sections, e := parseEncapsulated(r.header.Get("Encapsulated"))
+	if e != nil {
+		ic.t.Fatalf("An error should not be returned: %s", e)
+	}
+	req := &Request{}
+	if e = req.readSections(ic.br, sections); e != nil {
+		ic.t.Fatalf("An error should not be returned: %s", e)
+	}
+	r.hdr = string(req.ReqHdr) + string(req.ResHdr)
+	if req.Body != "" {
+		var buf bytes.Buffer
+		if _, e = readChunks(ic.br, &buf); e != nil {
+			ic.t.Fatalf("An error should not be returned: %s", e)
+		}
+		r.body = buf.Bytes()
+	}
+
+	return
+}
+
+func TestOptions(t *testing.T) {
+	_, _, addr := testServer(t, Config{})
+	ic := dial(t, addr)
+
+	tests := []struct {
+		uri     string
+		methods string
+	}{
+		{"/respmod", "RESPMOD"},
+		{"/reqmod", "REQMOD"},
+		{"/avscan", "REQMOD, RESPMOD"},
+	}
+	for _, tt := range tests {
+		r := ic.request("OPTIONS", tt.uri, nil, nil, -1)
+		if r.status != "200 OK" {
+			t.Fatalf("Expected 200 OK got %q", r.status)
+		}
+		if m := r.header.Get("Methods"); m != tt.methods {
+			t.Errorf("Expected %q got %q", tt.methods, m)
+		}
+		if r.header.Get("ISTag") != `"clamd-26850"` || r.header.Get("Preview") != "1024" || r.header.Get("Allow") != "204" {
+			t.Errorf("Unexpected headers %v", r.header)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	eicar, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	clean := bytes.Repeat([]byte("clean "), 10000)
+
+	_, cs, addr := testServer(t, Config{MaxMemory: 1024})
+	ic := dial(t, addr)
+
+	// Clean bodies get 204 after the preview
+	r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, clean, 1024)
+	if r.status != "204 No Content" || r.header.Get("ISTag") == "" {
+		t.Errorf("Expected 204 got %q %v", r.status, r.header)
+	}
+
+	// Infected bodies are replaced by a block page
+	r = ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, eicar, 1024)
+	if r.status != "200 OK" {
+		t.Fatalf("Expected 200 OK got %q", r.status)
+	}
+	if h := r.header.Get("X-Infection-Found"); h != "Type=0; Resolution=2; Threat="+clamdtest.EicarSignature+";" {
+		t.Errorf("Unexpected X-Infection-Found %q", h)
+	}
+	if !strings.HasPrefix(r.hdr, "HTTP/1.1 403 Forbidden\r\n") || !strings.Contains(string(r.body), clamdtest.EicarSignature) || !strings.Contains(string(r.body), "http://example.com/file.bin") {
+		t.Errorf("Unexpected block page %q %q", r.hdr, r.body)
+	}
+
+	// Clean bodies are returned without Allow: 204
+	r = ic.request("RESPMOD", "/respmod", nil, clean, -1)
+	if r.status != "200 OK" || r.hdr != testResHdr || !bytes.Equal(r.body, clean) {
+		t.Errorf("Expected the message to be returned got %q %q %d bytes", r.status, r.hdr, len(r.body))
+	}
+
+	// REQMOD bodies are scanned
+	r = ic.request("REQMOD", "/reqmod", nil, eicar, -1)
+	if r.status != "200 OK" || !strings.HasPrefix(r.hdr, "HTTP/1.1 403 Forbidden\r\n") {
+		t.Errorf("Expected a block page got %q %q", r.status, r.hdr)
+	}
+	r = ic.request("REQMOD", "/reqmod", nil, []byte("upload"), -1)
+	if r.status != "200 OK" || r.hdr != testReqHdr || string(r.body) != "upload" {
+		t.Errorf("Expected the request to be returned got %q %q %q", r.status, r.hdr, r.body)
+	}
+
+	// Messages without a body are not scanned
+	n := cs.Commands("INSTREAM")
+	if r = ic.request("REQMOD", "/reqmod", []string{"Allow: 204"}, nil, -1); r.status != "204 No Content" {
+		t.Errorf("Expected 204 got %q", r.status)
+	}
+	if r = ic.request("REQMOD", "/reqmod", nil, nil, -1); r.status != "200 OK" || r.hdr != testReqHdr || r.body != nil {
+		t.Errorf("Expected the headers to be returned got %q %q", r.status, r.hdr)
+	}
+	if cs.Commands("INSTREAM") != n {
+		t.Errorf("Expected no scan")
+	}
+
+	// A preview that holds the whole body allows 204
+	if r = ic.request("RESPMOD", "/respmod", nil, []byte("small"), 1024); r.status != "204 No Content" {
+		t.Errorf("Expected 204 got %q", r.status)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	eicar, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	_, _, addr := testServer(t, Config{HeaderOnly: true})
+	ic := dial(t, addr)
+
+	r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, eicar, -1)
+	if r.status != "200 OK" || r.hdr != testResHdr || !bytes.Equal(r.body, eicar) {
+		t.Errorf("Expected the message to be returned got %q %q", r.status, r.hdr)
+	}
+	if h := r.header.Get("X-Infection-Found"); h != "Type=0; Resolution=0; Threat="+clamdtest.EicarSignature+";" {
+		t.Errorf("Unexpected X-Infection-Found %q", h)
+	}
+	if r.header.Get("X-Virus-ID") != clamdtest.EicarSignature {
+		t.Errorf("Unexpected X-Virus-ID %q", r.header.Get("X-Virus-ID"))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv, cs, addr := testServer(t, Config{})
+
+	ic := dial(t, addr)
+	if r := ic.request("REQMOD", "/respmod", nil, []byte("x"), -1); r.status != "405 Method Not Allowed" {
+		t.Errorf("Expected 405 got %q", r.status)
+	}
+
+	ic = dial(t, addr)
+	if r := ic.request("TRACE", "/respmod", nil, nil, -1); r.status != "501 Method Not Implemented" {
+		t.Errorf("Expected 501 got %q", r.status)
+	}
+
+	ic = dial(t, addr)
+	ic.write("RESPMOD icap://test/respmod HTTP/1.1\r\n\r\n")
+	if r := ic.response(); r.status != "400 Bad Request" {
+		t.Errorf("Expected 400 got %q", r.status)
+	}
+
+	ic = dial(t, addr)
+	ic.write("RESPMOD icap://test/respmod ICAP/1.0\r\nEncapsulated: res-body=0\r\n\r\nzz\r\n")
+	if r := ic.response(); r.status != "400 Bad Request" {
+		t.Errorf("Expected 400 got %q", r.status)
+	}
+
+	srv.tag()
+	cs.Close()
+	ic = dial(t, addr)
+	if r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, []byte("data"), -1); r.status != "500 Server Error" {
+		t.Errorf("Expected 500 got %q", r.status)
+	}
+	if r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204", "Connection: close"}, []byte("data"), -1); r.status != "500 Server Error" {
+		t.Errorf("Expected the connection to be reused got %q", r.status)
+	}
+	if _, e := ic.br.ReadByte(); e == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+
+	srv.cfg.FailOpen = true
+	ic = dial(t, addr)
+	if r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, []byte("data"), -1); r.status != "204 No Content" {
+		t.Errorf("Expected 204 got %q", r.status)
+	}
+}
+
+func TestScanError(t *testing.T) {
+	srv, cs, addr := testServer(t, Config{})
+	cs.InjectFault("INSTREAM", clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"})
+
+	ic := dial(t, addr)
+	if r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, []byte("data"), -1); r.status != "500 Server Error" {
+		t.Errorf("Expected 500 got %q", r.status)
+	}
+	if r := ic.request("REQMOD", "/reqmod", nil, []byte("data"), -1); r.status != "500 Server Error" {
+		t.Errorf("Expected 500 got %q", r.status)
+	}
+
+	srv.cfg.FailOpen = true
+	ic = dial(t, addr)
+	if r := ic.request("RESPMOD", "/respmod", []string{"Allow: 204"}, []byte("data"), -1); r.status != "204 No Content" {
+		t.Errorf("Expected 204 got %q", r.status)
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv, _, addr := testServer(t, Config{})
+	ic := dial(t, addr)
+	ic.request("OPTIONS", "/respmod", nil, nil, -1)
+
+	if e := srv.Close(); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if _, e := ic.br.ReadByte(); e == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	if e := srv.Serve(l); e != ErrServerClosed {
+		t.Errorf("Expected %v got %v", ErrServerClosed, e)
+	}
+}
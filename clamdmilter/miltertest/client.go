@@ -0,0 +1,261 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package miltertest provides the MTA side of the milter
+protocol for testing milters.
+*/
+package miltertest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/baruwa-enterprise/clamd/clamdmilter"
+)
+
+const (
+	// The body is sent in chunks of at most this size
+	bodyChunkSize = 65535
+	replyErr      = "Unexpected milter reply: %q"
+	allActions    = clamdmilter.ActAddHeaders | clamdmilter.ActChgBody |
+		clamdmilter.ActAddRcpt | clamdmilter.ActDelRcpt |
+		clamdmilter.ActChgHeaders | clamdmilter.ActQuarantine
+)
+
+// A Message is the envelope and content of a message
+type Message struct {
+	From    string
+	Rcpt    []string
+	Headers [][2]string
+	Body    []byte
+}
+
+// A Modification is a change requested by the milter
+type Modification struct {
+	Cmd   byte
+	Index uint32
+	Name  string
+	Value string
+}
+
+// A Result is the reply of the milter to a message
+type Result struct {
+	// Cmd is the final reply
+	Cmd byte
+	// Reply is the SMTP reply of a RespReplyCode reply
+	Reply string
+	// Quarantine is the reason of a quarantine request
+	Quarantine    string
+	Modifications []Modification
+}
+
+// Header returns the value of the last header called
+// name that was added by the milter
+func (r *Result) Header(name string) (v string, ok bool) {
+	for _, m := range r.Modifications {
+		switch m.Cmd {
+		case clamdmilter.RespAddHeader, clamdmilter.RespInsHeader:
+			if strings.EqualFold(m.Name, name) {
+				v, ok = m.Value, true
+			}
+		}
+	}
+
+	return
+}
+
+// A Client is the MTA side of a milter connection
+type Client struct {
+	conn net.Conn
+	br   *bufio.Reader
+	opts clamdmilter.OptNeg
+}
+
+// Dial connects to the milter at address
+func Dial(network, address string) (c *Client, err error) {
+	var conn net.Conn
+
+	if conn, err = net.Dial(network, address); err != nil {
+		return
+	}
+
+	c = NewClient(conn)
+
+	return
+}
+
+// NewClient returns a Client that uses conn
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+}
+
+// Negotiate offers actions and the protocol steps that
+// may be skipped, zero actions offers all of them
+func (c *Client) Negotiate(actions, protocol uint32) (o clamdmilter.OptNeg, err error) {
+	var p *clamdmilter.Packet
+
+	if actions == 0 {
+		actions = allActions
+	}
+
+	req := clamdmilter.OptNeg{
+		Version:  clamdmilter.Version,
+		Actions:  actions,
+		Protocol: protocol,
+	}
+	if err = clamdmilter.WritePacket(c.conn, clamdmilter.CmdOptNeg, req.Bytes()); err != nil {
+		return
+	}
+
+	if p, err = clamdmilter.ReadPacket(c.br); err != nil {
+		return
+	}
+
+	if p.Cmd != clamdmilter.CmdOptNeg {
+		err = fmt.Errorf(replyErr, p.Cmd)
+		return
+	}
+
+	if o, err = clamdmilter.ParseOptNeg(p.Data); err != nil {
+		return
+	}
+	c.opts = o
+
+	return
+}
+
+// Send sends a message, the steps skipped by the milter
+// are not sent. The result holds the first reply that
+// is not RespContinue, or the final reply
+func (c *Client) Send(m *Message) (r *Result, err error) {
+	var done bool
+
+	type step struct {
+		skip uint32
+		cmd  byte
+		data [][]byte
+	}
+
+	steps := []step{
+		{clamdmilter.ProtoNoConnect, clamdmilter.CmdConnect, [][]byte{
+			clamdmilter.CString("localhost"), []byte{'4', 0, 25}, clamdmilter.CString("127.0.0.1"),
+		}},
+		{clamdmilter.ProtoNoHelo, clamdmilter.CmdHelo, [][]byte{clamdmilter.CString("localhost")}},
+		{clamdmilter.ProtoNoMail, clamdmilter.CmdMail, [][]byte{clamdmilter.CString("<" + m.From + ">")}},
+	}
+	for _, rcpt := range m.Rcpt {
+		steps = append(steps, step{clamdmilter.ProtoNoRcpt, clamdmilter.CmdRcpt, [][]byte{clamdmilter.CString("<" + rcpt + ">")}})
+	}
+	steps = append(steps, step{clamdmilter.ProtoNoData, clamdmilter.CmdData, nil})
+	for _, h := range m.Headers {
+		steps = append(steps, step{clamdmilter.ProtoNoHeaders, clamdmilter.CmdHeader, [][]byte{
+			clamdmilter.CString(h[0]), clamdmilter.CString(h[1]),
+		}})
+	}
+	steps = append(steps, step{clamdmilter.ProtoNoEOH, clamdmilter.CmdEOH, nil})
+	for b := m.Body; len(b) > 0; {
+		n := len(b)
+		if n > bodyChunkSize {
+			n = bodyChunkSize
+		}
+		steps = append(steps, step{clamdmilter.ProtoNoBody, clamdmilter.CmdBody, [][]byte{b[:n]}})
+		b = b[n:]
+	}
+
+	r = &Result{}
+	for _, s := range steps {
+		if c.opts.Protocol&s.skip != 0 {
+			continue
+		}
+
+		if err = clamdmilter.WritePacket(c.conn, s.cmd, s.data...); err != nil {
+			return
+		}
+
+		if _, err = c.reply(r); err != nil || r.Cmd != clamdmilter.RespContinue {
+			return
+		}
+	}
+
+	if err = clamdmilter.WritePacket(c.conn, clamdmilter.CmdEOB); err != nil {
+		return
+	}
+
+	for !done && err == nil {
+		done, err = c.reply(r)
+	}
+
+	return
+}
+
+// reply reads a reply into r, done is set when
+// it is a final reply
+func (c *Client) reply(r *Result) (done bool, err error) {
+	var p *clamdmilter.Packet
+
+	if p, err = clamdmilter.ReadPacket(c.br); err != nil {
+		return
+	}
+
+	switch p.Cmd {
+	case clamdmilter.RespAddHeader:
+		f := clamdmilter.SplitCStrings(p.Data)
+		if len(f) != 2 {
+			err = clamdmilter.ErrMalformed
+			return
+		}
+		r.Modifications = append(r.Modifications, Modification{Cmd: p.Cmd, Name: f[0], Value: f[1]})
+	case clamdmilter.RespInsHeader, clamdmilter.RespChgHeader:
+		if len(p.Data) < 4 {
+			err = clamdmilter.ErrMalformed
+			return
+		}
+		f := clamdmilter.SplitCStrings(p.Data[4:])
+		if len(f) != 2 {
+			err = clamdmilter.ErrMalformed
+			return
+		}
+		r.Modifications = append(r.Modifications, Modification{
+			Cmd:   p.Cmd,
+			Index: binary.BigEndian.Uint32(p.Data),
+			Name:  f[0],
+			Value: f[1],
+		})
+	case clamdmilter.RespQuarantine:
+		r.Quarantine = strings.TrimSuffix(string(p.Data), "\x00")
+	case clamdmilter.RespReplyCode:
+		r.Cmd = p.Cmd
+		r.Reply = strings.TrimSuffix(string(p.Data), "\x00")
+		done = true
+	case clamdmilter.RespAccept, clamdmilter.RespContinue, clamdmilter.RespDiscard,
+		clamdmilter.RespReject, clamdmilter.RespTempFail:
+		r.Cmd = p.Cmd
+		done = true
+	default:
+		err = fmt.Errorf(replyErr, p.Cmd)
+	}
+
+	return
+}
+
+// Abort aborts the current message
+func (c *Client) Abort() error {
+	return clamdmilter.WritePacket(c.conn, clamdmilter.CmdAbort)
+}
+
+// Close ends the session and closes the connection
+func (c *Client) Close() (err error) {
+	clamdmilter.WritePacket(c.conn, clamdmilter.CmdQuit)
+	err = c.conn.Close()
+
+	return
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdmilter provides a Sendmail/Postfix milter that
+scans messages with clamd.
+*/
+package clamdmilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Milter protocol commands sent by the MTA
+const (
+	CmdAbort   = 'A'
+	CmdBody    = 'B'
+	CmdConnect = 'C'
+	CmdMacro   = 'D'
+	CmdEOB     = 'E'
+	CmdHelo    = 'H'
+	CmdQuitNC  = 'K'
+	CmdHeader  = 'L'
+	CmdMail    = 'M'
+	CmdEOH     = 'N'
+	CmdOptNeg  = 'O'
+	CmdQuit    = 'Q'
+	CmdRcpt    = 'R'
+	CmdData    = 'T'
+	CmdUnknown = 'U'
+)
+
+// Milter protocol replies sent to the MTA
+const (
+	RespAccept     = 'a'
+	RespContinue   = 'c'
+	RespDiscard    = 'd'
+	RespAddHeader  = 'h'
+	RespInsHeader  = 'i'
+	RespChgHeader  = 'm'
+	RespQuarantine = 'q'
+	RespReject     = 'r'
+	RespTempFail   = 't'
+	RespReplyCode  = 'y'
+)
+
+// Actions the milter may perform, negotiated with OPTNEG
+const (
+	ActAddHeaders = 0x01
+	ActChgBody    = 0x02
+	ActAddRcpt    = 0x04
+	ActDelRcpt    = 0x08
+	ActChgHeaders = 0x10
+	ActQuarantine = 0x20
+)
+
+// Steps the MTA skips, negotiated with OPTNEG
+const (
+	ProtoNoConnect = 0x01
+	ProtoNoHelo    = 0x02
+	ProtoNoMail    = 0x04
+	ProtoNoRcpt    = 0x08
+	ProtoNoBody    = 0x10
+	ProtoNoHeaders = 0x20
+	ProtoNoEOH     = 0x40
+	ProtoNoUnknown = 0x100
+	ProtoNoData    = 0x200
+)
+
+const (
+	// Version is the milter protocol version
+	Version = 6
+	// MaxPacketSize is the largest packet that is accepted
+	MaxPacketSize = 1024 * 1024
+	packetErr     = "Milter packet of %d bytes exceeds the limit"
+)
+
+var (
+	// ErrMalformed is returned when a packet can not be parsed
+	ErrMalformed = errors.New("Malformed milter packet")
+)
+
+// A Packet is a milter protocol packet
+type Packet struct {
+	Cmd  byte
+	Data []byte
+}
+
+// ReadPacket reads a packet from r
+func ReadPacket(r io.Reader) (p *Packet, err error) {
+	var hdr [4]byte
+
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 {
+		err = ErrMalformed
+		return
+	}
+	if n > MaxPacketSize {
+		err = fmt.Errorf("%w: "+packetErr, ErrMalformed, n)
+		return
+	}
+
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	p = &Packet{
+		Cmd:  b[0],
+		Data: b[1:],
+	}
+
+	return
+}
+
+// WritePacket writes a packet to w
+func WritePacket(w io.Writer, cmd byte, data ...[]byte) (err error) {
+	var n int
+
+	for _, d := range data {
+		n += len(d)
+	}
+
+	b := make([]byte, 5, 5+n)
+	binary.BigEndian.PutUint32(b, uint32(n+1))
+	b[4] = cmd
+	for _, d := range data {
+		b = append(b, d...)
+	}
+
+	_, err = w.Write(b)
+
+	return
+}
+
+// CString returns s as a NUL terminated string
+func CString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Uint32 returns n in network byte order
+func Uint32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+
+	return b
+}
+
+// SplitCStrings splits NUL terminated strings
+func SplitCStrings(b []byte) (s []string) {
+	b = bytes.TrimSuffix(b, []byte{0})
+	if len(b) == 0 {
+		return
+	}
+
+	for _, f := range bytes.Split(b, []byte{0}) {
+		s = append(s, string(f))
+	}
+
+	return
+}
+
+// OptNeg is the data of an OPTNEG packet
+type OptNeg struct {
+	Version  uint32
+	Actions  uint32
+	Protocol uint32
+}
+
+// ParseOptNeg parses the data of an OPTNEG packet
+func ParseOptNeg(b []byte) (o OptNeg, err error) {
+	if len(b) < 12 {
+		err = ErrMalformed
+		return
+	}
+
+	o.Version = binary.BigEndian.Uint32(b)
+	o.Actions = binary.BigEndian.Uint32(b[4:])
+	o.Protocol = binary.BigEndian.Uint32(b[8:])
+
+	return
+}
+
+// Bytes returns the data of an OPTNEG packet
+func (o OptNeg) Bytes() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, o.Version)
+	binary.BigEndian.PutUint32(b[4:], o.Actions)
+	binary.BigEndian.PutUint32(b[8:], o.Protocol)
+
+	return b
+}
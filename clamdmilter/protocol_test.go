@@ -0,0 +1,85 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdmilter provides a Sendmail/Postfix milter that
+scans messages with clamd.
+*/
+package clamdmilter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPacket(t *testing.T) {
+	var buf bytes.Buffer
+
+	if e := WritePacket(&buf, CmdHeader, CString("Subject"), CString("test")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte("\x00\x00\x00\x0eLSubject\x00test\x00")) {
+		t.Errorf("Unexpected packet %q", buf.Bytes())
+	}
+
+	p, e := ReadPacket(&buf)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if p.Cmd != CmdHeader || !reflect.DeepEqual(SplitCStrings(p.Data), []string{"Subject", "test"}) {
+		t.Errorf("Unexpected packet %c %q", p.Cmd, p.Data)
+	}
+
+	if _, e = ReadPacket(&buf); e != io.EOF {
+		t.Errorf("Expected %v got %v", io.EOF, e)
+	}
+	if _, e = ReadPacket(bytes.NewReader([]byte("\x00\x00\x00\x05L"))); e != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, e)
+	}
+	if _, e = ReadPacket(bytes.NewReader([]byte("\x00\x00\x00\x00"))); !errors.Is(e, ErrMalformed) {
+		t.Errorf("Expected %v got %v", ErrMalformed, e)
+	}
+	if _, e = ReadPacket(bytes.NewReader([]byte("\x7f\x00\x00\x00"))); !errors.Is(e, ErrMalformed) {
+		t.Errorf("Expected %v got %v", ErrMalformed, e)
+	}
+}
+
+func TestOptNeg(t *testing.T) {
+	o := OptNeg{Version: Version, Actions: ActAddHeaders | ActQuarantine, Protocol: ProtoNoConnect}
+
+	p, e := ParseOptNeg(o.Bytes())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if p != o {
+		t.Errorf("Expected %+v got %+v", o, p)
+	}
+
+	if _, e = ParseOptNeg([]byte{0, 0, 0, 6}); e != ErrMalformed {
+		t.Errorf("Expected %v got %v", ErrMalformed, e)
+	}
+}
+
+func TestSplitCStrings(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{"", nil},
+		{"\x00", nil},
+		{"a\x00", []string{"a"}},
+		{"a\x00\x00", []string{"a", ""}},
+		{"a\x00b\x00", []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		if s := SplitCStrings([]byte(tt.in)); !reflect.DeepEqual(s, tt.out) {
+			t.Errorf("%q: expected %q got %q", tt.in, tt.out, s)
+		}
+	}
+}
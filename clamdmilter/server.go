@@ -0,0 +1,498 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdmilter provides a Sendmail/Postfix milter that
+scans messages with clamd.
+*/
+package clamdmilter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+)
+
+const (
+	// DefaultMaxMemory is the size of a message that is kept
+	// in memory while it is received
+	DefaultMaxMemory = 10 * 1024 * 1024
+	// ScannedHeader is the header that names the scanner
+	ScannedHeader = "X-Virus-Scanned"
+	// StatusHeader is the header that holds the scan result
+	StatusHeader = "X-Virus-Status"
+	defaultReply = "550 5.7.1 Virus %s detected"
+	cleanStatus  = "Clean"
+	infectedFmt  = "Infected (%s)"
+	actionErr    = "Unsupported action: %s"
+
+	// The actions and steps requested from the MTA
+	wantActions  = ActAddHeaders | ActChgHeaders | ActQuarantine
+	wantProtocol = ProtoNoConnect | ProtoNoHelo | ProtoNoMail |
+		ProtoNoRcpt | ProtoNoUnknown | ProtoNoData
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close
+	ErrServerClosed = errors.New("The milter server is closed")
+)
+
+// Action is what is done with an infected message
+type Action int
+
+// Actions that can be taken on an infected message
+const (
+	Reject Action = iota
+	Discard
+	Quarantine
+	Accept
+	TempFail
+)
+
+var actionNames = []string{"reject", "discard", "quarantine", "accept", "tempfail"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+
+	return actionNames[a]
+}
+
+// ParseAction returns the action named s
+func ParseAction(s string) (a Action, err error) {
+	for i, n := range actionNames {
+		if strings.EqualFold(s, n) {
+			a = Action(i)
+			return
+		}
+	}
+
+	err = fmt.Errorf(actionErr, s)
+
+	return
+}
+
+// Config holds the server settings
+type Config struct {
+	// Infected is the action taken on infected messages,
+	// the zero value rejects them
+	Infected Action
+	// Reply returns the SMTP reply used to reject an
+	// infected message
+	Reply func(signature string) string
+	// FailOpen accepts messages that could not be scanned,
+	// they are temporarily rejected otherwise
+	FailOpen bool
+	// NoHeaders disables the X-Virus-Scanned and
+	// X-Virus-Status headers
+	NoHeaders bool
+	// ScannedBy is the value of the X-Virus-Scanned header
+	ScannedBy string
+	// MaxSize is the size of the largest message that is
+	// scanned, larger messages are accepted unscanned
+	MaxSize int64
+	// MaxMemory is the size of a message that is kept in
+	// memory, larger messages are kept in a temporary file
+	MaxMemory int64
+}
+
+// A Server is a milter that scans messages with clamd
+type Server struct {
+	s      clamd.Scanner
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewServer returns a Server that scans with s
+func NewServer(s clamd.Scanner, cfg Config) (srv *Server) {
+	if cfg.Reply == nil {
+		cfg.Reply = defaultRejectReply
+	}
+
+	if cfg.ScannedBy == "" {
+		cfg.ScannedBy = "clamd-milter"
+		if h, err := os.Hostname(); err == nil {
+			cfg.ScannedBy += " at " + h
+		}
+	}
+
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = DefaultMaxMemory
+	}
+
+	srv = &Server{
+		s:         s,
+		cfg:       cfg,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+
+	return
+}
+
+// ListenAndServe listens on the address addr of the
+// network and serves the connections
+func (srv *Server) ListenAndServe(network, addr string) (err error) {
+	var l net.Listener
+
+	if l, err = net.Listen(network, addr); err != nil {
+		return
+	}
+
+	err = srv.Serve(l)
+
+	return
+}
+
+// Serve serves the connections accepted on l, it
+// returns ErrServerClosed after Close
+func (srv *Server) Serve(l net.Listener) (err error) {
+	var conn net.Conn
+
+	if !srv.track(l, nil) {
+		l.Close()
+		err = ErrServerClosed
+		return
+	}
+	defer srv.untrack(l, nil)
+
+	for {
+		if conn, err = l.Accept(); err != nil {
+			if srv.isClosed() {
+				err = ErrServerClosed
+			}
+			return
+		}
+
+		if !srv.track(nil, conn) {
+			conn.Close()
+			continue
+		}
+
+		srv.wg.Add(1)
+		go func(conn net.Conn) {
+			defer srv.wg.Done()
+			defer srv.untrack(nil, conn)
+			srv.serveConn(conn)
+		}(conn)
+	}
+}
+
+// Close closes the listeners and the connections and
+// waits for the connections to be released
+func (srv *Server) Close() (err error) {
+	srv.mu.Lock()
+	srv.closed = true
+	srv.cancel()
+	for l := range srv.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+
+	return
+}
+
+func (srv *Server) track(l net.Listener, conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return false
+	}
+
+	if l != nil {
+		srv.listeners[l] = struct{}{}
+	}
+
+	if conn != nil {
+		srv.conns[conn] = struct{}{}
+	}
+
+	return true
+}
+
+func (srv *Server) untrack(l net.Listener, conn net.Conn) {
+	srv.mu.Lock()
+	delete(srv.listeners, l)
+	delete(srv.conns, conn)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+// serveConn serves the messages sent on a connection
+func (srv *Server) serveConn(conn net.Conn) {
+	s := &session{
+		srv: srv,
+		bw:  bufio.NewWriter(conn),
+	}
+
+	defer conn.Close()
+	defer s.reset()
+
+	br := bufio.NewReader(conn)
+	for {
+		p, err := ReadPacket(br)
+		if err != nil {
+			return
+		}
+
+		if !s.handle(p) {
+			return
+		}
+
+		if s.bw.Flush() != nil {
+			return
+		}
+	}
+}
+
+// session is the state of a milter connection
+type session struct {
+	srv      *Server
+	bw       *bufio.Writer
+	actions  uint32
+	sp       *spool.Spool
+	size     int64
+	body     bool
+	oversize bool
+	// existing counts the X-Virus headers of the message
+	existing map[string]int
+}
+
+// handle responds to a packet, it returns false when
+// the connection should be closed
+func (s *session) handle(p *Packet) bool {
+	switch p.Cmd {
+	case CmdOptNeg:
+		o, err := ParseOptNeg(p.Data)
+		if err != nil {
+			return false
+		}
+		s.actions = o.Actions & wantActions
+		if o.Version > Version {
+			o.Version = Version
+		}
+		reply := OptNeg{
+			Version:  o.Version,
+			Actions:  s.actions,
+			Protocol: o.Protocol & wantProtocol,
+		}
+		s.write(CmdOptNeg, reply.Bytes())
+	case CmdMacro:
+		// Macros have no reply
+	case CmdAbort, CmdQuitNC:
+		s.reset()
+	case CmdMail:
+		s.reset()
+		s.write(RespContinue)
+	case CmdHeader:
+		s.header(SplitCStrings(p.Data))
+		s.write(RespContinue)
+	case CmdEOH:
+		s.add([]byte("\r\n"))
+		s.body = true
+		s.write(RespContinue)
+	case CmdBody:
+		if !s.body {
+			s.add([]byte("\r\n"))
+			s.body = true
+		}
+		s.add(p.Data)
+		s.write(RespContinue)
+	case CmdEOB:
+		s.eob()
+		s.reset()
+	case CmdQuit:
+		return false
+	default:
+		s.write(RespContinue)
+	}
+
+	return true
+}
+
+func (s *session) write(cmd byte, data ...[]byte) {
+	WritePacket(s.bw, cmd, data...)
+}
+
+// reset drops the message
+func (s *session) reset() {
+	if s.sp != nil {
+		s.sp.Close()
+	}
+
+	s.sp = nil
+	s.size = 0
+	s.body = false
+	s.oversize = false
+	s.existing = nil
+}
+
+// add appends b to the message, a message larger than
+// MaxSize is dropped and accepted unscanned
+func (s *session) add(b []byte) {
+	if s.oversize {
+		return
+	}
+
+	s.size += int64(len(b))
+	if s.srv.cfg.MaxSize > 0 && s.size > s.srv.cfg.MaxSize {
+		s.drop()
+		return
+	}
+
+	if s.sp == nil {
+		s.sp = spool.New(s.srv.cfg.MaxMemory)
+	}
+
+	if _, err := s.sp.Write(b); err != nil {
+		s.drop()
+	}
+}
+
+// drop discards the message data, the message is
+// accepted unscanned
+func (s *session) drop() {
+	if s.sp != nil {
+		s.sp.Close()
+		s.sp = nil
+	}
+
+	s.oversize = true
+}
+
+func (s *session) header(f []string) {
+	if len(f) != 2 {
+		return
+	}
+
+	for _, name := range []string{ScannedHeader, StatusHeader} {
+		if strings.EqualFold(f[0], name) {
+			if s.existing == nil {
+				s.existing = make(map[string]int)
+			}
+			s.existing[name]++
+		}
+	}
+
+	s.add([]byte(f[0] + ": " + strings.TrimLeft(f[1], " \t") + "\r\n"))
+}
+
+// eob scans the message and sends the final reply
+func (s *session) eob() {
+	var r []*clamd.Response
+	var v *clamd.Verdict
+	var err error
+
+	cfg := s.srv.cfg
+
+	if s.oversize {
+		s.write(RespContinue)
+		return
+	}
+
+	if s.sp == nil {
+		s.sp = spool.New(cfg.MaxMemory)
+	}
+
+	if err = s.sp.Rewind(); err == nil {
+		if r, err = s.srv.s.ScanReader(s.srv.ctx, s.sp); err == nil {
+			v = clamd.NewVerdict(r)
+		}
+	}
+
+	// A message clamd replied it could not scan is not clean
+	if err != nil || v.Failed() {
+		if cfg.FailOpen {
+			s.write(RespContinue)
+		} else {
+			s.write(RespTempFail)
+		}
+		return
+	}
+
+	if !v.Infected() {
+		s.headers(cleanStatus)
+		s.write(RespContinue)
+		return
+	}
+
+	sig := v.Signature
+
+	action := cfg.Infected
+	if action == Quarantine && s.actions&ActQuarantine == 0 {
+		action = Reject
+	}
+
+	switch action {
+	case Discard:
+		s.write(RespDiscard)
+	case Quarantine:
+		s.headers(fmt.Sprintf(infectedFmt, sig))
+		s.write(RespQuarantine, CString("Virus "+sig))
+		s.write(RespContinue)
+	case Accept:
+		s.headers(fmt.Sprintf(infectedFmt, sig))
+		s.write(RespContinue)
+	case TempFail:
+		s.write(RespTempFail)
+	default:
+		s.write(RespReplyCode, CString(cfg.Reply(sig)))
+	}
+}
+
+// headers replaces the X-Virus headers of the message
+func (s *session) headers(status string) {
+	if s.srv.cfg.NoHeaders || s.actions&ActAddHeaders == 0 {
+		return
+	}
+
+	if s.actions&ActChgHeaders != 0 {
+		for name, n := range s.existing {
+			// Headers are deleted last to first so the
+			// indexes of the rest do not change
+			for i := n; i > 0; i-- {
+				s.write(RespChgHeader, Uint32(uint32(i)), CString(name), CString(""))
+			}
+		}
+	}
+
+	s.write(RespInsHeader, Uint32(0), CString(ScannedHeader), CString(s.srv.cfg.ScannedBy))
+	s.write(RespInsHeader, Uint32(1), CString(StatusHeader), CString(status))
+}
+
+func defaultRejectReply(sig string) string {
+	return fmt.Sprintf(defaultReply, sig)
+}
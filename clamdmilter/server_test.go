@@ -0,0 +1,321 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdmilter provides a Sendmail/Postfix milter that
+scans messages with clamd.
+*/
+package clamdmilter_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdmilter"
+	"github.com/baruwa-enterprise/clamd/clamdmilter/miltertest"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func testServer(t *testing.T, cfg clamdmilter.Config) (srv *clamdmilter.Server, cs *clamdtest.Server, addr string) {
+	cs = clamdtest.NewServer()
+	t.Cleanup(cs.Close)
+
+	c, e := clamd.NewClient(cs.Network, cs.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	if cfg.ScannedBy == "" {
+		cfg.ScannedBy = "clamd-milter test"
+	}
+
+	srv = clamdmilter.NewServer(c, cfg)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	addr = l.Addr().String()
+
+	return
+}
+
+func dial(t *testing.T, addr string, actions uint32) (c *miltertest.Client) {
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c = miltertest.NewClient(conn)
+	if _, e = c.Negotiate(actions, 0xfff); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	return
+}
+
+func message(body []byte, hdr ...[2]string) *miltertest.Message {
+	return &miltertest.Message{
+		From:    "sender@example.com",
+		Rcpt:    []string{"rcpt@example.com"},
+		Headers: append([][2]string{{"Subject", "test"}}, hdr...),
+		Body:    body,
+	}
+}
+
+func eicar(t *testing.T) []byte {
+	b, e := ioutil.ReadFile("../examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	return b
+}
+
+func TestNegotiate(t *testing.T) {
+	_, _, addr := testServer(t, clamdmilter.Config{})
+
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer conn.Close()
+
+	c := miltertest.NewClient(conn)
+	o, e := c.Negotiate(clamdmilter.ActAddHeaders|clamdmilter.ActChgBody, 0xfff)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if o.Version != clamdmilter.Version || o.Actions != clamdmilter.ActAddHeaders {
+		t.Errorf("Unexpected negotiation %+v", o)
+	}
+	if o.Protocol&(clamdmilter.ProtoNoBody|clamdmilter.ProtoNoHeaders|clamdmilter.ProtoNoEOH) != 0 {
+		t.Errorf("The headers and body should be requested %+v", o)
+	}
+	if o.Protocol&clamdmilter.ProtoNoConnect == 0 {
+		t.Errorf("The connect step should be skipped %+v", o)
+	}
+}
+
+func TestScan(t *testing.T) {
+	_, cs, addr := testServer(t, clamdmilter.Config{})
+	c := dial(t, addr, 0)
+
+	r, e := c.Send(message([]byte("Hello\r\n")))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r.Cmd != clamdmilter.RespContinue {
+		t.Errorf("Expected the message to be accepted got %q", r.Cmd)
+	}
+	if v, ok := r.Header(clamdmilter.StatusHeader); !ok || v != "Clean" {
+		t.Errorf("Unexpected %s %q", clamdmilter.StatusHeader, v)
+	}
+	if v, _ := r.Header(clamdmilter.ScannedHeader); v != "clamd-milter test" {
+		t.Errorf("Unexpected %s %q", clamdmilter.ScannedHeader, v)
+	}
+	if cs.Commands("INSTREAM") != 1 {
+		t.Errorf("Expected one scan got %d", cs.Commands("INSTREAM"))
+	}
+
+	// Infected messages are rejected by default
+	r, e = c.Send(message(eicar(t)))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r.Cmd != clamdmilter.RespReplyCode || r.Reply != "550 5.7.1 Virus "+clamdtest.EicarSignature+" detected" {
+		t.Errorf("Unexpected reply %q %q", r.Cmd, r.Reply)
+	}
+	if len(r.Modifications) != 0 {
+		t.Errorf("Rejected messages should not be modified %v", r.Modifications)
+	}
+
+	// Large bodies are sent in several packets
+	big := append(bytes.Repeat([]byte("clean line\r\n"), 20000), eicar(t)...)
+	if r, e = c.Send(message(big)); e != nil || r.Cmd != clamdmilter.RespReplyCode {
+		t.Errorf("Expected the message to be rejected got %v %v", r, e)
+	}
+
+	// The virus is found in the headers too
+	if r, e = c.Send(message(nil, [2]string{"X-Test", string(eicar(t))})); e != nil || r.Cmd != clamdmilter.RespReplyCode {
+		t.Errorf("Expected the message to be rejected got %v %v", r, e)
+	}
+
+	// An aborted message is dropped
+	if e = c.Abort(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r, e = c.Send(message([]byte("clean"))); e != nil || r.Cmd != clamdmilter.RespContinue {
+		t.Errorf("Expected the message to be accepted got %v %v", r, e)
+	}
+}
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  clamdmilter.Action
+		actions uint32
+		cmd     byte
+		status  string
+		quar    bool
+	}{
+		{"discard", clamdmilter.Discard, 0, clamdmilter.RespDiscard, "", false},
+		{"quarantine", clamdmilter.Quarantine, 0, clamdmilter.RespContinue, "Infected (" + clamdtest.EicarSignature + ")", true},
+		{"quarantine-unsupported", clamdmilter.Quarantine, clamdmilter.ActAddHeaders, clamdmilter.RespReplyCode, "", false},
+		{"accept", clamdmilter.Accept, 0, clamdmilter.RespContinue, "Infected (" + clamdtest.EicarSignature + ")", false},
+		{"tempfail", clamdmilter.TempFail, 0, clamdmilter.RespTempFail, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, addr := testServer(t, clamdmilter.Config{Infected: tt.action})
+			c := dial(t, addr, tt.actions)
+
+			r, e := c.Send(message(eicar(t)))
+			if e != nil {
+				t.Fatalf("An error should not be returned: %s", e)
+			}
+			if r.Cmd != tt.cmd {
+				t.Errorf("Expected %q got %q", tt.cmd, r.Cmd)
+			}
+			if v, _ := r.Header(clamdmilter.StatusHeader); v != tt.status {
+				t.Errorf("Expected %s %q got %q", clamdmilter.StatusHeader, tt.status, v)
+			}
+			if (r.Quarantine != "") != tt.quar {
+				t.Errorf("Unexpected quarantine %q", r.Quarantine)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	_, _, addr := testServer(t, clamdmilter.Config{})
+	c := dial(t, addr, 0)
+
+	// Existing headers are deleted
+	r, e := c.Send(message([]byte("clean"), [2]string{"x-virus-status", "Clean"}, [2]string{"X-Virus-Status", "Clean"}))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	var deleted []uint32
+	for _, m := range r.Modifications {
+		if m.Cmd == clamdmilter.RespChgHeader {
+			if m.Name != clamdmilter.StatusHeader || m.Value != "" {
+				t.Errorf("Unexpected change %+v", m)
+			}
+			deleted = append(deleted, m.Index)
+		}
+	}
+	if len(deleted) != 2 || deleted[0] != 2 || deleted[1] != 1 {
+		t.Errorf("Expected headers 2 and 1 to be deleted got %v", deleted)
+	}
+
+	// Headers are only added when the MTA allows it
+	c = dial(t, addr, clamdmilter.ActQuarantine)
+	if r, e = c.Send(message([]byte("clean"))); e != nil || len(r.Modifications) != 0 {
+		t.Errorf("Expected no modifications got %v %v", r, e)
+	}
+
+	_, _, addr = testServer(t, clamdmilter.Config{NoHeaders: true})
+	c = dial(t, addr, 0)
+	if r, e = c.Send(message([]byte("clean"))); e != nil || len(r.Modifications) != 0 {
+		t.Errorf("Expected no modifications got %v %v", r, e)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, cs, addr := testServer(t, clamdmilter.Config{MaxSize: 1024})
+	c := dial(t, addr, 0)
+
+	// Messages larger than MaxSize are not scanned
+	n := cs.Commands("INSTREAM")
+	r, e := c.Send(message(append(bytes.Repeat([]byte("x"), 2048), eicar(t)...)))
+	if e != nil || r.Cmd != clamdmilter.RespContinue || len(r.Modifications) != 0 {
+		t.Errorf("Expected the message to be accepted unscanned got %v %v", r, e)
+	}
+	if cs.Commands("INSTREAM") != n {
+		t.Errorf("Expected no scan")
+	}
+
+	// Scan errors are temporary failures
+	cs.Close()
+	if r, e = c.Send(message([]byte("clean"))); e != nil || r.Cmd != clamdmilter.RespTempFail {
+		t.Errorf("Expected a temporary failure got %v %v", r, e)
+	}
+
+	srv, cs, addr := testServer(t, clamdmilter.Config{FailOpen: true})
+	cs.Close()
+	c = dial(t, addr, 0)
+	if r, e = c.Send(message([]byte("clean"))); e != nil || r.Cmd != clamdmilter.RespContinue {
+		t.Errorf("Expected the message to be accepted got %v %v", r, e)
+	}
+	if len(r.Modifications) != 0 {
+		t.Errorf("Expected no status header got %v", r.Modifications)
+	}
+
+	if e = srv.Close(); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if _, e = c.Send(message([]byte("clean"))); e == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	if e = srv.Serve(l); e != clamdmilter.ErrServerClosed {
+		t.Errorf("Expected %v got %v", clamdmilter.ErrServerClosed, e)
+	}
+}
+
+func TestScanError(t *testing.T) {
+	fault := clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"}
+
+	_, cs, addr := testServer(t, clamdmilter.Config{})
+	cs.InjectFault("INSTREAM", fault)
+	c := dial(t, addr, clamdmilter.ActAddHeaders|clamdmilter.ActChgHeaders)
+	r, e := c.Send(message([]byte("clean")))
+	if e != nil || r.Cmd != clamdmilter.RespTempFail {
+		t.Errorf("Expected a temporary failure got %v %v", r, e)
+	}
+	if e == nil && len(r.Modifications) != 0 {
+		t.Errorf("Expected no status header got %v", r.Modifications)
+	}
+
+	_, cs, addr = testServer(t, clamdmilter.Config{FailOpen: true})
+	cs.InjectFault("INSTREAM", fault)
+	c = dial(t, addr, clamdmilter.ActAddHeaders|clamdmilter.ActChgHeaders)
+	if r, e = c.Send(message([]byte("clean"))); e != nil || r.Cmd != clamdmilter.RespContinue {
+		t.Fatalf("Expected the message to be accepted got %v %v", r, e)
+	}
+	if _, ok := r.Header(clamdmilter.StatusHeader); ok {
+		t.Errorf("Expected no status header got %v", r.Modifications)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	for _, n := range []string{"reject", "discard", "quarantine", "accept", "tempfail"} {
+		a, e := clamdmilter.ParseAction(strings.ToUpper(n))
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if a.String() != n {
+			t.Errorf("Expected %q got %q", n, a)
+		}
+	}
+
+	if _, e := clamdmilter.ParseAction("bounce"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+const maxMemberSize = 64 * 1024 * 1024
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zipMagic   = []byte("PK\x03\x04")
+	tarMagic   = []byte("ustar")
+)
+
+// unpack returns the members of gzip, bzip2, tar and zip
+// archives, it returns nil for any other content
+func unpack(content []byte) (members [][]byte) {
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		if r, err := gzip.NewReader(bytes.NewReader(content)); err == nil {
+			members = readMember(members, r)
+		}
+	case bytes.HasPrefix(content, bzip2Magic):
+		members = readMember(members, bzip2.NewReader(bytes.NewReader(content)))
+	case bytes.HasPrefix(content, zipMagic):
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return
+		}
+		for _, f := range zr.File {
+			if rc, err := f.Open(); err == nil {
+				members = readMember(members, rc)
+				rc.Close()
+			}
+		}
+	case len(content) > 262 && bytes.HasPrefix(content[257:], tarMagic):
+		tr := tar.NewReader(bytes.NewReader(content))
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if h.Typeflag == tar.TypeReg {
+				members = readMember(members, tr)
+			}
+		}
+	}
+
+	return
+}
+
+func readMember(members [][]byte, r io.Reader) [][]byte {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxMemberSize))
+	if err != nil && len(b) == 0 {
+		return members
+	}
+
+	return append(members, b)
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// CommandReadTimedOut is the reply clamd sends when it times
+	// out waiting for a command or stream data
+	CommandReadTimedOut = "COMMAND READ TIMED OUT"
+	// SizeLimitExceeded is the reply clamd sends when a stream
+	// exceeds StreamMaxLength
+	SizeLimitExceeded = "INSTREAM size limit exceeded. ERROR"
+
+	fragmentDelay = time.Millisecond
+)
+
+var errFault = errors.New("clamdtest: fault injected")
+
+// A Fault describes a failure the server injects when it
+// handles a command, see Server.InjectFault.
+type Fault struct {
+	// Delay is slept before the reply is written
+	Delay time.Duration
+	// AfterBytes applies an INSTREAM fault once this many bytes
+	// of stream data have been received instead of after the
+	// terminating chunk
+	AfterBytes int64
+	// Reply replaces the reply, it is written as is without a
+	// session id prefix and the connection is then closed
+	Reply string
+	// Truncate writes only the first Truncate bytes of the
+	// reply and then closes the connection
+	Truncate int
+	// Fragment writes the reply in pieces of this many bytes
+	Fragment int
+	// Reset aborts the connection instead of replying, or after
+	// writing Reply when it is set
+	Reset bool
+	// Stall never replies, the connection is held open until
+	// the client or the server closes it
+	Stall bool
+	// Times is the number of commands the fault is applied to,
+	// zero applies it to every command
+	Times int
+}
+
+// InjectFault applies f to subsequent cmd commands, it
+// replaces any fault previously injected for cmd
+func (s *Server) InjectFault(cmd string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[cmd] = &f
+}
+
+// ClearFaults removes all injected faults
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = make(map[string]*Fault)
+}
+
+func (s *Server) fault(cmd string) (f *Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sf := s.faults[cmd]
+	if sf == nil {
+		return
+	}
+
+	fc := *sf
+	f = &fc
+
+	if sf.Times > 0 {
+		if sf.Times--; sf.Times == 0 {
+			delete(s.faults, cmd)
+		}
+	}
+
+	return
+}
+
+// inject applies the fault of req, it returns true when
+// the connection has been closed or should not be used
+func (cn *conn) inject(req *request) (done bool) {
+	f := req.fault
+	if f == nil || req.injected {
+		return
+	}
+	req.injected = true
+
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-cn.s.done:
+			done = true
+			return
+		}
+	}
+
+	switch {
+	case f.Stall:
+		io.Copy(ioutil.Discard, cn.r)
+		done = true
+	case f.Reply != "":
+		cn.send(req, f.Reply+string(req.delim))
+		if f.Reset {
+			cn.reset()
+		} else {
+			cn.linger()
+		}
+		done = true
+	case f.Reset:
+		cn.reset()
+		done = true
+	}
+
+	return
+}
+
+// linger closes the write side of the connection and discards
+// what the client is still sending so that it reads the reply
+// rather than a connection reset
+func (cn *conn) linger() {
+	if cw, ok := cn.c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	cn.c.SetReadDeadline(time.Now().Add(time.Minute))
+	io.Copy(ioutil.Discard, cn.r)
+}
+
+// reset closes the connection discarding unsent and unread
+// data, TCP clients receive a reset
+func (cn *conn) reset() {
+	if tc, ok := cn.c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	cn.close()
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestFaults(t *testing.T) {
+	big := bytes.Repeat([]byte("a"), 4*1024*1024)
+	dir := testDir(t)
+	clean := filepath.Join(dir, "clean.txt")
+
+	isTimeout := func(e error) bool {
+		var ne net.Error
+		return errors.As(e, &ne) && ne.Timeout()
+	}
+
+	tests := []struct {
+		name      string
+		network   string
+		cmd       string
+		fault     clamdtest.Fault
+		retryable bool
+		check     func(error) bool
+	}{
+		{
+			name:      "latency",
+			cmd:       "SCAN",
+			fault:     clamdtest.Fault{Delay: time.Second},
+			retryable: true,
+			check:     isTimeout,
+		},
+		{
+			name:      "stall",
+			cmd:       "INSTREAM",
+			fault:     clamdtest.Fault{Stall: true, AfterBytes: 1},
+			retryable: true,
+			check:     isTimeout,
+		},
+		{
+			name:      "reset",
+			network:   "tcp",
+			cmd:       "INSTREAM",
+			fault:     clamdtest.Fault{Reset: true, AfterBytes: 1024},
+			retryable: true,
+			check:     func(e error) bool { return e != nil },
+		},
+		{
+			name:      "reset before reply",
+			cmd:       "SCAN",
+			fault:     clamdtest.Fault{Reset: true},
+			retryable: true,
+			check:     func(e error) bool { return e == io.ErrUnexpectedEOF },
+		},
+		{
+			name:      "command read timed out",
+			cmd:       "SCAN",
+			fault:     clamdtest.Fault{Reply: clamdtest.CommandReadTimedOut},
+			retryable: true,
+			check:     func(e error) bool { return errors.Is(e, clamd.ErrCommandReadTimedOut) },
+		},
+		{
+			name:    "size limit",
+			network: "tcp",
+			cmd:     "INSTREAM",
+			fault:   clamdtest.Fault{Reply: clamdtest.SizeLimitExceeded, AfterBytes: 1},
+			check:   func(e error) bool { return errors.Is(e, clamd.ErrSizeLimitExceeded) },
+		},
+		{
+			name:  "size limit then close",
+			cmd:   "INSTREAM",
+			fault: clamdtest.Fault{Reply: clamdtest.SizeLimitExceeded, Reset: true, AfterBytes: 1},
+			check: func(e error) bool { return errors.Is(e, clamd.ErrSizeLimitExceeded) },
+		},
+		{
+			name:  "malformed",
+			cmd:   "SCAN",
+			fault: clamdtest.Fault{Reply: "garbage"},
+			check: func(e error) bool { return errors.Is(e, clamd.ErrInvalidResponse) },
+		},
+		{
+			name:      "partial write",
+			cmd:       "SCAN",
+			fault:     clamdtest.Fault{Truncate: 5},
+			retryable: true,
+			check:     func(e error) bool { return e == io.ErrUnexpectedEOF },
+		},
+		{
+			name:  "fragmented",
+			cmd:   "SCAN",
+			fault: clamdtest.Fault{Fragment: 3},
+			check: func(e error) bool { return e == nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := tt.network
+			if network == "" {
+				network = "unix"
+			}
+			s := clamdtest.NewUnstartedServer(network)
+			s.Start()
+			defer s.Close()
+
+			c := newClient(t, s)
+			c.SetCmdTimeout(200 * time.Millisecond)
+			s.InjectFault(tt.cmd, tt.fault)
+
+			var e error
+			ctx := context.Background()
+			if tt.cmd == "INSTREAM" {
+				_, e = c.ScanReader(ctx, bytes.NewReader(big))
+			} else {
+				_, e = c.Scan(ctx, clean)
+			}
+			if !tt.check(e) {
+				t.Errorf("Unexpected error: %v", e)
+			}
+			if clamd.IsRetryable(e) != tt.retryable {
+				t.Errorf("IsRetryable(%v) = %t", e, !tt.retryable)
+			}
+		})
+	}
+}
+
+func TestFaultTimes(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	s.InjectFault("PING", clamdtest.Fault{Reset: true, Times: 2})
+	for i := 0; i < 2; i++ {
+		if _, e := c.Ping(ctx); e != io.ErrUnexpectedEOF {
+			t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, e)
+		}
+	}
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+
+	s.InjectFault("PING", clamdtest.Fault{Reply: "PONG PONG"})
+	if b, e := c.Ping(ctx); e != nil || b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+	s.ClearFaults()
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+}
+
+func TestFaultSession(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	ss, e := c.IDSession(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer ss.End()
+
+	s.InjectFault("INSTREAM", clamdtest.Fault{Reply: "1: " + clamdtest.SizeLimitExceeded, Reset: true, AfterBytes: 1})
+	if _, e = ss.ScanReader(ctx, bytes.NewReader(bytes.Repeat([]byte("a"), 4*1024*1024))); !errors.Is(e, clamd.ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", clamd.ErrSizeLimitExceeded, e)
+	}
+
+	if ss, e = c.IDSession(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer ss.End()
+
+	s.InjectFault("PING", clamdtest.Fault{Reply: "garbage"})
+	if _, e = ss.Ping(ctx); !errors.Is(e, clamd.ErrInvalidResponse) {
+		t.Errorf("Expected %v got %v", clamd.ErrInvalidResponse, e)
+	}
+	if _, e = ss.Ping(ctx); e == nil {
+		t.Errorf("Expected the session to be closed")
+	}
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// fdConn is a unix connection that keeps the file
+// descriptors received as ancillary data
+type fdConn struct {
+	*net.UnixConn
+	mu  sync.Mutex
+	fds []int
+}
+
+func (c *fdConn) Read(b []byte) (n int, err error) {
+	var oobn int
+	var msgs []syscall.SocketControlMessage
+
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, _, _, err = c.ReadMsgUnix(b, oob)
+	if n < 0 {
+		n = 0
+	}
+	if err != nil || oobn == 0 {
+		return
+	}
+
+	if msgs, err = syscall.ParseSocketControlMessage(oob[:oobn]); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range msgs {
+		fds, perr := syscall.ParseUnixRights(&msgs[i])
+		if perr != nil {
+			continue
+		}
+		c.fds = append(c.fds, fds...)
+	}
+
+	return
+}
+
+func (c *fdConn) fd() (fd int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.fds) == 0 {
+		err = fmt.Errorf("clamdtest: no file descriptor received")
+		return
+	}
+
+	fd = c.fds[0]
+	c.fds = c.fds[1:]
+
+	return
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest
+
+import (
+	"errors"
+	"net"
+)
+
+const fildesUnsupportErr = "clamdtest: Fildes is not supported"
+
+type fdConn struct {
+	*net.UnixConn
+}
+
+func (c *fdConn) fd() (fd int, err error) {
+	err = errors.New(fildesUnsupportErr)
+	return
+}
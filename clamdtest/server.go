@@ -0,0 +1,694 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultVersion is the version reported by the server
+	DefaultVersion = "ClamAV 1.0.1/26850/Mon Mar 13 08:20:43 2023"
+	// DefaultStreamMaxLength is the default INSTREAM size limit
+	DefaultStreamMaxLength = 25 * 1024 * 1024
+	// EicarSignature is the signature name reported for EICAR
+	EicarSignature = "Eicar-Signature"
+
+	pingResp       = "PONG"
+	reloadResp     = "RELOADING"
+	unknownCmdResp = "UNKNOWN COMMAND"
+	statsFmt       = "POOLS: 1\n\nSTATE: VALID PRIMARY\nTHREADS: live %d  idle %d max %d idle-timeout 30\nQUEUE: 0 items\n\tSTATS 0.000000 \n\nMEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 0.000M pools_total 0.000M\nEND"
+	maxThreads     = 10
+	maxDepth       = 8
+)
+
+var (
+	eicar    = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	commands = []string{
+		"SCAN", "QUIT", "RELOAD", "PING", "CONTSCAN", "VERSIONCOMMANDS", "VERSION",
+		"END", "SHUTDOWN", "MULTISCAN", "FILDES", "STATS", "IDSESSION", "INSTREAM",
+	}
+)
+
+// A Server is a fake clamd listening on a unix socket or a
+// TCP port on the loopback interface. It implements the clamd
+// protocol with the n, z and legacy command forms, detects the
+// EICAR test string and any content registered with AddSignature.
+type Server struct {
+	// Network is the network the server listens on, unix or tcp
+	Network string
+	// Address is the socket path or host:port of the server
+	Address string
+	// Version is reported by VERSION and VERSIONCOMMANDS
+	Version string
+	// StreamMaxLength is the maximum INSTREAM size
+	StreamMaxLength int64
+
+	l          net.Listener
+	dir        string
+	mu         sync.Mutex
+	signatures map[string]string
+	conns      map[net.Conn]struct{}
+	reloads    int
+	commands   map[string]int
+	faults     map[string]*Fault
+	closed     bool
+	wg         sync.WaitGroup
+	done       chan struct{}
+}
+
+// NewServer starts and returns a server listening on a
+// unix socket in a temporary directory
+func NewServer() (s *Server) {
+	s = NewUnstartedServer("unix")
+	s.Start()
+	return
+}
+
+// NewTCPServer starts and returns a server listening
+// on a TCP port on the loopback interface
+func NewTCPServer() (s *Server) {
+	s = NewUnstartedServer("tcp")
+	s.Start()
+	return
+}
+
+// NewUnstartedServer returns a server that is not yet listening,
+// the caller should call Start after changing its configuration
+func NewUnstartedServer(network string) (s *Server) {
+	s = &Server{
+		Network:         network,
+		Version:         DefaultVersion,
+		StreamMaxLength: DefaultStreamMaxLength,
+		signatures:      make(map[string]string),
+		conns:           make(map[net.Conn]struct{}),
+		commands:        make(map[string]int),
+		faults:          make(map[string]*Fault),
+		done:            make(chan struct{}),
+	}
+	return
+}
+
+// Start starts the server, it panics if the server can not listen
+func (s *Server) Start() {
+	var err error
+
+	if s.l != nil {
+		panic("clamdtest: Server already started")
+	}
+
+	switch s.Network {
+	case "unix":
+		if s.dir, err = ioutil.TempDir("", "clamdtest"); err != nil {
+			panic(fmt.Sprintf("clamdtest: failed to create a temp directory: %v", err))
+		}
+		s.Address = filepath.Join(s.dir, "clamd.sock")
+	case "tcp", "tcp4":
+		s.Network = "tcp"
+		s.Address = "127.0.0.1:0"
+	default:
+		panic(fmt.Sprintf("clamdtest: unsupported network: %s", s.Network))
+	}
+
+	if s.l, err = net.Listen(s.Network, s.Address); err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to listen on %s: %v", s.Address, err))
+	}
+	s.Address = s.l.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close shuts down the server and closes all connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.l != nil {
+		s.l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// Done is closed when the server has been shutdown with
+// the SHUTDOWN command or by calling Close
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// AddSignature registers content the server reports as infected
+func (s *Server) AddSignature(name string, content []byte) {
+	sum := sha256.Sum256(content)
+	s.AddHash(name, hex.EncodeToString(sum[:]))
+}
+
+// AddHash registers the SHA-256 hex digest of content the
+// server reports as infected
+func (s *Server) AddHash(name, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signatures[strings.ToLower(hash)] = name
+}
+
+// Reloads returns the number of RELOAD commands received
+func (s *Server) Reloads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reloads
+}
+
+// Commands returns the number of times cmd was received
+func (s *Server) Commands(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commands[cmd]
+}
+
+// Match returns the signature name matched by content
+func (s *Server) Match(content []byte) (sig string, found bool) {
+	sig = s.match(content, 0)
+	found = sig != ""
+	return
+}
+
+func (s *Server) match(content []byte, depth int) (sig string) {
+	sum := sha256.Sum256(content)
+
+	s.mu.Lock()
+	sig = s.signatures[hex.EncodeToString(sum[:])]
+	s.mu.Unlock()
+	if sig != "" {
+		return
+	}
+
+	if bytes.Contains(content, eicar) {
+		sig = EicarSignature
+		return
+	}
+
+	if depth >= maxDepth {
+		return
+	}
+
+	for _, m := range unpack(content) {
+		if sig = s.match(m, depth+1); sig != "" {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) live() (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n = len(s.conns)
+
+	return
+}
+
+func (s *Server) count(cmd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[cmd]++
+	if cmd == "RELOAD" {
+		s.reloads++
+	}
+}
+
+// conn is a client connection
+type conn struct {
+	s      *Server
+	c      net.Conn
+	fc     *fdConn
+	r      *bufio.Reader
+	wmu    sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// request is a parsed command
+type request struct {
+	id       int
+	cmd      string
+	arg      string
+	delim    byte
+	fault    *Fault
+	injected bool
+}
+
+func (s *Server) handle(c net.Conn) {
+	var err error
+	var req *request
+
+	cn := &conn{s: s, c: c}
+	if uc, ok := c.(*net.UnixConn); ok {
+		cn.fc = &fdConn{UnixConn: uc}
+		cn.r = bufio.NewReader(cn.fc)
+	} else {
+		cn.r = bufio.NewReader(c)
+	}
+	defer cn.close()
+
+	if req, err = cn.readRequest(); err != nil {
+		return
+	}
+
+	if req.cmd == "IDSESSION" {
+		s.count(req.cmd)
+		cn.session(req.delim)
+		return
+	}
+
+	cn.exec(req, false)
+}
+
+func (cn *conn) readRequest() (req *request, err error) {
+	var b byte
+	var l string
+
+	if b, err = cn.r.ReadByte(); err != nil {
+		return
+	}
+
+	req = &request{delim: '\n'}
+	switch b {
+	case 'z':
+		req.delim = 0
+	case 'n':
+	default:
+		cn.r.UnreadByte()
+	}
+
+	if l, err = cn.r.ReadString(req.delim); err != nil {
+		req = nil
+		return
+	}
+
+	l = strings.TrimRight(l, "\r\n\x00")
+	p := strings.SplitN(l, " ", 2)
+	req.cmd = p[0]
+	if len(p) == 2 {
+		req.arg = p[1]
+	}
+
+	return
+}
+
+func (cn *conn) session(delim byte) {
+	var id int
+
+	for {
+		req, err := cn.readRequest()
+		if err != nil {
+			break
+		}
+		id++
+		req.id = id
+		if req.cmd == "END" {
+			cn.s.count(req.cmd)
+			break
+		}
+		if !cn.exec(req, true) {
+			break
+		}
+	}
+
+	cn.wg.Wait()
+}
+
+// exec runs a command, it returns false when the
+// connection should no longer be used
+func (cn *conn) exec(req *request, async bool) (ok bool) {
+	var reply string
+	var content []byte
+	var name string
+
+	cn.s.count(req.cmd)
+	req.fault = cn.s.fault(req.cmd)
+
+	switch req.cmd {
+	case "INSTREAM":
+		var err error
+		if content, err = cn.readStream(req); err != nil {
+			if err == errSizeLimit {
+				cn.send(req, SizeLimitExceeded+string(req.delim))
+				cn.linger()
+			}
+			return
+		}
+		name = "stream"
+	case "FILDES":
+		var err error
+		var fd int
+		if content, fd, err = cn.readFildes(); err != nil {
+			return
+		}
+		name = fmt.Sprintf("fd[%d]", fd)
+	}
+
+	if cn.inject(req) {
+		return
+	}
+
+	switch req.cmd {
+	case "PING":
+		reply = pingResp
+	case "VERSION":
+		reply = cn.s.Version
+	case "VERSIONCOMMANDS":
+		reply = fmt.Sprintf("%s| COMMANDS: %s", cn.s.Version, strings.Join(commands, " "))
+	case "RELOAD":
+		reply = reloadResp
+	case "STATS":
+		live := cn.s.live()
+		reply = fmt.Sprintf(statsFmt, live, maxThreads-live, maxThreads)
+	case "SHUTDOWN":
+		go cn.s.Close()
+		return
+	case "SCAN", "CONTSCAN", "MULTISCAN":
+		cn.reply(req, async, func() []string {
+			return cn.s.scanPath(req.cmd, req.arg)
+		})
+		ok = true
+		return
+	case "INSTREAM", "FILDES":
+	default:
+		cn.write(req, unknownCmdResp)
+		return
+	}
+
+	if name != "" {
+		cn.reply(req, async, func() []string {
+			return []string{cn.s.result(name, content)}
+		})
+		ok = true
+		return
+	}
+
+	cn.write(req, reply)
+	ok = true
+
+	return
+}
+
+func (cn *conn) reply(req *request, async bool, f func() []string) {
+	if !async {
+		cn.write(req, f()...)
+		return
+	}
+
+	cn.wg.Add(1)
+	go func() {
+		defer cn.wg.Done()
+		cn.write(req, f()...)
+	}()
+}
+
+// write sends the reply lines, within a session
+// each line is prefixed with the request id
+func (cn *conn) write(req *request, lines ...string) {
+	var b strings.Builder
+
+	for _, l := range lines {
+		if req.id > 0 {
+			b.WriteString(strconv.Itoa(req.id))
+			b.WriteString(": ")
+		}
+		b.WriteString(l)
+		b.WriteByte(req.delim)
+	}
+
+	cn.send(req, b.String())
+}
+
+// send writes s applying the Truncate and Fragment faults
+func (cn *conn) send(req *request, s string) {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+
+	if cn.closed {
+		return
+	}
+
+	cn.c.SetWriteDeadline(time.Now().Add(time.Minute))
+
+	f := req.fault
+	switch {
+	case f == nil:
+		io.WriteString(cn.c, s)
+	case f.Truncate > 0:
+		if f.Truncate < len(s) {
+			s = s[:f.Truncate]
+		}
+		io.WriteString(cn.c, s)
+		cn.closed = true
+		cn.c.Close()
+	case f.Fragment > 0:
+		for len(s) > 0 {
+			n := f.Fragment
+			if n > len(s) {
+				n = len(s)
+			}
+			if _, err := io.WriteString(cn.c, s[:n]); err != nil {
+				return
+			}
+			s = s[n:]
+			time.Sleep(fragmentDelay)
+		}
+	default:
+		io.WriteString(cn.c, s)
+	}
+}
+
+func (cn *conn) close() {
+	cn.wmu.Lock()
+	cn.closed = true
+	cn.wmu.Unlock()
+	cn.c.Close()
+}
+
+var errSizeLimit = fmt.Errorf("clamdtest: %s", SizeLimitExceeded)
+
+// readStream reads INSTREAM chunks, a fault with AfterBytes
+// set is applied once that much data has been received
+func (cn *conn) readStream(req *request) (content []byte, err error) {
+	var buf bytes.Buffer
+
+	after := int64(-1)
+	if req.fault != nil && req.fault.AfterBytes > 0 {
+		after = req.fault.AfterBytes
+	}
+
+	b := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(cn.r, b); err != nil {
+			return
+		}
+
+		n := int64(binary.BigEndian.Uint32(b))
+		if n == 0 {
+			break
+		}
+
+		if int64(buf.Len())+n > cn.s.StreamMaxLength {
+			err = errSizeLimit
+			return
+		}
+
+		if after > 0 && int64(buf.Len())+n >= after {
+			m := after - int64(buf.Len())
+			if _, err = io.CopyN(&buf, cn.r, m); err != nil {
+				return
+			}
+			after = -1
+			if cn.inject(req) {
+				err = errFault
+				return
+			}
+			n -= m
+		}
+
+		if _, err = io.CopyN(&buf, cn.r, n); err != nil {
+			return
+		}
+	}
+
+	content = buf.Bytes()
+
+	return
+}
+
+func (cn *conn) readFildes() (content []byte, fd int, err error) {
+	var f *os.File
+
+	if cn.fc == nil {
+		err = fmt.Errorf("clamdtest: FILDES requires a unix socket")
+		return
+	}
+
+	// The descriptor is passed with at least one dummy byte
+	if _, err = cn.r.ReadByte(); err != nil {
+		return
+	}
+
+	if fd, err = cn.fc.fd(); err != nil {
+		return
+	}
+
+	f = os.NewFile(uintptr(fd), "fildes")
+	defer f.Close()
+
+	content, err = ioutil.ReadAll(f)
+
+	return
+}
+
+func (s *Server) result(name string, content []byte) (r string) {
+	if sig := s.match(content, 0); sig != "" {
+		r = fmt.Sprintf("%s: %s FOUND", name, sig)
+		return
+	}
+
+	r = fmt.Sprintf("%s: OK", name)
+
+	return
+}
+
+func (s *Server) scanPath(cmd, p string) (r []string) {
+	var err error
+	var fi os.FileInfo
+
+	if fi, err = os.Lstat(p); err != nil {
+		r = append(r, fmt.Sprintf("%s: lstat() failed: %s. ERROR", p, strerror(err)))
+		return
+	}
+
+	if !fi.IsDir() {
+		r = append(r, s.scanFile(p))
+		return
+	}
+
+	filepath.Walk(p, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			r = append(r, fmt.Sprintf("%s: lstat() failed: %s. ERROR", fp, strerror(err)))
+			if cmd == "SCAN" {
+				return io.EOF
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if l := s.scanFile(fp); !strings.HasSuffix(l, ": OK") {
+			r = append(r, l)
+			if cmd == "SCAN" {
+				return io.EOF
+			}
+		}
+
+		return nil
+	})
+
+	if len(r) == 0 {
+		r = append(r, fmt.Sprintf("%s: OK", p))
+	}
+
+	return
+}
+
+func (s *Server) scanFile(p string) (r string) {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		r = fmt.Sprintf("%s: Access denied. ERROR", p)
+		return
+	}
+
+	r = s.result(p, content)
+
+	return
+}
+
+// strerror returns the C library style message for err
+func strerror(err error) (s string) {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+
+	s = err.Error()
+	if s != "" {
+		s = strings.ToUpper(s[:1]) + s[1:]
+	}
+
+	return
+}
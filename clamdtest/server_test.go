@@ -0,0 +1,357 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamdtest provides an in-process fake clamd server
+for testing code that uses the clamd client without ClamAV.
+*/
+package clamdtest_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+const (
+	eicarFile    = "../examples/eicar.txt"
+	eicarArchive = "../examples/eicar.tar.bz2"
+)
+
+func newClient(t *testing.T, s *clamdtest.Server) (c *clamd.Client) {
+	var err error
+	if c, err = clamd.NewClient(s.Network, s.Address); err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+	return
+}
+
+func testDir(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	for _, fn := range []string{eicarFile, eicarArchive} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("Reading %s failed: %s", fn, err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(fn)), b, 0644); err != nil {
+			t.Fatalf("Writing %s failed: %s", fn, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "clean.txt"), []byte("clean"), 0644); err != nil {
+		t.Fatalf("Writing clean.txt failed: %s", err)
+	}
+	return
+}
+
+func TestServer(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+
+	v, e := c.VersionInfo(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if v.Raw != clamdtest.DefaultVersion || v.DatabaseVersion != 26850 {
+		t.Errorf("Got %+v", v)
+	}
+
+	cmds, v, e := c.VersionCmds(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(cmds) == 0 || cmds[0] != "SCAN" || v.Raw != clamdtest.DefaultVersion {
+		t.Errorf("Got %q %+v", cmds, v)
+	}
+
+	st, e := c.StatsResult(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if st.Pools != 1 || st.ThreadPools[0].Threads.Max != 10 {
+		t.Errorf("Got %+v", st)
+	}
+
+	if b, e := c.Reload(ctx); e != nil || !b {
+		t.Errorf("Reload: got %t, %v", b, e)
+	}
+	if n := s.Reloads(); n != 1 {
+		t.Errorf("Expected 1 reload got %d", n)
+	}
+	if n := s.Commands("PING"); n != 1 {
+		t.Errorf("Expected 1 PING got %d", n)
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+	dir := testDir(t)
+	fn := filepath.Join(dir, "eicar.txt")
+
+	r, e := c.Scan(ctx, fn)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != fn || r[0].Signature != clamdtest.EicarSignature || r[0].Status != "FOUND" {
+		t.Errorf("Got %v", r)
+	}
+
+	clean := filepath.Join(dir, "clean.txt")
+	if r, e = c.Scan(ctx, clean); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != clean || r[0].Status != "OK" {
+		t.Errorf("Got %v", r)
+	}
+
+	if r, e = c.Scan(ctx, dir); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "FOUND" {
+		t.Errorf("Expected SCAN to stop at the first detection got %v", r)
+	}
+
+	for _, f := range []func(context.Context, string) ([]*clamd.Response, error){c.ContScan, c.MultiScan} {
+		if r, e = f(ctx, dir); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(r) != 2 {
+			t.Fatalf("Expected 2 detections got %v", r)
+		}
+		if r[0].Filename != filepath.Join(dir, "eicar.tar.bz2") || r[1].Filename != fn {
+			t.Errorf("Got %v", r)
+		}
+	}
+
+	if r, e = c.Scan(ctx, filepath.Join(dir, "missing")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "ERROR" || !strings.Contains(r[0].Error, "lstat() failed: No such file or directory") {
+		t.Errorf("Got %v", r)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	r, e := c.InStream(ctx, eicarFile)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != "stream" || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Got %v", r)
+	}
+
+	if r, e = c.InStream(ctx, eicarArchive); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Expected the archive member to be detected got %v", r)
+	}
+
+	content := bytes.Repeat([]byte("custom malware "), 1000)
+	s.AddSignature("Test.Custom-1", content)
+	if r, e = c.ScanReader(ctx, bytes.NewReader(content)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Signature != "Test.Custom-1" {
+		t.Errorf("Got %v", r)
+	}
+	if sig, found := s.Match(content); !found || sig != "Test.Custom-1" {
+		t.Errorf("Match: got %q %t", sig, found)
+	}
+
+	if r, e = c.ScanReader(ctx, strings.NewReader("clean")); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "OK" {
+		t.Errorf("Got %v", r)
+	}
+}
+
+func TestServerStreamMaxLength(t *testing.T) {
+	s := clamdtest.NewUnstartedServer("tcp")
+	s.StreamMaxLength = 2048
+	s.Start()
+	defer s.Close()
+
+	conn, e := net.Dial(s.Network, s.Address)
+	if e != nil {
+		t.Fatalf("Dial failed: %s", e)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("zINSTREAM\x00"))
+	conn.Write([]byte{0, 0, 0x0c, 0})
+	conn.Write(make([]byte, 3072))
+	l, e := bufio.NewReader(conn).ReadString(0)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if l != "INSTREAM size limit exceeded. ERROR\x00" {
+		t.Errorf("Got %q", l)
+	}
+}
+
+func TestServerFildes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FILDES is not supported on windows")
+	}
+
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	r, e := c.Fildes(ctx, eicarFile)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || !strings.HasPrefix(r[0].Filename, "fd[") || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Got %v", r)
+	}
+
+	ss, e := c.IDSession(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer ss.End()
+	if r, e = ss.Fildes(ctx, eicarFile); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Got %v", r)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	s := clamdtest.NewTCPServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	ctx := context.Background()
+	dir := testDir(t)
+
+	ss, e := c.IDSession(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				r, err := ss.InStream(ctx, eicarFile)
+				if err != nil || len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+					t.Errorf("InStream: got %v, %v", r, err)
+				}
+				return
+			}
+			fn := filepath.Join(dir, "clean.txt")
+			r, err := ss.Scan(ctx, fn)
+			if err != nil || len(r) != 1 || r[0].Filename != fn || r[0].Status != "OK" {
+				t.Errorf("Scan: got %v, %v", r, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if st, e := ss.Stats(ctx); e != nil || !strings.HasSuffix(st, "END") {
+		t.Errorf("Stats: got %q, %v", st, e)
+	}
+	if e = ss.End(); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if n := s.Commands("IDSESSION"); n != 1 {
+		t.Errorf("Expected 1 IDSESSION got %d", n)
+	}
+	for i := 0; s.Commands("END") != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expected 1 END got %d", s.Commands("END"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerRaw(t *testing.T) {
+	s := clamdtest.NewTCPServer()
+	defer s.Close()
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"zPING\x00", "PONG\x00"},
+		{"nPING\n", "PONG\n"},
+		{"PING\n", "PONG\n"},
+		{"zVERSION\x00", clamdtest.DefaultVersion + "\x00"},
+		{"nFOO\n", "UNKNOWN COMMAND\n"},
+		{"zIDSESSION\x00zPING\x00zVERSION\x00zEND\x00", "1: PONG\x002: " + clamdtest.DefaultVersion + "\x00"},
+	}
+
+	for _, tt := range tests {
+		conn, e := net.Dial(s.Network, s.Address)
+		if e != nil {
+			t.Fatalf("Dial failed: %s", e)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(tt.in))
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(b) != tt.out {
+			t.Errorf("%q: got %q want %q", tt.in, b, tt.out)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	c := newClient(t, s)
+	if e := c.Shutdown(context.Background()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The server was not shutdown")
+	}
+
+	if _, e := os.Stat(s.Address); !os.IsNotExist(e) {
+		t.Errorf("Expected the socket to be removed")
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxFails    = 1
+	defaultFailTimeout = 10 * time.Second
+	noEndpointsErr     = "No cluster endpoints are available"
+)
+
+// Balancer selects the endpoint a command is sent to
+type Balancer int
+
+const (
+	// RoundRobin sends commands to each endpoint in turn
+	RoundRobin Balancer = iota
+	// LeastOutstanding sends commands to the endpoint with
+	// the fewest commands in progress
+	LeastOutstanding
+	// RandomTwoChoices picks two endpoints at random and sends
+	// commands to the one with fewer commands in progress
+	RandomTwoChoices
+)
+
+// Scanner is the set of commands implemented
+// by both Client and Cluster
+type Scanner interface {
+	Ping(ctx context.Context) (bool, error)
+	Version(ctx context.Context) (string, error)
+	VersionInfo(ctx context.Context) (*VersionInfo, error)
+	VersionCmds(ctx context.Context) ([]string, *VersionInfo, error)
+	Reload(ctx context.Context) (bool, error)
+	Shutdown(ctx context.Context) error
+	Stats(ctx context.Context) (string, error)
+	StatsResult(ctx context.Context) (*StatsResult, error)
+	Scan(ctx context.Context, p string) ([]*Response, error)
+	ScanReader(ctx context.Context, i io.Reader) ([]*Response, error)
+	ScanAndStore(ctx context.Context, i io.Reader, s Sink) ([]*Response, error)
+	ContScan(ctx context.Context, p string) ([]*Response, error)
+	MultiScan(ctx context.Context, p string) ([]*Response, error)
+	InStream(ctx context.Context, p string) ([]*Response, error)
+	Fildes(ctx context.Context, p string) ([]*Response, error)
+}
+
+var (
+	_ Scanner = (*Client)(nil)
+	_ Scanner = (*Cluster)(nil)
+)
+
+// Endpoint is the address of a clamd server
+type Endpoint struct {
+	Network string
+	Address string
+}
+
+// EndpointStatus is the state of a cluster endpoint
+type EndpointStatus struct {
+	Endpoint
+	Healthy     bool
+	Outstanding int64
+	Failures    int64
+}
+
+// ClusterConfig holds the cluster settings
+type ClusterConfig struct {
+	// Balancer selects the endpoint for each command
+	Balancer Balancer
+	// Retries is the number of other endpoints a failed command
+	// is retried on, zero means every endpoint is tried once and
+	// a negative value disables retries
+	Retries int
+	// MaxFails is the number of consecutive failures after which
+	// an endpoint is marked unhealthy, zero means the default of 1
+	MaxFails int
+	// FailTimeout is the time an endpoint marked unhealthy by
+	// failed commands is skipped, zero means the default of 10s
+	FailTimeout time.Duration
+	// HealthCheckInterval is the interval at which endpoints are
+	// checked with a PING, zero disables active health checks
+	HealthCheckInterval time.Duration
+}
+
+// A Cluster sends commands to a set of clamd servers,
+// commands that fail on one server with a retryable
+// error are sent to another. The Set methods should be
+// called before the cluster is used.
+type Cluster struct {
+	next  uint64
+	cfg   ClusterConfig
+	nodes []*node
+	rmu   sync.Mutex
+	rnd   *rand.Rand
+	stop  chan struct{}
+	start sync.Once
+	once  sync.Once
+}
+
+type node struct {
+	outstanding int64
+	failures    int64
+	ep          Endpoint
+	c           *Client
+	mu          sync.Mutex
+	fails       int
+	downUntil   time.Time
+	down        bool
+}
+
+// NewCluster returns a new cluster of the endpoints
+func NewCluster(endpoints []Endpoint, cfg ClusterConfig) (cl *Cluster, err error) {
+	var c *Client
+
+	if len(endpoints) == 0 {
+		err = ErrNoEndpoints
+		return
+	}
+
+	if cfg.MaxFails <= 0 {
+		cfg.MaxFails = defaultMaxFails
+	}
+
+	if cfg.FailTimeout <= 0 {
+		cfg.FailTimeout = defaultFailTimeout
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = len(endpoints) - 1
+	} else if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+
+	cl = &Cluster{
+		cfg:  cfg,
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop: make(chan struct{}),
+	}
+
+	for _, ep := range endpoints {
+		if c, err = NewClient(ep.Network, ep.Address); err != nil {
+			cl = nil
+			return
+		}
+		cl.nodes = append(cl.nodes, &node{ep: ep, c: c})
+	}
+
+	return
+}
+
+// SetConnTimeout sets the connection timeout of all endpoints
+func (cl *Cluster) SetConnTimeout(t time.Duration) {
+	for _, n := range cl.nodes {
+		n.c.SetConnTimeout(t)
+	}
+}
+
+// SetCmdTimeout sets the cmd timeout of all endpoints
+func (cl *Cluster) SetCmdTimeout(t time.Duration) {
+	for _, n := range cl.nodes {
+		n.c.SetCmdTimeout(t)
+	}
+}
+
+// SetConnRetries sets the number of times the connection
+// to an endpoint is retried
+func (cl *Cluster) SetConnRetries(s int) {
+	for _, n := range cl.nodes {
+		n.c.SetConnRetries(s)
+	}
+}
+
+// SetConnSleep sets the connection retry sleep duration
+func (cl *Cluster) SetConnSleep(s time.Duration) {
+	for _, n := range cl.nodes {
+		n.c.SetConnSleep(s)
+	}
+}
+
+// SetZMode sets the use of the z command prefix on all endpoints
+func (cl *Cluster) SetZMode(z bool) {
+	for _, n := range cl.nodes {
+		n.c.SetZMode(z)
+	}
+}
+
+// SetAllMatch sets the AllMatchScan mode on all endpoints
+func (cl *Cluster) SetAllMatch(b bool) {
+	for _, n := range cl.nodes {
+		n.c.SetAllMatch(b)
+	}
+}
+
+// SetPool enables connection pooling on all endpoints
+func (cl *Cluster) SetPool(cfg PoolConfig) {
+	for _, n := range cl.nodes {
+		n.c.SetPool(cfg)
+	}
+}
+
+// Close stops the health checks and closes
+// the connection pools
+func (cl *Cluster) Close() (err error) {
+	cl.once.Do(func() {
+		close(cl.stop)
+	})
+
+	for _, n := range cl.nodes {
+		n.c.Close()
+	}
+
+	return
+}
+
+// Status returns the state of the endpoints
+func (cl *Cluster) Status() (s []EndpointStatus) {
+	for _, n := range cl.nodes {
+		s = append(s, EndpointStatus{
+			Endpoint:    n.ep,
+			Healthy:     n.healthy(time.Now()),
+			Outstanding: atomic.LoadInt64(&n.outstanding),
+			Failures:    atomic.LoadInt64(&n.failures),
+		})
+	}
+
+	return
+}
+
+// Ping sends a ping to an endpoint
+func (cl *Cluster) Ping(ctx context.Context) (b bool, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		b, e = c.Ping(ctx)
+		return
+	})
+	return
+}
+
+// Version returns the server version of an endpoint
+func (cl *Cluster) Version(ctx context.Context) (v string, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		v, e = c.Version(ctx)
+		return
+	})
+	return
+}
+
+// VersionInfo returns the parsed server version of an endpoint
+func (cl *Cluster) VersionInfo(ctx context.Context) (v *VersionInfo, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		v, e = c.VersionInfo(ctx)
+		return
+	})
+	return
+}
+
+// VersionCmds returns the supported commands of an endpoint
+func (cl *Cluster) VersionCmds(ctx context.Context) (r []string, v *VersionInfo, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, v, e = c.VersionCmds(ctx)
+		return
+	})
+	return
+}
+
+// Reload reloads the virus databases of all endpoints,
+// b is true when all the endpoints are reloading
+func (cl *Cluster) Reload(ctx context.Context) (b bool, err error) {
+	b = true
+	err = cl.each(func(c *Client) (e error) {
+		var ok bool
+		ok, e = c.Reload(ctx)
+		b = b && ok
+		return
+	})
+	return
+}
+
+// Shutdown stops all the endpoints
+func (cl *Cluster) Shutdown(ctx context.Context) (err error) {
+	err = cl.each(func(c *Client) error {
+		return c.Shutdown(ctx)
+	})
+	return
+}
+
+// Stats returns the statistics of an endpoint
+func (cl *Cluster) Stats(ctx context.Context) (s string, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		s, e = c.Stats(ctx)
+		return
+	})
+	return
+}
+
+// StatsResult returns the parsed statistics of an endpoint
+func (cl *Cluster) StatsResult(ctx context.Context) (r *StatsResult, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.StatsResult(ctx)
+		return
+	})
+	return
+}
+
+// Scan a file or directory
+func (cl *Cluster) Scan(ctx context.Context, p string) (r []*Response, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.Scan(ctx, p)
+		return
+	})
+	return
+}
+
+// ScanReader scans an io.reader, the command is only retried
+// when i is an io.Seeker that can be rewound
+func (cl *Cluster) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
+	var pos int64
+
+	sk, retry := i.(io.Seeker)
+	if retry {
+		if pos, err = sk.Seek(0, io.SeekCurrent); err != nil {
+			retry = false
+			err = nil
+		}
+	}
+
+	first := true
+	err = cl.do(ctx, retry, func(c *Client) (e error) {
+		if !first {
+			if _, e = sk.Seek(pos, io.SeekStart); e != nil {
+				return
+			}
+		}
+		first = false
+		r, e = c.ScanReader(ctx, i)
+		return
+	})
+
+	return
+}
+
+// ContScan a file or directory
+func (cl *Cluster) ContScan(ctx context.Context, p string) (r []*Response, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.ContScan(ctx, p)
+		return
+	})
+	return
+}
+
+// MultiScan a file or directory
+func (cl *Cluster) MultiScan(ctx context.Context, p string) (r []*Response, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.MultiScan(ctx, p)
+		return
+	})
+	return
+}
+
+// InStream scan a stream
+func (cl *Cluster) InStream(ctx context.Context, p string) (r []*Response, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.InStream(ctx, p)
+		return
+	})
+	return
+}
+
+// Fildes scan a FD
+func (cl *Cluster) Fildes(ctx context.Context, p string) (r []*Response, err error) {
+	err = cl.do(ctx, true, func(c *Client) (e error) {
+		r, e = c.Fildes(ctx, p)
+		return
+	})
+	return
+}
+
+// do runs f on an endpoint, when retry is set and f fails with
+// a retryable error it is run again on another endpoint
+func (cl *Cluster) do(ctx context.Context, retry bool, f func(c *Client) error) (err error) {
+	var n *node
+
+	cl.start.Do(cl.startHealthCheck)
+
+	tried := make(map[*node]bool)
+	for i := 0; ; i++ {
+		if n = cl.pick(tried); n == nil {
+			if err == nil {
+				err = ErrNoEndpoints
+			}
+			return
+		}
+		tried[n] = true
+
+		atomic.AddInt64(&n.outstanding, 1)
+		err = f(n.c)
+		atomic.AddInt64(&n.outstanding, -1)
+
+		if err != nil && IsRetryable(err) && ctx.Err() == nil {
+			cl.fail(n)
+		} else {
+			n.ok()
+		}
+
+		if err == nil || !retry || i >= cl.cfg.Retries || !IsRetryable(err) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// each runs f on every endpoint returning the first error
+func (cl *Cluster) each(f func(c *Client) error) (err error) {
+	cl.start.Do(cl.startHealthCheck)
+
+	for _, n := range cl.nodes {
+		if e := f(n.c); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// pick returns an endpoint that has not been tried, healthy
+// endpoints are preferred over unhealthy ones
+func (cl *Cluster) pick(tried map[*node]bool) (n *node) {
+	var healthy, other []*node
+
+	now := time.Now()
+	for _, nd := range cl.nodes {
+		if tried[nd] {
+			continue
+		}
+		if nd.healthy(now) {
+			healthy = append(healthy, nd)
+		} else {
+			other = append(other, nd)
+		}
+	}
+
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = other
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	start := int(atomic.AddUint64(&cl.next, 1)-1) % len(candidates)
+
+	switch cl.cfg.Balancer {
+	case LeastOutstanding:
+		for i := range candidates {
+			nd := candidates[(start+i)%len(candidates)]
+			if n == nil || atomic.LoadInt64(&nd.outstanding) < atomic.LoadInt64(&n.outstanding) {
+				n = nd
+			}
+		}
+	case RandomTwoChoices:
+		n = candidates[0]
+		if len(candidates) > 1 {
+			cl.rmu.Lock()
+			a := cl.rnd.Intn(len(candidates))
+			b := cl.rnd.Intn(len(candidates) - 1)
+			cl.rmu.Unlock()
+			if b >= a {
+				b++
+			}
+			n = candidates[a]
+			if atomic.LoadInt64(&candidates[b].outstanding) < atomic.LoadInt64(&n.outstanding) {
+				n = candidates[b]
+			}
+		}
+	default:
+		n = candidates[start]
+	}
+
+	return
+}
+
+// fail records a failed command, the endpoint is marked
+// unhealthy for FailTimeout after MaxFails failures
+func (cl *Cluster) fail(n *node) {
+	atomic.AddInt64(&n.failures, 1)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.fails++; n.fails >= cl.cfg.MaxFails {
+		n.downUntil = time.Now().Add(cl.cfg.FailTimeout)
+	}
+}
+
+func (cl *Cluster) startHealthCheck() {
+	if cl.cfg.HealthCheckInterval > 0 {
+		go cl.healthCheck()
+	}
+}
+
+func (cl *Cluster) healthCheck() {
+	t := time.NewTicker(cl.cfg.HealthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cl.stop:
+			return
+		case <-t.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range cl.nodes {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), cl.cfg.HealthCheckInterval)
+				defer cancel()
+				b, err := n.c.Ping(ctx)
+				down := err != nil || !b
+				n.mu.Lock()
+				n.down = down
+				n.mu.Unlock()
+				if down {
+					atomic.AddInt64(&n.failures, 1)
+				}
+			}(n)
+		}
+		wg.Wait()
+	}
+}
+
+// ok resets the failure count after a successful command
+func (n *node) ok() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.fails = 0
+	n.downUntil = time.Time{}
+}
+
+func (n *node) healthy(now time.Time) (b bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	b = !n.down && !now.Before(n.downUntil)
+
+	return
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func testCluster(t *testing.T, n int, cfg ClusterConfig) (cl *Cluster, servers []*clamdtest.Server) {
+	var e error
+	var eps []Endpoint
+
+	for i := 0; i < n; i++ {
+		s := clamdtest.NewServer()
+		t.Cleanup(s.Close)
+		servers = append(servers, s)
+		eps = append(eps, Endpoint{Network: s.Network, Address: s.Address})
+	}
+
+	if cl, e = NewCluster(eps, cfg); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	cl.SetCmdTimeout(time.Second)
+	t.Cleanup(func() { cl.Close() })
+
+	return
+}
+
+func TestClusterRoundRobin(t *testing.T) {
+	cl, servers := testCluster(t, 3, ClusterConfig{})
+	ctx := context.Background()
+
+	for i := 0; i < 9; i++ {
+		if b, e := cl.Ping(ctx); e != nil || !b {
+			t.Fatalf("Ping: got %t, %v", b, e)
+		}
+	}
+
+	for i, s := range servers {
+		if n := s.Commands("PING"); n != 3 {
+			t.Errorf("Expected server %d to get 3 PING got %d", i, n)
+		}
+	}
+
+	if b, e := cl.Reload(ctx); e != nil || !b {
+		t.Errorf("Reload: got %t, %v", b, e)
+	}
+	for i, s := range servers {
+		if n := s.Reloads(); n != 1 {
+			t.Errorf("Expected server %d to get 1 RELOAD got %d", i, n)
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	cl, servers := testCluster(t, 3, ClusterConfig{})
+	ctx := context.Background()
+
+	servers[0].Close()
+	servers[1].InjectFault("INSTREAM", clamdtest.Fault{Reset: true})
+
+	var e error
+	for i := 0; i < 2; i++ {
+		var r []*Response
+		if r, e = cl.InStream(ctx, "./examples/eicar.txt"); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+			t.Errorf("Got %v", r)
+		}
+	}
+	if n := servers[2].Commands("INSTREAM"); n != 2 {
+		t.Errorf("Expected the commands to be retried on server 2 got %d", n)
+	}
+
+	st := cl.Status()
+	if st[0].Healthy || st[1].Healthy || !st[2].Healthy {
+		t.Errorf("Expected servers 0 and 1 to be unhealthy got %+v", st)
+	}
+	if st[0].Failures != 1 || st[1].Failures != 1 {
+		t.Errorf("Expected 1 failure got %+v", st)
+	}
+
+	for i := 0; i < 3; i++ {
+		if b, e := cl.Ping(ctx); e != nil || !b {
+			t.Fatalf("Ping: got %t, %v", b, e)
+		}
+	}
+	if n := servers[1].Commands("PING"); n != 0 {
+		t.Errorf("Expected the unhealthy server to be skipped got %d", n)
+	}
+
+	servers[2].InjectFault("SCAN", clamdtest.Fault{Reply: clamdtest.SizeLimitExceeded})
+	if _, e = cl.Scan(ctx, "/tmp"); e == nil || IsRetryable(e) {
+		t.Errorf("Expected a non retryable error got %v", e)
+	}
+	if n := servers[1].Commands("SCAN"); n != 0 {
+		t.Errorf("Expected a non retryable error not to be retried")
+	}
+}
+
+func TestClusterNoRetry(t *testing.T) {
+	cl, servers := testCluster(t, 2, ClusterConfig{Retries: -1})
+	ctx := context.Background()
+
+	servers[0].InjectFault("PING", clamdtest.Fault{Reset: true})
+	if _, e := cl.Ping(ctx); e != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, e)
+	}
+	if n := servers[1].Commands("PING"); n != 0 {
+		t.Errorf("Expected no retry got %d", n)
+	}
+
+	if _, e := NewCluster(nil, ClusterConfig{}); e != ErrNoEndpoints {
+		t.Errorf("Expected %v got %v", ErrNoEndpoints, e)
+	}
+}
+
+func TestClusterScanReader(t *testing.T) {
+	cl, servers := testCluster(t, 2, ClusterConfig{})
+	ctx := context.Background()
+
+	eicar, e := ioutil.ReadFile("./examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	servers[0].InjectFault("INSTREAM", clamdtest.Fault{Reset: true, Times: 1})
+	r, e := cl.ScanReader(ctx, bytes.NewReader(eicar))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Expected the rewound reader to be scanned got %v", r)
+	}
+
+	// Reset the round robin so server 0 gets the command
+	servers[0].InjectFault("INSTREAM", clamdtest.Fault{Reset: true, Times: 1})
+	cl.next = 0
+	cl.nodes[0].ok()
+	if _, e = cl.ScanReader(ctx, io.MultiReader(bytes.NewReader(eicar))); e == nil {
+		t.Errorf("Expected a reader that can not be rewound not to be retried")
+	}
+	if n := servers[1].Commands("INSTREAM"); n != 1 {
+		t.Errorf("Expected 1 INSTREAM on server 1 got %d", n)
+	}
+}
+
+func TestClusterBalancers(t *testing.T) {
+	for _, b := range []Balancer{LeastOutstanding, RandomTwoChoices} {
+		cl, _ := testCluster(t, 2, ClusterConfig{Balancer: b})
+		cl.nodes[0].outstanding = 5
+
+		for i := 0; i < 10; i++ {
+			if n := cl.pick(nil); n != cl.nodes[1] {
+				t.Errorf("Balancer %d: expected the least loaded endpoint", b)
+			}
+		}
+
+		cl.nodes[1].downUntil = time.Now().Add(time.Minute)
+		if n := cl.pick(nil); n != cl.nodes[0] {
+			t.Errorf("Balancer %d: expected the healthy endpoint", b)
+		}
+		if n := cl.pick(map[*node]bool{cl.nodes[0]: true}); n != cl.nodes[1] {
+			t.Errorf("Balancer %d: expected an unhealthy endpoint when no other is left", b)
+		}
+	}
+}
+
+func TestClusterHealthCheck(t *testing.T) {
+	cl, servers := testCluster(t, 2, ClusterConfig{HealthCheckInterval: 20 * time.Millisecond})
+	if b, e := cl.Ping(context.Background()); e != nil || !b {
+		t.Fatalf("Ping: got %t, %v", b, e)
+	}
+
+	servers[1].InjectFault("PING", clamdtest.Fault{Reply: "garbage"})
+	wait := func(healthy bool) {
+		for i := 0; cl.Status()[1].Healthy != healthy; i++ {
+			if i == 100 {
+				t.Fatalf("Expected healthy to be %t got %+v", healthy, cl.Status())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wait(false)
+	if !cl.Status()[0].Healthy {
+		t.Errorf("Expected server 0 to be healthy")
+	}
+
+	servers[1].ClearFaults()
+	wait(true)
+}
@@ -0,0 +1,305 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/baruwa-enterprise/clamd"
+)
+
+const (
+	methodErr       = "Method not allowed"
+	tooLargeErr     = "The request body is too large"
+	tooManyPartsErr = "The request has too many parts"
+	badRequestErr   = "The request body could not be read"
+	notMultipartErr = "The request is not multipart/form-data"
+	unauthorizedErr = "A valid admin token is required"
+	reloadErr       = "clamd did not reply with RELOADING"
+)
+
+// scanResult is the result of scanning a body or a file part,
+// Failed is set when clamd could not scan it
+type scanResult struct {
+	Field     string            `json:"field,omitempty"`
+	Filename  string            `json:"filename,omitempty"`
+	Infected  bool              `json:"infected"`
+	Failed    bool              `json:"failed"`
+	Verdict   *clamd.Verdict    `json:"verdict"`
+	Responses []*clamd.Response `json:"responses"`
+}
+
+type multipartResult struct {
+	Infected bool          `json:"infected"`
+	Failed   bool          `json:"failed"`
+	Parts    []*scanResult `json:"parts"`
+}
+
+// setVerdict sets the verdict of the responses
+func (sr *scanResult) setVerdict() {
+	sr.Verdict = clamd.NewVerdict(sr.Responses)
+	sr.Infected = sr.Verdict.Infected()
+	sr.Failed = sr.Verdict.Failed()
+}
+
+var errTooLarge = errors.New(tooLargeErr)
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// server exposes a clamd.Scanner over HTTP
+type server struct {
+	c   clamd.Scanner
+	cfg *Config
+}
+
+func newServer(c clamd.Scanner, cfg *Config) http.Handler {
+	s := &server{
+		c:   c,
+		cfg: cfg,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", s.method(http.MethodPost, s.scan))
+	mux.HandleFunc("/scan/multipart", s.method(http.MethodPost, s.scanMultipart))
+	mux.HandleFunc("/ping", s.method(http.MethodGet, s.ping))
+	mux.HandleFunc("/version", s.method(http.MethodGet, s.version))
+	mux.HandleFunc("/stats", s.method(http.MethodGet, s.stats))
+	mux.HandleFunc("/reload", s.method(http.MethodPost, s.admin(s.reload)))
+
+	return mux
+}
+
+// method rejects requests that do not use m
+func (s *server) method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, methodErr)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// admin rejects requests without the admin token, every
+// request is rejected when no token is configured
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, unauthorizedErr)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func (s *server) scan(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	sr := &scanResult{}
+	body := s.limit(w, r.Body)
+	if sr.Responses, err = s.c.ScanReader(r.Context(), body); err != nil {
+		s.scanError(w, err)
+		return
+	}
+	sr.setVerdict()
+
+	writeJSON(w, http.StatusOK, sr)
+}
+
+func (s *server) scanMultipart(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var part *multipart.Part
+
+	mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" || params["boundary"] == "" {
+		writeError(w, http.StatusBadRequest, notMultipartErr)
+		return
+	}
+
+	mr := multipart.NewReader(s.limit(w, r.Body), params["boundary"])
+	res := &multipartResult{Parts: []*scanResult{}}
+	for {
+		if part, err = mr.NextPart(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			var br *bodyError
+			if !errors.As(err, &br) {
+				err = &bodyError{err: err}
+			}
+			s.scanError(w, err)
+			return
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		if s.cfg.MaxParts > 0 && len(res.Parts) == s.cfg.MaxParts {
+			writeError(w, http.StatusRequestEntityTooLarge, tooManyPartsErr)
+			return
+		}
+
+		sr := &scanResult{
+			Field:    part.FormName(),
+			Filename: part.FileName(),
+		}
+		if sr.Responses, err = s.c.ScanReader(r.Context(), part); err != nil {
+			s.scanError(w, err)
+			return
+		}
+		sr.setVerdict()
+		res.Infected = res.Infected || sr.Infected
+		res.Failed = res.Failed || sr.Failed
+		res.Parts = append(res.Parts, sr)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) ping(w http.ResponseWriter, r *http.Request) {
+	b, err := s.c.Ping(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"ping": b})
+}
+
+func (s *server) version(w http.ResponseWriter, r *http.Request) {
+	v, err := s.c.VersionInfo(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *server) stats(w http.ResponseWriter, r *http.Request) {
+	st, err := s.c.StatsResult(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *server) reload(w http.ResponseWriter, r *http.Request) {
+	b, err := s.c.Reload(r.Context())
+	if err == nil && !b {
+		err = errors.New(reloadErr)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"reloading": b})
+}
+
+// limit caps the size of a request body at MaxSize, the
+// MaxBytesReader reads one byte more so the bodyReader can
+// tell a body that is too large
+func (s *server) limit(w http.ResponseWriter, body io.ReadCloser) io.Reader {
+	var r io.Reader = body
+
+	if s.cfg.MaxSize > 0 {
+		r = http.MaxBytesReader(w, body, s.cfg.MaxSize+1)
+	}
+
+	return &bodyReader{r: r, max: s.cfg.MaxSize}
+}
+
+// scanError writes the response for a failed scan
+func (s *server) scanError(w http.ResponseWriter, err error) {
+	var br *bodyError
+
+	switch {
+	case errors.As(err, &br) && br.tooLarge:
+		writeError(w, http.StatusRequestEntityTooLarge, tooLargeErr)
+	case errors.As(err, &br):
+		writeError(w, http.StatusBadRequest, badRequestErr)
+	case errors.Is(err, clamd.ErrSizeLimitExceeded):
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// bodyReader marks the errors of reading the request body
+// so they are not taken for clamd errors, a body of more
+// than max bytes is too large
+type bodyReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (b *bodyReader) Read(p []byte) (n int, err error) {
+	if b.max > 0 && b.n > b.max {
+		err = &bodyError{err: errTooLarge, tooLarge: true}
+		return
+	}
+
+	n, err = b.r.Read(p)
+	b.n += int64(n)
+
+	if b.max > 0 && b.n > b.max {
+		n -= int(b.n - b.max)
+		err = &bodyError{err: errTooLarge, tooLarge: true}
+		return
+	}
+
+	if err != nil && err != io.EOF {
+		err = &bodyError{err: err}
+	}
+
+	return
+}
+
+type bodyError struct {
+	err      error
+	tooLarge bool
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyError) Unwrap() error {
+	return e.err
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &errorBody{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+const eicarFile = "../../examples/eicar.txt"
+
+func testServer(t *testing.T, cfg *Config) (hs *httptest.Server, s *clamdtest.Server) {
+	s = clamdtest.NewServer()
+	t.Cleanup(s.Close)
+
+	c, err := clamd.NewClient(s.Network, s.Address)
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	hs = httptest.NewServer(newServer(c, cfg))
+	t.Cleanup(hs.Close)
+
+	return
+}
+
+func do(t *testing.T, method, url, ct string, body io.Reader, hdr map[string]string, v interface{}) (code int) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	for k, val := range hdr {
+		req.Header.Set(k, val)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a JSON response got %q", ct)
+	}
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("An error should not be returned: %s", err)
+		}
+	}
+	code = resp.StatusCode
+
+	return
+}
+
+func TestScan(t *testing.T) {
+	eicar, err := ioutil.ReadFile(eicarFile)
+	if err != nil {
+		t.Fatalf("Reading %s failed: %s", eicarFile, err)
+	}
+
+	hs, _ := testServer(t, &Config{MaxSize: 1024})
+
+	var sr scanResult
+	if code := do(t, "POST", hs.URL+"/scan", "", bytes.NewReader(eicar), nil, &sr); code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", code)
+	}
+	if !sr.Infected || len(sr.Responses) != 1 || sr.Responses[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Unexpected result %+v", sr)
+	}
+
+	sr = scanResult{}
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader("clean"), nil, &sr); code != http.StatusOK || sr.Infected {
+		t.Errorf("Expected a clean result got %d %+v", code, sr)
+	}
+
+	var eb errorBody
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader(strings.Repeat("a", 2048)), nil, &eb); code != http.StatusRequestEntityTooLarge || eb.Error != tooLargeErr {
+		t.Errorf("Expected 413 got %d %+v", code, eb)
+	}
+
+	// A body of MaxSize bytes is accepted
+	sr = scanResult{}
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader(strings.Repeat("a", 1024)), nil, &sr); code != http.StatusOK {
+		t.Errorf("Expected 200 got %d", code)
+	}
+	eb = errorBody{}
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader(strings.Repeat("a", 1025)), nil, &eb); code != http.StatusRequestEntityTooLarge || eb.Error != tooLargeErr {
+		t.Errorf("Expected 413 got %d %+v", code, eb)
+	}
+
+	if code := do(t, "GET", hs.URL+"/scan", "", nil, nil, &eb); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 got %d", code)
+	}
+}
+
+func TestScanMultipart(t *testing.T) {
+	eicar, err := ioutil.ReadFile(eicarFile)
+	if err != nil {
+		t.Fatalf("Reading %s failed: %s", eicarFile, err)
+	}
+
+	hs, _ := testServer(t, &Config{MaxParts: 2})
+
+	body := func(files ...string) (b *bytes.Buffer, ct string) {
+		b = &bytes.Buffer{}
+		mw := multipart.NewWriter(b)
+		mw.WriteField("comment", "not scanned")
+		for i, f := range files {
+			w, _ := mw.CreateFormFile("file", string(rune('a'+i))+".txt")
+			w.Write([]byte(f))
+		}
+		mw.Close()
+		ct = mw.FormDataContentType()
+		return
+	}
+
+	var res multipartResult
+	b, ct := body("clean", string(eicar))
+	if code := do(t, "POST", hs.URL+"/scan/multipart", ct, b, nil, &res); code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", code)
+	}
+	if !res.Infected || len(res.Parts) != 2 || res.Parts[0].Infected || !res.Parts[1].Infected || res.Parts[1].Filename != "b.txt" {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	var eb errorBody
+	b, ct = body("1", "2", "3")
+	if code := do(t, "POST", hs.URL+"/scan/multipart", ct, b, nil, &eb); code != http.StatusRequestEntityTooLarge || eb.Error != tooManyPartsErr {
+		t.Errorf("Expected 413 got %d %+v", code, eb)
+	}
+
+	if code := do(t, "POST", hs.URL+"/scan/multipart", "text/plain", strings.NewReader("x"), nil, &eb); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 got %d", code)
+	}
+
+	b, _ = body("1")
+	if code := do(t, "POST", hs.URL+"/scan/multipart", "multipart/form-data; boundary=wrong", b, nil, &eb); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 got %d", code)
+	}
+}
+
+func TestScanFailed(t *testing.T) {
+	hs, s := testServer(t, &Config{})
+
+	var sr scanResult
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader("clean"), nil, &sr); code != http.StatusOK || sr.Failed || sr.Verdict == nil || !sr.Verdict.Clean() {
+		t.Errorf("Expected a clean result got %d %+v", code, sr)
+	}
+
+	s.InjectFault("INSTREAM", clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"})
+
+	sr = scanResult{}
+	if code := do(t, "POST", hs.URL+"/scan", "", strings.NewReader("clean"), nil, &sr); code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", code)
+	}
+	if sr.Infected || !sr.Failed || sr.Verdict == nil || sr.Verdict.Status != clamd.StatusError || sr.Verdict.Error != "Can't allocate memory" {
+		t.Errorf("Expected a failed result got %+v", sr)
+	}
+
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	w, _ := mw.CreateFormFile("file", "a.txt")
+	w.Write([]byte("clean"))
+	mw.Close()
+
+	var res multipartResult
+	if code := do(t, "POST", hs.URL+"/scan/multipart", mw.FormDataContentType(), b, nil, &res); code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", code)
+	}
+	if res.Infected || !res.Failed || len(res.Parts) != 1 || !res.Parts[0].Failed {
+		t.Errorf("Expected a failed result got %+v", res)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	hs, s := testServer(t, &Config{AdminToken: "secret"})
+
+	var ping map[string]bool
+	if code := do(t, "GET", hs.URL+"/ping", "", nil, nil, &ping); code != http.StatusOK || !ping["ping"] {
+		t.Errorf("Unexpected ping %d %v", code, ping)
+	}
+
+	var v clamd.VersionInfo
+	if code := do(t, "GET", hs.URL+"/version", "", nil, nil, &v); code != http.StatusOK || v.Raw != clamdtest.DefaultVersion || v.DatabaseVersion != 26850 {
+		t.Errorf("Unexpected version %d %+v", code, v)
+	}
+
+	var st clamd.StatsResult
+	if code := do(t, "GET", hs.URL+"/stats", "", nil, nil, &st); code != http.StatusOK || st.Pools != 1 || len(st.ThreadPools) != 1 {
+		t.Errorf("Unexpected stats %d %+v", code, st)
+	}
+
+	var eb errorBody
+	if code := do(t, "POST", hs.URL+"/reload", "", nil, nil, &eb); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 got %d", code)
+	}
+	if code := do(t, "POST", hs.URL+"/reload", "", nil, map[string]string{"Authorization": "Bearer wrong"}, &eb); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 got %d", code)
+	}
+	if s.Reloads() != 0 {
+		t.Errorf("Expected no reload")
+	}
+
+	var rl map[string]bool
+	if code := do(t, "POST", hs.URL+"/reload", "", nil, map[string]string{"Authorization": "Bearer secret"}, &rl); code != http.StatusOK || !rl["reloading"] {
+		t.Errorf("Unexpected reload %d %v", code, rl)
+	}
+	if s.Reloads() != 1 {
+		t.Errorf("Expected 1 reload got %d", s.Reloads())
+	}
+
+	s.Close()
+	if code := do(t, "GET", hs.URL+"/ping", "", nil, nil, &eb); code != http.StatusBadGateway {
+		t.Errorf("Expected 502 got %d", code)
+	}
+}
+
+func TestReloadDisabled(t *testing.T) {
+	hs, s := testServer(t, &Config{})
+
+	var eb errorBody
+	if code := do(t, "POST", hs.URL+"/reload", "", nil, map[string]string{"Authorization": "Bearer "}, &eb); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 got %d", code)
+	}
+	if s.Reloads() != 0 {
+		t.Errorf("Expected no reload")
+	}
+}
+
+func TestRun(t *testing.T) {
+	var o, e bytes.Buffer
+
+	if code := run(context.Background(), "clamd-http", []string{"--client-version"}, &o, &e); code != exitOK || !strings.HasPrefix(o.String(), "clamd-http "+Version) {
+		t.Errorf("Unexpected version %d %q", code, o.String())
+	}
+
+	if code := run(context.Background(), "clamd-http", []string{"--bogus"}, &o, &e); code != exitError {
+		t.Errorf("Expected %d got %d", exitError, code)
+	}
+
+	e.Reset()
+	if code := run(context.Background(), "clamd-http", []string{"-H", "127.0.0.1", "-l", "127.0.0.1:-1"}, &o, &e); code != exitError || !strings.Contains(e.String(), "ERROR") {
+		t.Errorf("Expected a listen error got %d %q", code, e.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		done <- run(ctx, "clamd-http", []string{"-H", "127.0.0.1", "-l", "127.0.0.1:0"}, ioutil.Discard, ioutil.Discard)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if code := <-done; code != exitOK {
+		t.Errorf("Expected %d got %d", exitOK, code)
+	}
+}
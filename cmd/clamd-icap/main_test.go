@@ -0,0 +1,93 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func freeAddr(t *testing.T) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	addr = l.Addr().String()
+	l.Close()
+	return
+}
+
+func TestRun(t *testing.T) {
+	var o, e bytes.Buffer
+
+	if code := run(context.Background(), "clamd-icap", []string{"--client-version"}, &o, &e); code != exitOK || !strings.HasPrefix(o.String(), "clamd-icap "+Version) {
+		t.Errorf("Unexpected version %d %q", code, o.String())
+	}
+
+	if code := run(context.Background(), "clamd-icap", []string{"--bogus"}, &o, &e); code != exitError {
+		t.Errorf("Expected %d got %d", exitError, code)
+	}
+
+	e.Reset()
+	if code := run(context.Background(), "clamd-icap", []string{"-H", "127.0.0.1", "-l", "127.0.0.1:-1"}, &o, &e); code != exitError || !strings.Contains(e.String(), "ERROR") {
+		t.Errorf("Expected a listen error got %d %q", code, e.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		done <- run(ctx, "clamd-icap", []string{"-H", s.Address, "-l", addr, "--preview", "-1"}, ioutil.Discard, ioutil.Discard)
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("OPTIONS icap://" + addr + "/respmod ICAP/1.0\r\nHost: test\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "ICAP/1.0 200 OK\r\n" {
+		t.Errorf("Unexpected reply %q, %v", line, err)
+	}
+	for line != "\r\n" && err == nil {
+		if line, err = br.ReadString('\n'); strings.HasPrefix(line, "Preview:") {
+			t.Errorf("Expected no preview got %q", line)
+		}
+	}
+	conn.Close()
+
+	cancel()
+	if code := <-done; code != exitOK {
+		t.Errorf("Expected %d got %d", exitOK, code)
+	}
+}
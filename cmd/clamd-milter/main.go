@@ -0,0 +1,199 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	"github.com/baruwa-enterprise/clamd/clamdmilter"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	exitOK    = 0
+	exitError = 2
+
+	defaultSock = "/var/run/clamav/clamd.sock"
+)
+
+// Config holds the configuration
+type Config struct {
+	Address     string
+	Port        int
+	Listen      string
+	ConnTimeout time.Duration
+	CmdTimeout  time.Duration
+	Infected    string
+	FailOpen    bool
+	NoHeaders   bool
+	MaxSize     int64
+	MaxMemory   int64
+	ShowVersion bool
+}
+
+func parseAddr(a string, p int) (n string, h string) {
+	if strings.HasPrefix(a, "/") {
+		n = "unix"
+		h = a
+	} else {
+		n = "tcp"
+		if strings.Contains(a, ":") {
+			h = fmt.Sprintf("[%s]:%d", a, p)
+		} else {
+			h = fmt.Sprintf("%s:%d", a, p)
+		}
+	}
+	return
+}
+
+// parseListen parses the milter socket, unix:/path and
+// inet:host:port as used by MTAs are accepted
+func parseListen(a string) (n string, h string) {
+	switch {
+	case strings.HasPrefix(a, "unix:"):
+		n, h = "unix", strings.TrimPrefix(a, "unix:")
+	case strings.HasPrefix(a, "inet:"):
+		n, h = "tcp", strings.TrimPrefix(a, "inet:")
+	case strings.HasPrefix(a, "/"):
+		n, h = "unix", a
+	default:
+		n, h = "tcp", a
+	}
+	return
+}
+
+func newFlagSet(name string, cfg *Config, stderr io.Writer) (fs *flag.FlagSet) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SortFlags = false
+	fs.SetOutput(stderr)
+	fs.StringVarP(&cfg.Address, "host", "H", defaultSock,
+		`Specify Clamd host or unix socket to connect to.`)
+	fs.IntVarP(&cfg.Port, "port", "p", 3310,
+		`In TCP/IP mode, connect to clamd server listening on given port`)
+	fs.StringVarP(&cfg.Listen, "listen", "l", "inet:127.0.0.1:7357",
+		`Milter socket, unix:/path or inet:host:port`)
+	fs.DurationVar(&cfg.ConnTimeout, "conn-timeout", 15*time.Second,
+		`Connection timeout`)
+	fs.DurationVar(&cfg.CmdTimeout, "timeout", time.Minute,
+		`Command timeout`)
+	fs.StringVar(&cfg.Infected, "infected", "reject",
+		`Action taken on infected messages: reject, discard, quarantine, accept or tempfail`)
+	fs.BoolVar(&cfg.FailOpen, "fail-open", false,
+		`Accept messages that could not be scanned`)
+	fs.BoolVar(&cfg.NoHeaders, "no-headers", false,
+		`Do not add the X-Virus-Scanned and X-Virus-Status headers`)
+	fs.Int64Var(&cfg.MaxSize, "max-size", 25*1024*1024,
+		`Size of the largest message that is scanned, zero scans all messages`)
+	fs.Int64Var(&cfg.MaxMemory, "max-memory", clamdmilter.DefaultMaxMemory,
+		`Size of a message kept in memory, larger messages are kept in a temporary file`)
+	fs.BoolVar(&cfg.ShowVersion, "client-version", false,
+		`Print the clamd-milter version`)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [options]\n", name)
+		fmt.Fprint(stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	return
+}
+
+func clientVersion() (v string) {
+	v = Version
+	if VersionPrerelease != "" {
+		v = fmt.Sprintf("%s-%s", v, VersionPrerelease)
+	}
+	if GitCommit != "" {
+		v = fmt.Sprintf("%s (%s)", v, GitCommit)
+	}
+	return
+}
+
+func run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) (code int) {
+	var err error
+	var l net.Listener
+	var c *clamd.Client
+	var action clamdmilter.Action
+
+	cfg := &Config{}
+	fs := newFlagSet(name, cfg, stderr)
+	if err = fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitError
+	}
+
+	if cfg.ShowVersion {
+		fmt.Fprintf(stdout, "%s %s\n", name, clientVersion())
+		return exitOK
+	}
+
+	if action, err = clamdmilter.ParseAction(cfg.Infected); err != nil {
+		fmt.Fprintf(stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+
+	network, address := parseAddr(cfg.Address, cfg.Port)
+	if c, err = clamd.NewClient(network, address); err != nil {
+		fmt.Fprintf(stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+	c.SetConnTimeout(cfg.ConnTimeout)
+	c.SetCmdTimeout(cfg.CmdTimeout)
+
+	if l, err = net.Listen(parseListen(cfg.Listen)); err != nil {
+		fmt.Fprintf(stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+
+	srv := clamdmilter.NewServer(c, clamdmilter.Config{
+		Infected:  action,
+		FailOpen:  cfg.FailOpen,
+		NoHeaders: cfg.NoHeaders,
+		MaxSize:   cfg.MaxSize,
+		MaxMemory: cfg.MaxMemory,
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = srv.Close()
+	}
+
+	if err != nil && err != clamdmilter.ErrServerClosed {
+		fmt.Fprintf(stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+
+	return exitOK
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	code := run(ctx, path.Base(os.Args[0]), os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
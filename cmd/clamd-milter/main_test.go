@@ -0,0 +1,117 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdmilter"
+	"github.com/baruwa-enterprise/clamd/clamdmilter/miltertest"
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+	}{
+		{"unix:/run/milter.sock", "unix", "/run/milter.sock"},
+		{"/run/milter.sock", "unix", "/run/milter.sock"},
+		{"inet:127.0.0.1:7357", "tcp", "127.0.0.1:7357"},
+		{":7357", "tcp", ":7357"},
+	}
+
+	for _, tt := range tests {
+		if n, a := parseListen(tt.in); n != tt.network || a != tt.address {
+			t.Errorf("%q: expected %s %s got %s %s", tt.in, tt.network, tt.address, n, a)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var o, e bytes.Buffer
+
+	if code := run(context.Background(), "clamd-milter", []string{"--client-version"}, &o, &e); code != exitOK || !strings.HasPrefix(o.String(), "clamd-milter "+Version) {
+		t.Errorf("Unexpected version %d %q", code, o.String())
+	}
+
+	if code := run(context.Background(), "clamd-milter", []string{"--bogus"}, &o, &e); code != exitError {
+		t.Errorf("Expected %d got %d", exitError, code)
+	}
+
+	e.Reset()
+	if code := run(context.Background(), "clamd-milter", []string{"--infected", "bounce"}, &o, &e); code != exitError || !strings.Contains(e.String(), "ERROR") {
+		t.Errorf("Expected an action error got %d %q", code, e.String())
+	}
+
+	e.Reset()
+	if code := run(context.Background(), "clamd-milter", []string{"-H", "127.0.0.1", "-l", "inet:127.0.0.1:-1"}, &o, &e); code != exitError || !strings.Contains(e.String(), "ERROR") {
+		t.Errorf("Expected a listen error got %d %q", code, e.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "clamd-milter")
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "milter.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		done <- run(ctx, "clamd-milter", []string{"-H", s.Address, "-l", "unix:" + sock, "--infected", "discard"}, ioutil.Discard, ioutil.Discard)
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := miltertest.NewClient(conn)
+	if _, err = c.Negotiate(0, 0); err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+
+	eicar, err := ioutil.ReadFile("../../examples/eicar.txt")
+	if err != nil {
+		t.Fatalf("An error should not be returned: %s", err)
+	}
+	r, err := c.Send(&miltertest.Message{From: "a@example.com", Rcpt: []string{"b@example.com"}, Body: eicar})
+	if err != nil || r.Cmd != clamdmilter.RespDiscard {
+		t.Errorf("Expected the message to be discarded got %v %v", r, err)
+	}
+	c.Close()
+
+	cancel()
+	if code := <-done; code != exitOK {
+		t.Errorf("Expected %d got %d", exitOK, code)
+	}
+}
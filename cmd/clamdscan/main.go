@@ -9,6 +9,209 @@ Clamd - Golang clamd client
 */
 package main
 
-func main() {
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	exitClean    = 0
+	exitInfected = 1
+	exitError    = 2
+
+	defaultSock = "/var/run/clamav/clamd.sock"
+)
+
+// Config holds the configuration
+type Config struct {
+	Address     string
+	Port        int
+	ConnTimeout time.Duration
+	CmdTimeout  time.Duration
+	Command     string
+	MultiScan   bool
+	Stream      bool
+	FdPass      bool
+	FileList    string
+	Infected    bool
+	NoSummary   bool
+	Ping        bool
+	Version     bool
+	Stats       bool
+	Reload      bool
+	Shutdown    bool
+	ShowVersion bool
+}
+
+func parseAddr(a string, p int) (n string, h string) {
+	if strings.HasPrefix(a, "/") {
+		n = "unix"
+		h = a
+	} else {
+		n = "tcp"
+		if strings.Contains(a, ":") {
+			h = fmt.Sprintf("[%s]:%d", a, p)
+		} else {
+			h = fmt.Sprintf("%s:%d", a, p)
+		}
+	}
+	return
+}
+
+func newFlagSet(name string, cfg *Config, stderr io.Writer) (fs *flag.FlagSet) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SortFlags = false
+	fs.SetOutput(stderr)
+	fs.StringVarP(&cfg.Address, "host", "H", defaultSock,
+		`Specify Clamd host or unix socket to connect to.`)
+	fs.IntVarP(&cfg.Port, "port", "p", 3310,
+		`In TCP/IP mode, connect to clamd server listening on given port`)
+	fs.DurationVar(&cfg.ConnTimeout, "conn-timeout", 15*time.Second,
+		`Connection timeout`)
+	fs.DurationVar(&cfg.CmdTimeout, "timeout", time.Minute,
+		`Command timeout`)
+	fs.StringVarP(&cfg.Command, "command", "C", "CONTSCAN",
+		`Scan command to use: SCAN, CONTSCAN or MULTISCAN`)
+	fs.BoolVarP(&cfg.MultiScan, "multiscan", "m", false,
+		`Scan in parallel using MULTISCAN`)
+	fs.BoolVar(&cfg.Stream, "stream", false,
+		`Stream files to clamd using INSTREAM`)
+	fs.BoolVar(&cfg.FdPass, "fdpass", false,
+		`Pass file descriptors to clamd using FILDES`)
+	fs.StringVarP(&cfg.FileList, "file-list", "f", "",
+		`Scan files listed line by line in FILE, - reads the list from stdin`)
+	fs.BoolVarP(&cfg.Infected, "infected", "i", false,
+		`Only print infected files`)
+	fs.BoolVar(&cfg.NoSummary, "no-summary", false,
+		`Disable the summary at the end of scanning`)
+	fs.BoolVar(&cfg.Ping, "ping", false,
+		`Ping clamd`)
+	fs.BoolVarP(&cfg.Version, "version", "V", false,
+		`Print the clamd version`)
+	fs.BoolVar(&cfg.Stats, "stats", false,
+		`Print clamd statistics`)
+	fs.BoolVar(&cfg.Reload, "reload", false,
+		`Request clamd to reload the virus database`)
+	fs.BoolVar(&cfg.Shutdown, "shutdown", false,
+		`Request clamd to shutdown`)
+	fs.BoolVar(&cfg.ShowVersion, "client-version", false,
+		`Print the clamdscan version`)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [options] [file/directory/-]\n", name)
+		fmt.Fprint(stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	return
+}
+
+func clientVersion() (v string) {
+	v = Version
+	if VersionPrerelease != "" {
+		v = fmt.Sprintf("%s-%s", v, VersionPrerelease)
+	}
+	if GitCommit != "" {
+		v = fmt.Sprintf("%s (%s)", v, GitCommit)
+	}
+	return
+}
+
+// command runs one of the non scan commands
+func command(ctx context.Context, c *clamd.Client, cfg *Config, stdout io.Writer) (err error) {
+	var b bool
+	var s string
+
+	switch {
+	case cfg.Ping:
+		if b, err = c.Ping(ctx); err == nil && !b {
+			err = errors.New("clamd did not reply with PONG")
+		}
+		if err == nil {
+			fmt.Fprintln(stdout, "PONG")
+		}
+	case cfg.Version:
+		if s, err = c.Version(ctx); err == nil {
+			fmt.Fprintln(stdout, s)
+		}
+	case cfg.Stats:
+		if s, err = c.Stats(ctx); err == nil {
+			fmt.Fprintln(stdout, s)
+		}
+	case cfg.Reload:
+		if b, err = c.Reload(ctx); err == nil && !b {
+			err = errors.New("clamd did not reply with RELOADING")
+		}
+		if err == nil {
+			fmt.Fprintln(stdout, "RELOADING")
+		}
+	case cfg.Shutdown:
+		err = c.Shutdown(ctx)
+	}
 
+	return
+}
+
+func run(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) (code int) {
+	var err error
+	var c *clamd.Client
+
+	cfg := &Config{}
+	fs := newFlagSet(name, cfg, stderr)
+	if err = fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitClean
+		}
+		return exitError
+	}
+
+	if cfg.ShowVersion {
+		fmt.Fprintf(stdout, "%s %s\n", name, clientVersion())
+		return exitClean
+	}
+
+	if cfg.MultiScan {
+		cfg.Command = "MULTISCAN"
+	}
+	cfg.Command = strings.ToUpper(cfg.Command)
+
+	network, address := parseAddr(cfg.Address, cfg.Port)
+	if c, err = clamd.NewClient(network, address); err != nil {
+		fmt.Fprintf(stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+	c.SetConnTimeout(cfg.ConnTimeout)
+	c.SetCmdTimeout(cfg.CmdTimeout)
+
+	ctx := context.Background()
+	if cfg.Ping || cfg.Version || cfg.Stats || cfg.Reload || cfg.Shutdown {
+		if err = command(ctx, c, cfg, stdout); err != nil {
+			fmt.Fprintf(stderr, "ERROR: %s\n", err)
+			return exitError
+		}
+		return exitClean
+	}
+
+	s := &scanner{
+		c:      c,
+		cfg:    cfg,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	code = s.run(ctx, fs.Args())
+
+	return
+}
+
+func main() {
+	os.Exit(run(path.Base(os.Args[0]), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,106 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+const eicarFile = "../../examples/eicar.txt"
+
+func testDir(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	b, err := ioutil.ReadFile(eicarFile)
+	if err != nil {
+		t.Fatalf("Reading %s failed: %s", eicarFile, err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "eicar.txt"), b, 0644); err != nil {
+		t.Fatalf("Writing eicar.txt failed: %s", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "clean.txt"), []byte("clean"), 0644); err != nil {
+		t.Fatalf("Writing clean.txt failed: %s", err)
+	}
+	return
+}
+
+func runCmd(stdin string, args ...string) (code int, stdout, stderr string) {
+	var o, e bytes.Buffer
+	code = run("clamdscan", args, strings.NewReader(stdin), &o, &e)
+	stdout, stderr = o.String(), e.String()
+	return
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are required")
+	}
+
+	s := clamdtest.NewServer()
+	defer s.Close()
+
+	dir := testDir(t)
+	eicar := filepath.Join(dir, "eicar.txt")
+	clean := filepath.Join(dir, "clean.txt")
+	host := "--host=" + s.Address
+
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		code  int
+		out   []string
+	}{
+		{"ping", "", []string{host, "--ping"}, exitClean, []string{"PONG\n"}},
+		{"version", "", []string{host, "-V"}, exitClean, []string{clamdtest.DefaultVersion}},
+		{"stats", "", []string{host, "--stats"}, exitClean, []string{"POOLS: 1", "END"}},
+		{"reload", "", []string{host, "--reload"}, exitClean, []string{"RELOADING"}},
+		{"clean", "", []string{host, clean}, exitClean, []string{clean + ": OK\n", summaryHeader, "Infected files: 0\n"}},
+		{"infected", "", []string{host, dir}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n", "Infected files: 1\n"}},
+		{"multiscan", "", []string{host, "-m", dir}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n"}},
+		{"scan", "", []string{host, "-C", "scan", dir}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n"}},
+		{"stream", "", []string{host, "--stream", dir}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n", clean + ": OK\n"}},
+		{"fdpass", "", []string{host, "--fdpass", "-i", dir}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n"}},
+		{"stdin", "clean", []string{host, "--no-summary", "-"}, exitClean, []string{"stdin: OK\n"}},
+		{"file list", eicar + "\n\n" + clean + "\n", []string{host, "-f", "-"}, exitInfected, []string{eicar + ": Eicar-Signature FOUND\n", clean + ": OK\n"}},
+		{"missing", "", []string{host, filepath.Join(dir, "missing")}, exitError, []string{"lstat() failed", "Total errors: 1\n"}},
+		{"missing stream", "", []string{host, "--stream", filepath.Join(dir, "missing")}, exitError, []string{"Total errors: 1\n"}},
+		{"bad command", "", []string{host, "-C", "FOO", dir}, exitError, nil},
+		{"bad flag", "", []string{"--foo"}, exitError, nil},
+		{"no server", "", []string{"--host=" + filepath.Join(dir, "clamd.sock"), "--ping"}, exitError, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCmd(tt.stdin, tt.args...)
+			if code != tt.code {
+				t.Errorf("Expected exit code %d got %d: %s%s", tt.code, code, stdout, stderr)
+			}
+			for _, o := range tt.out {
+				if !strings.Contains(stdout, o) {
+					t.Errorf("Expected %q in %q", o, stdout)
+				}
+			}
+		})
+	}
+
+	if _, stdout, _ := runCmd("", host, "--fdpass", "-i", dir); strings.Contains(stdout, ": OK") {
+		t.Errorf("Expected only infected files to be printed got %q", stdout)
+	}
+	if code, _, _ := runCmd("", host, "--shutdown"); code != exitClean {
+		t.Errorf("Expected exit code %d got %d", exitClean, code)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd"
+)
+
+const (
+	stdinTarget   = "-"
+	summaryHeader = "----------- SCAN SUMMARY -----------"
+	dateFmt       = "2006:01:02 15:04:05"
+	unknownCmdErr = "Unknown scan command: %s"
+)
+
+// scanner scans targets and keeps the counts
+// reported in the summary
+type scanner struct {
+	c        *clamd.Client
+	cfg      *Config
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	infected int
+	errors   int
+}
+
+func (s *scanner) run(ctx context.Context, args []string) (code int) {
+	var err error
+	var targets []string
+
+	start := time.Now()
+
+	if s.cfg.Command != "SCAN" && s.cfg.Command != "CONTSCAN" && s.cfg.Command != "MULTISCAN" {
+		fmt.Fprintf(s.stderr, "ERROR: "+unknownCmdErr+"\n", s.cfg.Command)
+		return exitError
+	}
+
+	if s.cfg.FdPass && s.cfg.Stream {
+		fmt.Fprintln(s.stderr, "ERROR: --stream and --fdpass can not be used together")
+		return exitError
+	}
+
+	if targets, err = s.targets(args); err != nil {
+		fmt.Fprintf(s.stderr, "ERROR: %s\n", err)
+		return exitError
+	}
+
+	for _, t := range targets {
+		if err = s.scan(ctx, t); err != nil {
+			fmt.Fprintf(s.stderr, "ERROR: %s\n", err)
+			s.errors++
+			break
+		}
+	}
+
+	if !s.cfg.NoSummary {
+		s.summary(start, time.Now())
+	}
+
+	switch {
+	case s.infected > 0:
+		code = exitInfected
+	case s.errors > 0:
+		code = exitError
+	default:
+		code = exitClean
+	}
+
+	return
+}
+
+// targets returns the paths to scan from args and the file
+// list, the current directory is scanned when there are none
+func (s *scanner) targets(args []string) (t []string, err error) {
+	var f *os.File
+	var r io.Reader
+
+	t = append(t, args...)
+
+	if s.cfg.FileList != "" {
+		if s.cfg.FileList == stdinTarget {
+			r = s.stdin
+		} else {
+			if f, err = os.Open(s.cfg.FileList); err != nil {
+				return
+			}
+			defer f.Close()
+			r = f
+		}
+
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			if l := strings.TrimSpace(sc.Text()); l != "" {
+				t = append(t, l)
+			}
+		}
+		if err = sc.Err(); err != nil {
+			return
+		}
+	}
+
+	if len(t) == 0 {
+		var wd string
+		if wd, err = os.Getwd(); err != nil {
+			return
+		}
+		t = append(t, wd)
+	}
+
+	return
+}
+
+// scan scans a target, per file errors are reported and counted,
+// the error returned is one that prevents further scanning
+func (s *scanner) scan(ctx context.Context, t string) (err error) {
+	var p string
+	var r []*clamd.Response
+
+	if t == stdinTarget {
+		r, err = s.c.ScanReader(ctx, s.stdin)
+		return s.report("stdin", r, err)
+	}
+
+	if p, err = filepath.Abs(t); err != nil {
+		return
+	}
+
+	if s.cfg.Stream || s.cfg.FdPass {
+		return s.scanFiles(ctx, p)
+	}
+
+	switch s.cfg.Command {
+	case "SCAN":
+		r, err = s.c.Scan(ctx, p)
+	case "MULTISCAN":
+		r, err = s.c.MultiScan(ctx, p)
+	default:
+		r, err = s.c.ContScan(ctx, p)
+	}
+
+	return s.report("", r, err)
+}
+
+// scanFiles walks p sending each regular file with
+// INSTREAM or FILDES, clamd can not see the files
+func (s *scanner) scanFiles(ctx context.Context, p string) (err error) {
+	return filepath.Walk(p, func(fp string, fi os.FileInfo, werr error) (err error) {
+		var r []*clamd.Response
+
+		if werr != nil {
+			s.fileError(fp, werr)
+			return
+		}
+
+		if !fi.Mode().IsRegular() {
+			return
+		}
+
+		if s.cfg.FdPass {
+			r, err = s.c.Fildes(ctx, fp)
+		} else {
+			r, err = s.c.InStream(ctx, fp)
+		}
+
+		err = s.report(fp, r, err)
+
+		return
+	})
+}
+
+// report prints the results, when name is set it replaces the
+// stream or descriptor name in the server responses
+func (s *scanner) report(name string, r []*clamd.Response, err error) error {
+	var se *clamd.ServerError
+	var pe *os.PathError
+
+	switch {
+	case err == nil:
+	case errors.As(err, &se):
+		if name != "" && !strings.HasPrefix(se.Msg, name+":") {
+			fmt.Fprintf(s.stdout, "%s: %s ERROR\n", name, se.Msg)
+		} else {
+			fmt.Fprintf(s.stdout, "%s ERROR\n", se.Msg)
+		}
+		s.errors++
+		return nil
+	case errors.As(err, &pe):
+		s.fileError(pe.Path, pe.Err)
+		return nil
+	default:
+		return err
+	}
+
+	for _, rs := range r {
+		fn := rs.Filename
+		if name != "" {
+			fn = name
+		}
+
+		switch rs.Status {
+		case clamd.StatusFound:
+			s.infected++
+			fmt.Fprintf(s.stdout, "%s: %s FOUND\n", fn, rs.Signature)
+		case clamd.StatusError:
+			s.errors++
+			fmt.Fprintf(s.stdout, "%s: %s ERROR\n", fn, rs.Error)
+		default:
+			if !s.cfg.Infected {
+				fmt.Fprintf(s.stdout, "%s: OK\n", fn)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *scanner) fileError(p string, err error) {
+	var pe *os.PathError
+
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+
+	s.errors++
+	fmt.Fprintf(s.stdout, "%s: %s. ERROR\n", p, err)
+}
+
+func (s *scanner) summary(start, end time.Time) {
+	d := end.Sub(start)
+
+	fmt.Fprintf(s.stdout, "\n%s\n", summaryHeader)
+	fmt.Fprintf(s.stdout, "Infected files: %d\n", s.infected)
+	if s.errors > 0 {
+		fmt.Fprintf(s.stdout, "Total errors: %d\n", s.errors)
+	}
+	fmt.Fprintf(s.stdout, "Time: %.3f sec (%d m %d s)\n", d.Seconds(), int(d.Minutes()), int(d.Seconds())%60)
+	fmt.Fprintf(s.stdout, "Start Date: %s\n", start.Format(dateFmt))
+	fmt.Fprintf(s.stdout, "End Date:   %s\n", end.Format(dateFmt))
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/internal/spool"
+	"github.com/baruwa-enterprise/clamd/protocol"
+)
+
+// A DedupScanner is a Scanner that coalesces identical scans
+// that are in flight at the same time into one command, the
+// result is returned to every caller. Path scans are keyed
+// by command and path and ScanReader by a SHA-256 of the
+// content. The shared command is canceled when every
+// caller waiting for it has been canceled, its deadline is
+// the latest deadline of the callers and it has none when
+// a caller has none
+type DedupScanner struct {
+	Scanner
+	maxMemory int64
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a command shared by its waiters
+type flight struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	deadline time.Time
+	r        []*Response
+	err      error
+}
+
+// flightContext is the context of a flight, its deadline
+// follows the waiters that join the flight
+type flightContext struct {
+	context.Context
+	d *DedupScanner
+	f *flight
+}
+
+// Deadline returns the latest deadline of the waiters
+func (c *flightContext) Deadline() (dl time.Time, ok bool) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	dl = c.f.deadline
+	ok = !dl.IsZero()
+
+	return
+}
+
+// NewDedupScanner returns a DedupScanner that scans with s
+func NewDedupScanner(s Scanner) *DedupScanner {
+	return &DedupScanner{
+		Scanner:   s,
+		maxMemory: defaultCacheMaxMemory,
+		flights:   make(map[string]*flight),
+	}
+}
+
+// SetMaxMemory sets the size of a stream kept in memory
+// while it is hashed, larger streams are kept in a
+// temporary file
+func (d *DedupScanner) SetMaxMemory(n int64) {
+	if n > 0 {
+		d.maxMemory = n
+	}
+}
+
+// InFlight returns the number of commands in flight
+func (d *DedupScanner) InFlight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.flights)
+}
+
+// Scan coalesces SCAN commands of the same path
+func (d *DedupScanner) Scan(ctx context.Context, p string) ([]*Response, error) {
+	return d.path(ctx, protocol.Scan, p, d.Scanner.Scan)
+}
+
+// ContScan coalesces CONTSCAN commands of the same path
+func (d *DedupScanner) ContScan(ctx context.Context, p string) ([]*Response, error) {
+	return d.path(ctx, protocol.ContScan, p, d.Scanner.ContScan)
+}
+
+// MultiScan coalesces MULTISCAN commands of the same path
+func (d *DedupScanner) MultiScan(ctx context.Context, p string) ([]*Response, error) {
+	return d.path(ctx, protocol.MultiScan, p, d.Scanner.MultiScan)
+}
+
+// InStream coalesces INSTREAM scans of the same path
+func (d *DedupScanner) InStream(ctx context.Context, p string) ([]*Response, error) {
+	return d.path(ctx, protocol.Instream, p, d.Scanner.InStream)
+}
+
+// Fildes coalesces FILDES scans of the same path
+func (d *DedupScanner) Fildes(ctx context.Context, p string) ([]*Response, error) {
+	return d.path(ctx, protocol.Fildes, p, d.Scanner.Fildes)
+}
+
+// ScanReader coalesces scans of the same content, i is read
+// to the end before the scan is sent
+func (d *DedupScanner) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
+	sp := spool.New(d.maxMemory)
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(h, sp), i); err != nil {
+		sp.Close()
+		return
+	}
+
+	if err = sp.Rewind(); err != nil {
+		sp.Close()
+		return
+	}
+
+	// The spool is owned by the flight, it outlives the
+	// caller when the caller is canceled
+	key := protocol.Instream.String() + ":" + hex.EncodeToString(h.Sum(nil))
+	r, err = d.do(ctx, key, func(fctx context.Context) ([]*Response, error) {
+		return d.Scanner.ScanReader(fctx, sp)
+	}, func() {
+		sp.Close()
+	})
+
+	return
+}
+
+// ScanAndStore scans i with ScanReader and persists it to s
+func (d *DedupScanner) ScanAndStore(ctx context.Context, i io.Reader, s Sink) (r []*Response, err error) {
+	r, err = scanAndStore(ctx, d.ScanReader, i, s)
+	return
+}
+
+func (d *DedupScanner) path(ctx context.Context, cmd protocol.Command, p string, scan func(context.Context, string) ([]*Response, error)) ([]*Response, error) {
+	return d.do(ctx, cmd.String()+":"+p, func(fctx context.Context) ([]*Response, error) {
+		return scan(fctx, p)
+	}, nil)
+}
+
+// do runs fn once for the callers of key that overlap,
+// release is called when the caller no longer needs
+// the resources of fn
+func (d *DedupScanner) do(ctx context.Context, key string, fn func(context.Context) ([]*Response, error), release func()) (r []*Response, err error) {
+	d.mu.Lock()
+	f, ok := d.flights[key]
+	if ok {
+		f.waiters++
+		if dl, bounded := ctx.Deadline(); !bounded {
+			f.deadline = time.Time{}
+		} else if !f.deadline.IsZero() && dl.After(f.deadline) {
+			f.deadline = dl
+		}
+		d.mu.Unlock()
+		if release != nil {
+			release()
+		}
+	} else {
+		var fctx context.Context
+
+		f = &flight{
+			done:    make(chan struct{}),
+			waiters: 1,
+		}
+		f.deadline, _ = ctx.Deadline()
+		fctx, f.cancel = context.WithCancel(context.Background())
+		fctx = &flightContext{Context: fctx, d: d, f: f}
+		d.flights[key] = f
+		d.mu.Unlock()
+
+		go func() {
+			f.r, f.err = fn(fctx)
+			if release != nil {
+				release()
+			}
+			d.remove(key, f)
+			f.cancel()
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-f.done:
+		r, err = copyResponses(f.r), f.err
+	case <-ctx.Done():
+		d.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			if d.flights[key] == f {
+				delete(d.flights, key)
+			}
+		}
+		d.mu.Unlock()
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (d *DedupScanner) remove(key string, f *flight) {
+	d.mu.Lock()
+	if d.flights[key] == f {
+		delete(d.flights, key)
+	}
+	d.mu.Unlock()
+}
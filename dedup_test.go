@@ -0,0 +1,295 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+// gateScanner holds scans until release is closed
+type gateScanner struct {
+	Scanner
+	calls    int32
+	canceled int32
+	release  chan struct{}
+	ctxs     chan context.Context
+}
+
+func (g *gateScanner) wait(ctx context.Context, r []*Response) ([]*Response, error) {
+	atomic.AddInt32(&g.calls, 1)
+	if g.ctxs != nil {
+		g.ctxs <- ctx
+	}
+	select {
+	case <-g.release:
+		return r, nil
+	case <-ctx.Done():
+		atomic.AddInt32(&g.canceled, 1)
+		return nil, ctx.Err()
+	}
+}
+
+func (g *gateScanner) ScanReader(ctx context.Context, i io.Reader) ([]*Response, error) {
+	b, err := ioutil.ReadAll(i)
+	if err != nil {
+		return nil, err
+	}
+	return g.wait(ctx, []*Response{{Filename: "stream", Status: "OK", Raw: string(b)}})
+}
+
+func (g *gateScanner) Scan(ctx context.Context, p string) ([]*Response, error) {
+	return g.wait(ctx, []*Response{{Filename: p, Status: "OK"}})
+}
+
+func (g *gateScanner) ContScan(ctx context.Context, p string) ([]*Response, error) {
+	return g.wait(ctx, []*Response{{Filename: p, Status: "OK"}})
+}
+
+// waitFor polls until f returns true
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting")
+}
+
+func (d *DedupScanner) waiters() (n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, f := range d.flights {
+		n += f.waiters
+	}
+
+	return
+}
+
+func TestDedupScanner(t *testing.T) {
+	g := &gateScanner{release: make(chan struct{})}
+	d := NewDedupScanner(g)
+	d.SetMaxMemory(4)
+
+	var wg sync.WaitGroup
+	results := make(chan []*Response, 20)
+	scan := func(content string) {
+		defer wg.Done()
+		r, err := d.ScanReader(context.Background(), &plainReader{strings.NewReader(content)})
+		if err != nil {
+			t.Errorf("An error should not be returned: %s", err)
+		}
+		results <- r
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go scan("same content")
+	}
+	wg.Add(1)
+	go scan("other content")
+	waitFor(t, func() bool { return d.waiters() == 11 })
+
+	if n := d.InFlight(); n != 2 {
+		t.Errorf("Expected 2 commands in flight got %d", n)
+	}
+
+	close(g.release)
+	wg.Wait()
+	close(results)
+
+	seen := make(map[*Response]bool)
+	for r := range results {
+		if len(r) != 1 || (r[0].Raw != "same content" && r[0].Raw != "other content") {
+			t.Errorf("Unexpected result %v", r)
+			continue
+		}
+		// Every caller gets its own responses
+		if seen[r[0]] {
+			t.Errorf("Responses should not be shared")
+		}
+		seen[r[0]] = true
+	}
+	if n := atomic.LoadInt32(&g.calls); n != 2 {
+		t.Errorf("Expected 2 scans got %d", n)
+	}
+	if n := d.InFlight(); n != 0 {
+		t.Errorf("Expected no command in flight got %d", n)
+	}
+
+	// Scans that do not overlap are not coalesced
+	d.ScanReader(context.Background(), strings.NewReader("same content"))
+	if n := atomic.LoadInt32(&g.calls); n != 3 {
+		t.Errorf("Expected 3 scans got %d", n)
+	}
+}
+
+func TestDedupScannerCancel(t *testing.T) {
+	g := &gateScanner{release: make(chan struct{})}
+	d := NewDedupScanner(g)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 2)
+	go func() {
+		_, err := d.Scan(ctx, "/tmp/file")
+		errc <- err
+	}()
+	waitFor(t, func() bool { return d.waiters() == 1 })
+
+	var r []*Response
+	done := make(chan error)
+	go func() {
+		var err error
+		r, err = d.Scan(context.Background(), "/tmp/file")
+		done <- err
+	}()
+	waitFor(t, func() bool { return d.waiters() == 2 })
+
+	// The first caller leaves, the scan goes on
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+	if atomic.LoadInt32(&g.canceled) != 0 {
+		t.Errorf("The scan should not be canceled")
+	}
+
+	close(g.release)
+	if err := <-done; err != nil || len(r) != 1 || r[0].Filename != "/tmp/file" {
+		t.Errorf("Unexpected result %v %v", r, err)
+	}
+
+	// The scan is canceled when every caller has left
+	g.release = make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	for _, c := range []context.Context{ctx1, ctx2} {
+		go func(c context.Context) {
+			_, err := d.ContScan(c, "/tmp/file")
+			errc <- err
+		}(c)
+	}
+	waitFor(t, func() bool { return d.waiters() == 2 })
+	if n := d.InFlight(); n != 1 {
+		t.Errorf("Expected 1 command in flight got %d", n)
+	}
+
+	cancel1()
+	cancel2()
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("Expected %v got %v", context.Canceled, err)
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&g.canceled) == 1 })
+	if n := d.InFlight(); n != 0 {
+		t.Errorf("Expected no command in flight got %d", n)
+	}
+}
+
+func TestDedupScannerDeadline(t *testing.T) {
+	g := &gateScanner{release: make(chan struct{}), ctxs: make(chan context.Context, 1)}
+	d := NewDedupScanner(g)
+
+	deadline := func(ctx context.Context) (dl time.Time) {
+		dl, _ = ctx.Deadline()
+		return
+	}
+
+	scan := func(ctx context.Context) {
+		d.Scan(ctx, "/tmp/file")
+	}
+
+	now := time.Now()
+	ctx1, cancel1 := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancel1()
+	go scan(ctx1)
+	fctx := <-g.ctxs
+	if dl := deadline(fctx); !dl.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the deadline of the caller got %v", dl)
+	}
+
+	// The latest deadline of the callers is used
+	ctx2, cancel2 := context.WithDeadline(context.Background(), now.Add(time.Hour))
+	defer cancel2()
+	go scan(ctx2)
+	waitFor(t, func() bool { return d.waiters() == 2 })
+	if dl := deadline(fctx); !dl.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the latest deadline got %v", dl)
+	}
+
+	ctx3, cancel3 := context.WithDeadline(context.Background(), now.Add(time.Second))
+	defer cancel3()
+	go scan(ctx3)
+	waitFor(t, func() bool { return d.waiters() == 3 })
+	if dl := deadline(fctx); !dl.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the latest deadline got %v", dl)
+	}
+
+	// A caller without a deadline removes it
+	go scan(context.Background())
+	waitFor(t, func() bool { return d.waiters() == 4 })
+	if _, ok := fctx.Deadline(); ok {
+		t.Errorf("Expected no deadline")
+	}
+
+	close(g.release)
+	waitFor(t, func() bool { return d.InFlight() == 0 })
+}
+
+func TestDedupScannerServer(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	eicar, e := ioutil.ReadFile("examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	d := NewDedupScanner(c)
+	ctx := context.Background()
+
+	r, e := d.ScanReader(ctx, bytes.NewReader(eicar))
+	if e != nil || len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+		t.Errorf("Unexpected result %v %v", r, e)
+	}
+
+	var buf bytes.Buffer
+	if r, e = d.ScanAndStore(ctx, strings.NewReader("clean"), NewWriterSink(&buf, nil, nil)); e != nil || len(r) != 1 || r[0].Status != "OK" || buf.String() != "clean" {
+		t.Errorf("Unexpected result %v %v %q", r, e, buf.String())
+	}
+
+	if r, e = d.InStream(ctx, "examples/eicar.txt"); e != nil || len(r) != 1 || r[0].Status != "FOUND" {
+		t.Errorf("Unexpected result %v %v", r, e)
+	}
+
+	// Errors are returned to every caller
+	srv.Close()
+	if _, e = d.ScanReader(ctx, strings.NewReader("clean")); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A DiskCache is a Cache that stores each entry as a JSON
+// file in a directory, it can be shared by processes
+type DiskCache struct {
+	dir    string
+	maxAge time.Duration
+}
+
+// NewDiskCache returns a DiskCache that stores entries in
+// dir, the directory is created when it does not exist
+func NewDiskCache(dir string) (c *DiskCache, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	c = &DiskCache{dir: dir}
+
+	return
+}
+
+// SetMaxAge sets the age after which entries are expired,
+// zero means entries do not expire
+func (c *DiskCache) SetMaxAge(d time.Duration) {
+	c.maxAge = d
+}
+
+// Get returns the entry of key, entries that can not
+// be read are treated as missing
+func (c *DiskCache) Get(key string) (e *CacheEntry, ok bool) {
+	var b []byte
+	var fi os.FileInfo
+	var err error
+
+	p, valid := c.path(key)
+	if !valid {
+		return
+	}
+
+	if fi, err = os.Stat(p); err != nil {
+		return
+	}
+
+	if c.maxAge > 0 && time.Since(fi.ModTime()) > c.maxAge {
+		os.Remove(p)
+		return
+	}
+
+	if b, err = ioutil.ReadFile(p); err != nil {
+		return
+	}
+
+	e = &CacheEntry{}
+	if err = json.Unmarshal(b, e); err != nil {
+		e = nil
+		return
+	}
+
+	ok = true
+
+	return
+}
+
+// Set stores the entry of key, the file is replaced
+// atomically so readers never see a partial entry
+func (c *DiskCache) Set(key string, e *CacheEntry) {
+	var b []byte
+	var f *os.File
+	var err error
+
+	p, valid := c.path(key)
+	if !valid {
+		return
+	}
+
+	if b, err = json.Marshal(e); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return
+	}
+
+	if f, err = ioutil.TempFile(filepath.Dir(p), "."+key+".*"); err != nil {
+		return
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// Delete removes the entry of key
+func (c *DiskCache) Delete(key string) {
+	if p, valid := c.path(key); valid {
+		os.Remove(p)
+	}
+}
+
+// path returns the file of key, keys are hex digests and
+// are spread over sub directories named by their first
+// two characters
+func (c *DiskCache) path(key string) (p string, ok bool) {
+	if len(key) < 2 {
+		return
+	}
+
+	if _, err := hex.DecodeString(key); err != nil {
+		return
+	}
+
+	p = filepath.Join(c.dir, key[:2], key+".json")
+	ok = true
+
+	return
+}
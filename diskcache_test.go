@@ -0,0 +1,111 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+const testKey = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestDiskCache(t *testing.T) {
+	dir, e := ioutil.TempDir("", "clamd-cache")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer os.RemoveAll(dir)
+
+	c, e := NewDiskCache(filepath.Join(dir, "cache"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	if _, ok := c.Get(testKey); ok {
+		t.Errorf("Expected a miss")
+	}
+
+	c.Set(testKey, &CacheEntry{
+		Responses:       []*Response{{Filename: "stream", Status: "OK", Raw: "stream: OK"}},
+		DatabaseVersion: 26850,
+	})
+	if _, e = os.Stat(filepath.Join(dir, "cache", "9f", testKey+".json")); e != nil {
+		t.Errorf("Expected the entry file: %s", e)
+	}
+
+	entry, ok := c.Get(testKey)
+	if !ok || entry.DatabaseVersion != 26850 || len(entry.Responses) != 1 || entry.Responses[0].Raw != "stream: OK" {
+		t.Errorf("Unexpected entry %v %v", entry, ok)
+	}
+
+	// Keys that are not hex digests are ignored
+	c.Set("../x", &CacheEntry{})
+	if _, ok = c.Get("../x"); ok {
+		t.Errorf("Expected a miss")
+	}
+
+	// Corrupt entries are misses
+	ioutil.WriteFile(filepath.Join(dir, "cache", "9f", testKey+".json"), []byte("{"), 0600)
+	if _, ok = c.Get(testKey); ok {
+		t.Errorf("Expected a miss")
+	}
+
+	c.Delete(testKey)
+	if _, e = os.Stat(filepath.Join(dir, "cache", "9f", testKey+".json")); !os.IsNotExist(e) {
+		t.Errorf("Expected the entry to be deleted")
+	}
+
+	c.SetMaxAge(time.Nanosecond)
+	c.Set(testKey, &CacheEntry{})
+	time.Sleep(time.Millisecond)
+	if _, ok = c.Get(testKey); ok {
+		t.Errorf("Expected the entry to expire")
+	}
+}
+
+func TestDiskCacheShared(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	dir, e := ioutil.TempDir("", "clamd-cache")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer os.RemoveAll(dir)
+
+	// Verdicts outlive the scanner that stored them
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(srv.Network, srv.Address)
+		if err != nil {
+			t.Fatalf("An error should not be returned: %s", err)
+		}
+
+		dc, err := NewDiskCache(dir)
+		if err != nil {
+			t.Fatalf("An error should not be returned: %s", err)
+		}
+
+		cs := NewCachedScanner(c, CacheConfig{Cache: dc})
+		if rs, err := cs.ScanReader(context.Background(), strings.NewReader("content")); err != nil || len(rs) != 1 || rs[0].Status != "OK" {
+			t.Errorf("Unexpected result %v %v", rs, err)
+		}
+	}
+
+	if n := srv.Commands("INSTREAM"); n != 1 {
+		t.Errorf("Expected 1 scan got %d", n)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	errorResp           = "ERROR"
+	sizeLimitResp       = "INSTREAM size limit exceeded"
+	cmdReadTimedOutResp = "COMMAND READ TIMED OUT"
+	unknownCmdResp      = "UNKNOWN COMMAND"
+)
+
+var (
+	// ErrSizeLimitExceeded is returned when a stream exceeds
+	// the StreamMaxLength configured on the server
+	ErrSizeLimitExceeded = errors.New(sizeLimitResp)
+	// ErrCommandReadTimedOut is returned when the server timed
+	// out waiting for a command or stream data
+	ErrCommandReadTimedOut = errors.New(cmdReadTimedOutResp)
+	// ErrUnknownCommand is returned when the server does
+	// not recognize a command
+	ErrUnknownCommand = errors.New(unknownCmdResp)
+	// ErrInvalidResponse is returned when the server
+	// response can not be parsed
+	ErrInvalidResponse = errors.New("Invalid server response")
+	// ErrUnsupportedNetwork is returned by NewClient for
+	// networks other than unix and tcp
+	ErrUnsupportedNetwork = errors.New("Protocol is not supported")
+	// ErrSocketNotFound is returned by NewClient when
+	// the unix socket does not exist
+	ErrSocketNotFound = errors.New("The unix socket does not exist")
+	// ErrFildesUnsupported is returned when FILDES is
+	// called on a connection that can not pass descriptors
+	ErrFildesUnsupported = errors.New(fldesErr)
+	// ErrSessionClosed is returned when a command is sent
+	// on a session that has ended
+	ErrSessionClosed = errors.New(sessionClosedErr)
+	// ErrAllMatchSession is returned by IDSession when
+	// SetAllMatch is set, the end of a reply that reports
+	// a file several times can not be found in a session
+	ErrAllMatchSession = errors.New(allMatchSessionErr)
+	// ErrPoolClosed is returned when the client
+	// connection pool has been closed
+	ErrPoolClosed = errors.New(poolClosedErr)
+	// ErrNoEndpoints is returned when a cluster has
+	// no endpoint left to send a command to
+	ErrNoEndpoints = errors.New(noEndpointsErr)
+	// ErrStreamClosed is returned when writing
+	// to a StreamWriter that has been closed
+	ErrStreamClosed = errors.New(streamClosedErr)
+)
+
+// ServerError is an error reply from the server, it matches
+// ErrSizeLimitExceeded, ErrCommandReadTimedOut and
+// ErrUnknownCommand with errors.Is when applicable
+type ServerError struct {
+	Msg string
+	Err error
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns the classified error if any
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// DialError is returned when a connection to the server
+// can not be established
+type DialError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the dial timed out
+func (e *DialError) Timeout() (b bool) {
+	var ne net.Error
+	if errors.As(e.Err, &ne) {
+		b = ne.Timeout()
+	}
+	return
+}
+
+// IsRetryable reports whether the command that returned err
+// may succeed if it is sent again, possibly on another server
+func IsRetryable(err error) (b bool) {
+	var de *DialError
+	var ne net.Error
+
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+	case errors.As(err, &de):
+		b = true
+	case errors.Is(err, ErrCommandReadTimedOut), errors.Is(err, ErrSessionClosed):
+		b = true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		b = true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		b = true
+	case errors.As(err, &ne):
+		b = ne.Timeout()
+	}
+
+	return
+}
+
+// clamdError keeps the message format used by this package
+// while allowing the error to be matched with errors.Is,
+// cause is the error that led to it if any
+type clamdError struct {
+	msg   string
+	err   error
+	cause error
+}
+
+func (e *clamdError) Error() string {
+	return e.msg
+}
+
+func (e *clamdError) Unwrap() error {
+	return e.err
+}
+
+// Is matches the cause of the error
+func (e *clamdError) Is(target error) bool {
+	return e.cause != nil && errors.Is(e.cause, target)
+}
+
+func errorf(err error, format string, a ...interface{}) error {
+	return &clamdError{
+		msg: fmt.Sprintf(format, a...),
+		err: err,
+	}
+}
+
+// emptyReply returns the error for a command that got
+// no reply, it is an ErrInvalidResponse that also matches
+// cause, the error of a connection closed without a reply
+func emptyReply(msg string, cause error) error {
+	return &clamdError{
+		msg:   msg,
+		err:   ErrInvalidResponse,
+		cause: cause,
+	}
+}
+
+func newServerError(s string) (err *ServerError) {
+	s = strings.TrimSpace(s)
+	err = &ServerError{
+		Msg: strings.TrimSpace(strings.TrimSuffix(s, errorResp)),
+	}
+
+	switch {
+	case strings.HasPrefix(s, sizeLimitResp):
+		err.Err = ErrSizeLimitExceeded
+	case strings.HasPrefix(s, cmdReadTimedOutResp):
+		err.Err = ErrCommandReadTimedOut
+	case strings.HasPrefix(s, unknownCmdResp):
+		err.Err = ErrUnknownCommand
+	}
+
+	return
+}
+
+func isServerError(s string) bool {
+	return strings.HasSuffix(s, errorResp) ||
+		strings.HasPrefix(s, cmdReadTimedOutResp) ||
+		strings.HasPrefix(s, unknownCmdResp) ||
+		strings.HasPrefix(s, sizeLimitResp)
+}
+
+// responseError returns the error for a reply line
+// that is not a valid response
+func responseError(s string) (err error) {
+	if isServerError(s) {
+		err = newServerError(s)
+		return
+	}
+
+	err = errorf(ErrInvalidResponse, invalidRespErr, s)
+
+	return
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+type responseErrorTestKey struct {
+	in     string
+	msg    string
+	server bool
+	is     error
+}
+
+var TestResponseErrors = []responseErrorTestKey{
+	{"INSTREAM size limit exceeded. ERROR", "INSTREAM size limit exceeded.", true, ErrSizeLimitExceeded},
+	{"COMMAND READ TIMED OUT", "COMMAND READ TIMED OUT", true, ErrCommandReadTimedOut},
+	{"UNKNOWN COMMAND", "UNKNOWN COMMAND", true, ErrUnknownCommand},
+	{"/tmp/x: lstat() failed: No such file or directory. ERROR", "/tmp/x: lstat() failed: No such file or directory.", true, nil},
+	{"garbage", fmt.Sprintf(invalidRespErr, "garbage"), false, ErrInvalidResponse},
+}
+
+type retryableTestKey struct {
+	in  error
+	out bool
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var TestRetryable = []retryableTestKey{
+	{nil, false},
+	{&DialError{Network: "tcp", Address: "127.0.0.1:3310", Err: syscall.ECONNREFUSED}, true},
+	{newServerError(cmdReadTimedOutResp), true},
+	{newServerError("INSTREAM size limit exceeded. ERROR"), false},
+	{newServerError(unknownCmdResp), false},
+	{newServerError("Access denied. ERROR"), false},
+	{ErrSessionClosed, true},
+	{io.EOF, true},
+	{io.ErrUnexpectedEOF, true},
+	{&net.OpError{Op: "write", Net: "tcp", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}, true},
+	{&net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, true},
+	{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, true},
+	{context.Canceled, false},
+	{context.DeadlineExceeded, false},
+	{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), false},
+	{errorf(ErrInvalidResponse, invalidRespErr, "x"), false},
+	{emptyReply(versionErr, io.ErrUnexpectedEOF), true},
+	{emptyReply(versionErr, nil), false},
+	{ErrPoolClosed, false},
+	{os.ErrNotExist, false},
+}
+
+func TestResponseError(t *testing.T) {
+	for _, tt := range TestResponseErrors {
+		e := responseError(tt.in)
+		if e.Error() != tt.msg {
+			t.Errorf("responseError(%q) = %q, want %q", tt.in, e, tt.msg)
+		}
+		var se *ServerError
+		if errors.As(e, &se) != tt.server {
+			t.Errorf("responseError(%q) should return a *ServerError: %t", tt.in, tt.server)
+		}
+		if tt.is != nil && !errors.Is(e, tt.is) {
+			t.Errorf("errors.Is(responseError(%q), %q) = false", tt.in, tt.is)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range TestRetryable {
+		if b := IsRetryable(tt.in); b != tt.out {
+			t.Errorf("IsRetryable(%v) = %t, want %t", tt.in, b, tt.out)
+		}
+	}
+}
+
+func TestEmptyReply(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+
+	for _, f := range []clamdtest.Fault{{Reset: true}, {Reply: "\n"}} {
+		srv.InjectFault("VERSION", f)
+		if _, e = c.Version(ctx); !errors.Is(e, ErrInvalidResponse) || e.Error() != versionErr {
+			t.Errorf("Expected %q got %v", versionErr, e)
+		}
+		srv.InjectFault("STATS", f)
+		if _, e = c.Stats(ctx); !errors.Is(e, ErrInvalidResponse) || e.Error() != statsErr {
+			t.Errorf("Expected %q got %v", statsErr, e)
+		}
+		if IsRetryable(e) != f.Reset {
+			t.Errorf("Expected a closed connection only to be retryable got %v", e)
+		}
+	}
+}
+
+func TestDialError(t *testing.T) {
+	var e error
+	var c *Client
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Listen failed: %s", e)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	if c, e = NewClient("tcp", address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetConnRetries(2)
+	c.SetConnSleep(10 * time.Millisecond)
+
+	start := time.Now()
+	_, e = c.Ping(context.Background())
+	var de *DialError
+	if !errors.As(e, &de) {
+		t.Fatalf("Expected *DialError got %v", e)
+	}
+	if de.Network != "tcp" || de.Address != address || de.Timeout() {
+		t.Errorf("Got %+v", de)
+	}
+	if !errors.Is(e, syscall.ECONNREFUSED) || !IsRetryable(e) {
+		t.Errorf("Expected a retryable connection refused error got %v", e)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Expected the dial to be retried, took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if _, e = c.Ping(ctx); !errors.Is(e, context.Canceled) || IsRetryable(e) {
+		t.Errorf("Expected a non retryable context error got %v", e)
+	}
+	if d := time.Since(start); d >= 10*time.Millisecond {
+		t.Errorf("Expected the dial not to be retried, took %s", d)
+	}
+}
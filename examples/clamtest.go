@@ -129,7 +129,7 @@ func versionCmds(n, a string, w *sync.WaitGroup) {
 	}
 	c.SetConnTimeout(5 * time.Second)
 	ctx := context.Background()
-	s, e := c.VersionCmds(ctx)
+	s, _, e := c.VersionCmds(ctx)
 	if e != nil {
 		log.Println(e)
 		return
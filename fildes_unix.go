@@ -12,21 +12,22 @@ Clamd - Golang clamd client
 package clamd
 
 import (
-	"fmt"
+	"bufio"
 	"net"
-	"net/textproto"
 	"os"
 	"syscall"
 
 	"github.com/baruwa-enterprise/clamd/protocol"
 )
 
-func (c *Client) fildesScan(tc *textproto.Conn, conn net.Conn, p string) (err error) {
+func (c *Client) fildesScan(w *bufio.Writer, conn net.Conn, p string) (err error) {
 	var f *os.File
 	var vf *os.File
 
-	fmt.Fprintf(tc.W, "n%s\n", protocol.Fildes)
-	tc.W.Flush()
+	c.writeCmd(w, protocol.Fildes)
+	if err = w.Flush(); err != nil {
+		return
+	}
 
 	if f, err = os.Open(p); err != nil {
 		return
@@ -10,13 +10,12 @@ Clamd - Golang clamd client
 package clamd
 
 import (
-	"errors"
+	"bufio"
 	"net"
-	"net/textproto"
 )
 
 const fildesUnsupportErr = "Fildes is not supported"
 
-func (c *Client) fildesScan(tc *textproto.Conn, conn net.Conn, p string) (err error) {
-	return errors.New(fildesUnsupportErr)
+func (c *Client) fildesScan(w *bufio.Writer, conn net.Conn, p string) (err error) {
+	return errorf(ErrFildesUnsupported, fildesUnsupportErr)
 }
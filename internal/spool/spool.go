@@ -0,0 +1,93 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package spool keeps a copy of a body while it is scanned so
+it can be passed on once the verdict is known.
+*/
+package spool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A Spool is kept in memory up to max bytes and
+// then moved to a temporary file
+type Spool struct {
+	max int64
+	buf bytes.Buffer
+	f   *os.File
+	r   io.Reader
+}
+
+// New returns a Spool that keeps up to max bytes in memory
+func New(max int64) *Spool {
+	return &Spool{max: max}
+}
+
+// Write appends p to the spool
+func (s *Spool) Write(p []byte) (n int, err error) {
+	if s.f == nil && int64(s.buf.Len()+len(p)) > s.max {
+		if s.f, err = ioutil.TempFile("", "clamd-spool"); err != nil {
+			return
+		}
+		if _, err = s.buf.WriteTo(s.f); err != nil {
+			return
+		}
+	}
+
+	if s.f != nil {
+		n, err = s.f.Write(p)
+		return
+	}
+
+	n, err = s.buf.Write(p)
+
+	return
+}
+
+// Rewind prepares the spool for reading
+func (s *Spool) Rewind() (err error) {
+	if s.f == nil {
+		s.r = &s.buf
+		return
+	}
+
+	if _, err = s.f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	s.r = s.f
+
+	return
+}
+
+// Read reads from the spool after Rewind
+func (s *Spool) Read(p []byte) (n int, err error) {
+	n, err = s.r.Read(p)
+	return
+}
+
+// Close removes the temporary file
+func (s *Spool) Close() (err error) {
+	if s.f == nil {
+		return
+	}
+
+	s.f.Close()
+	err = os.Remove(s.f.Name())
+	s.f = nil
+	s.r = eofReader{}
+
+	return
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package spool keeps a copy of a body while it is scanned so
+it can be passed on once the verdict is known.
+*/
+package spool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	for _, size := range []int{10, 100, 1000} {
+		data := bytes.Repeat([]byte("x"), size)
+
+		s := New(100)
+		s.Write(data[:size/2])
+		s.Write(data[size/2:])
+		if (s.f != nil) != (size > 100) {
+			t.Errorf("Size %d: expected a temporary file only above the limit", size)
+		}
+
+		if e := s.Rewind(); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		b, e := ioutil.ReadAll(s)
+		if e != nil || !bytes.Equal(b, data) {
+			t.Errorf("Size %d: got %d bytes, %v", size, len(b), e)
+		}
+
+		var name string
+		if s.f != nil {
+			name = s.f.Name()
+		}
+		if e = s.Close(); e != nil {
+			t.Errorf("An error should not be returned: %s", e)
+		}
+		if name != "" {
+			if _, e = os.Stat(name); !os.IsNotExist(e) {
+				t.Errorf("Expected the temporary file to be removed")
+			}
+		}
+	}
+}
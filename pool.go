@@ -0,0 +1,382 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/protocol"
+)
+
+const (
+	defaultMaxIdle = 2
+	poolClosedErr  = "The connection pool is closed"
+)
+
+// PoolConfig holds the connection pool settings
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle sessions kept,
+	// zero means the default of 2 and a negative value
+	// disables keeping idle sessions
+	MaxIdle int
+	// MaxOpen is the maximum number of open sessions,
+	// zero means there is no limit
+	MaxOpen int
+	// IdleTimeout is the maximum time a session may be idle
+	// before it is closed, zero means sessions are not closed
+	// due to their idle time
+	IdleTimeout time.Duration
+	// PingOnBorrow checks the health of an idle session with
+	// a PING before it is handed out
+	PingOnBorrow bool
+}
+
+// PoolStats holds the connection pool statistics
+type PoolStats struct {
+	MaxOpen           int
+	Open              int
+	InUse             int
+	Idle              int
+	WaitCount         int64
+	WaitDuration      time.Duration
+	MaxIdleClosed     int64
+	MaxIdleTimeClosed int64
+	HealthCheckFailed int64
+}
+
+type pool struct {
+	c       *Client
+	cfg     PoolConfig
+	mu      sync.Mutex
+	idle    []*idleSession
+	waiters []chan *Session
+	open    int
+	closed  bool
+	stats   PoolStats
+	stop    chan struct{}
+}
+
+type idleSession struct {
+	s *Session
+	t time.Time
+}
+
+// SetPool enables connection pooling, sessions started with
+// IDSESSION are reused for the PING, VERSION, STATS, SCAN,
+// INSTREAM and FILDES commands unless SetAllMatch is set.
+// It should be called before the client is used.
+func (c *Client) SetPool(cfg PoolConfig) {
+	if c.pool != nil {
+		c.pool.close()
+	}
+
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = defaultMaxIdle
+	} else if cfg.MaxIdle < 0 {
+		cfg.MaxIdle = 0
+	}
+
+	if cfg.MaxOpen < 0 {
+		cfg.MaxOpen = 0
+	}
+
+	if cfg.MaxOpen > 0 && cfg.MaxIdle > cfg.MaxOpen {
+		cfg.MaxIdle = cfg.MaxOpen
+	}
+
+	c.pool = &pool{
+		c:    c,
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+
+	if cfg.IdleTimeout > 0 {
+		go c.pool.cleaner()
+	}
+}
+
+// PoolStats returns the connection pool statistics
+func (c *Client) PoolStats() (s PoolStats) {
+	if c.pool != nil {
+		s = c.pool.poolStats()
+	}
+
+	return
+}
+
+// Close closes the connection pool
+func (c *Client) Close() (err error) {
+	if c.pool != nil {
+		c.pool.close()
+	}
+
+	return
+}
+
+func (p *pool) do(ctx context.Context, f func(s *Session) error) (err error) {
+	var s *Session
+
+	if s, err = p.get(ctx); err != nil {
+		return
+	}
+
+	err = f(s)
+	p.put(s)
+
+	return
+}
+
+func (p *pool) get(ctx context.Context) (s *Session, err error) {
+	var ok bool
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			err = ErrPoolClosed
+			return
+		}
+
+		if n := len(p.idle); n > 0 {
+			is := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			if p.expired(is) || !is.s.alive() {
+				p.open--
+				p.mu.Unlock()
+				is.s.End()
+				continue
+			}
+			p.mu.Unlock()
+
+			if p.cfg.PingOnBorrow {
+				if ok, err = is.s.Ping(ctx); err != nil || !ok {
+					if cerr := ctx.Err(); cerr != nil {
+						p.put(is.s)
+						err = cerr
+						return
+					}
+					p.mu.Lock()
+					p.stats.HealthCheckFailed++
+					p.open--
+					p.release()
+					p.mu.Unlock()
+					is.s.End()
+					err = nil
+					continue
+				}
+			}
+
+			s = is.s
+			return
+		}
+
+		if p.cfg.MaxOpen > 0 && p.open >= p.cfg.MaxOpen {
+			ch := make(chan *Session, 1)
+			p.waiters = append(p.waiters, ch)
+			p.stats.WaitCount++
+			p.mu.Unlock()
+
+			start := time.Now()
+			select {
+			case s, ok = <-ch:
+				p.mu.Lock()
+				p.stats.WaitDuration += time.Since(start)
+				p.mu.Unlock()
+				if !ok {
+					err = ErrPoolClosed
+					return
+				}
+			case <-ctx.Done():
+				p.mu.Lock()
+				p.stats.WaitDuration += time.Since(start)
+				p.removeWaiter(ch)
+				p.mu.Unlock()
+				select {
+				case s, ok = <-ch:
+					if s != nil {
+						p.put(s)
+					} else if ok {
+						p.mu.Lock()
+						p.open--
+						p.release()
+						p.mu.Unlock()
+					}
+				default:
+				}
+				s = nil
+				err = ctx.Err()
+				return
+			}
+
+			if s != nil {
+				return
+			}
+			// a nil session is a permit to open a new one
+		} else {
+			p.open++
+			p.mu.Unlock()
+		}
+
+		if s, err = p.c.IDSession(ctx); err != nil {
+			p.mu.Lock()
+			p.open--
+			p.release()
+			p.mu.Unlock()
+		}
+
+		return
+	}
+}
+
+func (p *pool) put(s *Session) {
+	p.mu.Lock()
+	if p.closed || !s.alive() {
+		p.open--
+		p.release()
+		p.mu.Unlock()
+		s.End()
+		return
+	}
+
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		ch <- s
+		p.mu.Unlock()
+		return
+	}
+
+	if len(p.idle) >= p.cfg.MaxIdle {
+		p.open--
+		p.stats.MaxIdleClosed++
+		p.mu.Unlock()
+		s.End()
+		return
+	}
+
+	p.idle = append(p.idle, &idleSession{s: s, t: time.Now()})
+	p.mu.Unlock()
+}
+
+// release hands a permit to open a session to the first
+// waiter, it must be called with p.mu held
+func (p *pool) release() {
+	if len(p.waiters) == 0 || p.closed {
+		return
+	}
+
+	ch := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	p.open++
+	ch <- nil
+}
+
+func (p *pool) removeWaiter(ch chan *Session) {
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// expired must be called with p.mu held
+func (p *pool) expired(is *idleSession) (b bool) {
+	if p.cfg.IdleTimeout <= 0 {
+		return
+	}
+
+	if b = time.Since(is.t) > p.cfg.IdleTimeout; b {
+		p.stats.MaxIdleTimeClosed++
+	}
+
+	return
+}
+
+func (p *pool) cleaner() {
+	t := time.NewTicker(p.cfg.IdleTimeout / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+
+		var stale []*Session
+		p.mu.Lock()
+		active := p.idle[:0]
+		for _, is := range p.idle {
+			if p.expired(is) || !is.s.alive() {
+				stale = append(stale, is.s)
+				p.open--
+				continue
+			}
+			active = append(active, is)
+		}
+		p.idle = active
+		p.mu.Unlock()
+
+		for _, s := range stale {
+			s.End()
+		}
+	}
+}
+
+func (p *pool) poolStats() (s PoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s = p.stats
+	s.MaxOpen = p.cfg.MaxOpen
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - s.Idle
+
+	return
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	for _, ch := range p.waiters {
+		close(ch)
+	}
+	p.waiters = nil
+	close(p.stop)
+	p.mu.Unlock()
+
+	for _, is := range idle {
+		is.s.End()
+	}
+}
+
+// pooled returns true when cmd is sent on a pooled session
+func (c *Client) pooled(cmd protocol.Command) bool {
+	return c.pool != nil && !c.allMatch && pooledCmd(cmd)
+}
+
+func pooledCmd(cmd protocol.Command) (b bool) {
+	switch cmd {
+	case protocol.Ping, protocol.Version, protocol.Stats, protocol.Scan, protocol.Instream, protocol.Fildes:
+		b = true
+	}
+	return
+}
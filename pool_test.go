@@ -0,0 +1,197 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestPool(t *testing.T) {
+	var e error
+	var c *Client
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{MaxOpen: 2, MaxIdle: 5})
+	defer c.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn := fmt.Sprintf("/tmp/file-%d", i)
+			r, err := c.Scan(ctx, fn)
+			if err != nil || len(r) != 1 || r[0].Filename != fn {
+				t.Errorf("Scan: got %v, %v", r, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := c.PoolStats()
+	if s.MaxOpen != 2 {
+		t.Errorf("Expected MaxOpen 2 got %d", s.MaxOpen)
+	}
+	if s.Open != 2 || s.Idle != 2 || s.InUse != 0 {
+		t.Errorf("Expected 2 open and idle sessions got %+v", s)
+	}
+	if s.WaitCount == 0 {
+		t.Errorf("Expected callers to wait for a session got %+v", s)
+	}
+
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+	if v, e := c.Version(ctx); e != nil || v != testVersion {
+		t.Errorf("Version: got %q, %v", v, e)
+	}
+	if v, e := c.Stats(ctx); e != nil || v != testStats {
+		t.Errorf("Stats: got %q, %v", v, e)
+	}
+	if r, e := c.ScanReader(ctx, strings.NewReader("clean data")); e != nil || len(r) != 1 || r[0].Status != "OK" {
+		t.Errorf("ScanReader: got %v, %v", r, e)
+	}
+	if r, e := c.InStream(ctx, "./examples/eicar.txt"); e != nil || len(r) != 1 || r[0].Signature != "Eicar-Signature" {
+		t.Errorf("InStream: got %v, %v", r, e)
+	}
+
+	c.Close()
+	if s = c.PoolStats(); s.Open != 0 || s.Idle != 0 {
+		t.Errorf("Expected no open sessions after Close got %+v", s)
+	}
+	if _, e = c.Ping(ctx); e != ErrPoolClosed {
+		t.Errorf("Got %v want %q", e, ErrPoolClosed)
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	var e error
+	var c *Client
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{MaxOpen: 1})
+	defer c.Close()
+
+	ctx := context.Background()
+	s, e := c.pool.get(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, e = c.Ping(tctx); e != context.DeadlineExceeded {
+		t.Errorf("Expected %v got %v", context.DeadlineExceeded, e)
+	}
+	if ps := c.PoolStats(); ps.WaitCount != 1 || ps.WaitDuration == 0 {
+		t.Errorf("Expected a recorded wait got %+v", ps)
+	}
+
+	c.pool.put(s)
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var e error
+	var c *Client
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{PingOnBorrow: true, IdleTimeout: 50 * time.Millisecond})
+	defer c.Close()
+
+	ctx := context.Background()
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Fatalf("Ping: got %t, %v", b, e)
+	}
+
+	// Break the idle session behind the pool's back
+	c.pool.mu.Lock()
+	c.pool.idle[0].s.conn.Close()
+	c.pool.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Fatalf("Ping: got %t, %v", b, e)
+	}
+	if s := c.PoolStats(); s.Open != 1 || s.Idle != 1 {
+		t.Errorf("Expected the broken session to be replaced got %+v", s)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if s := c.PoolStats(); s.Open != 0 || s.Idle != 0 || s.MaxIdleTimeClosed != 1 {
+		t.Errorf("Expected the idle session to be closed got %+v", s)
+	}
+}
+
+func TestPoolAllMatch(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{})
+	c.SetAllMatch(true)
+	defer c.Close()
+
+	ctx := context.Background()
+	srv.InjectFault("INSTREAM", clamdtest.Fault{
+		Reply: "stream: Eicar-Signature FOUND\nstream: Win.Test.EICAR_HDB-1 FOUND",
+	})
+	r, e := c.ScanReader(ctx, strings.NewReader("infected data"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	fr := FileResults(r)
+	if len(r) != 2 || len(fr) != 1 || len(fr[0].Signatures) != 2 {
+		t.Errorf("Expected every match of the stream got %v", r)
+	}
+
+	srv.InjectFault("SCAN", clamdtest.Fault{
+		Reply: "/tmp/file: Eicar-Signature FOUND\n/tmp/file: Win.Test.EICAR_HDB-1 FOUND",
+	})
+	if r, e = c.Scan(ctx, "/tmp/file"); e != nil || len(r) != 2 {
+		t.Errorf("Expected every match of the file got %v, %v", r, e)
+	}
+
+	if b, e := c.Ping(ctx); e != nil || !b {
+		t.Errorf("Ping: got %t, %v", b, e)
+	}
+	if n := srv.Commands("IDSESSION"); n != 0 {
+		t.Errorf("Expected no sessions got %d", n)
+	}
+	if s := c.PoolStats(); s.Open != 0 {
+		t.Errorf("Expected no open sessions got %+v", s)
+	}
+
+	if _, e = c.IDSession(ctx); e != ErrAllMatchSession {
+		t.Errorf("Expected %v got %v", ErrAllMatchSession, e)
+	}
+}
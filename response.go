@@ -0,0 +1,238 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"strings"
+)
+
+const (
+	foundStatus      = "FOUND"
+	okStatus         = "OK"
+	errorStatus      = "ERROR"
+	fieldSep         = ": "
+	failedOp         = "() failed"
+	invalidStatusErr = "Invalid status: %q"
+	noResponsesErr   = "No responses"
+	excludedMsg      = "Excluded"
+	excludedFSMsg    = "Excluded (another filesystem)"
+	symlinkMsg       = "Symbolic link"
+	accessDeniedMsg  = "Access denied"
+)
+
+// Status is the status of a Response
+type Status string
+
+const (
+	// StatusOK is the status of a clean file
+	StatusOK Status = okStatus
+	// StatusFound is the status of an infected file
+	StatusFound Status = foundStatus
+	// StatusError is the status of a file that
+	// could not be scanned
+	StatusError Status = errorStatus
+)
+
+func (s Status) String() string {
+	return string(s)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s Status) MarshalText() (b []byte, err error) {
+	b = []byte(s)
+
+	return
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler,
+// the status is not case sensitive and an empty status
+// is the zero Status
+func (s *Status) UnmarshalText(b []byte) (err error) {
+	v := Status(strings.ToUpper(string(b)))
+	if v != "" && !v.valid() {
+		err = errorf(ErrInvalidResponse, invalidStatusErr, string(b))
+		return
+	}
+
+	*s = v
+
+	return
+}
+
+func (s Status) valid() bool {
+	return s == StatusOK || s == StatusFound || s == StatusError
+}
+
+// Infected returns true when a signature matched
+func (rs *Response) Infected() bool {
+	return rs.Status == StatusFound
+}
+
+// Clean returns true when no signature matched
+func (rs *Response) Clean() bool {
+	return rs.Status == StatusOK
+}
+
+// Failed returns true when the file could not be scanned
+func (rs *Response) Failed() bool {
+	return rs.Status == StatusError
+}
+
+// Verdict is the overall result of the responses of a scan
+type Verdict struct {
+	// Status is FOUND when a response is infected, ERROR when
+	// a response failed or there are no responses and OK
+	// when every response is clean
+	Status Status `json:"status"`
+	// Filename and Signature are those of the first detection
+	Filename  string `json:"filename,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// Error is the message of the first failed response
+	Error string `json:"error,omitempty"`
+}
+
+// NewVerdict returns the Verdict of r
+func NewVerdict(r []*Response) (v *Verdict) {
+	v = &Verdict{Status: StatusOK}
+
+	if len(r) == 0 {
+		v.Status, v.Error = StatusError, noResponsesErr
+		return
+	}
+
+	for _, rs := range r {
+		switch {
+		case rs.Infected():
+			if v.Status != StatusFound {
+				v.Status, v.Filename, v.Signature = StatusFound, rs.Filename, rs.Signature
+			}
+		case rs.Failed():
+			if v.Error == "" {
+				v.Error = rs.Error
+			}
+			if v.Status == StatusOK {
+				v.Status = StatusError
+			}
+		}
+	}
+
+	return
+}
+
+// Infected returns true when a response is infected
+func (v *Verdict) Infected() bool {
+	return v.Status == StatusFound
+}
+
+// Clean returns true when every response is clean
+func (v *Verdict) Clean() bool {
+	return v.Status == StatusOK
+}
+
+// Failed returns true when no response is infected and
+// a response failed or there are no responses
+func (v *Verdict) Failed() bool {
+	return v.Status == StatusError
+}
+
+// ParseResponse parses a scan reply line of the form
+// "<filename>: OK", "<filename>: <signature> FOUND" or
+// "<filename>: <message> ERROR". A trailing newline or NUL
+// delimiter is removed.
+//
+// The filename ends at the last ": " of the line so
+// filenames that contain colons, spaces or, in replies to
+// z-prefixed commands, newlines are returned unchanged.
+// The message of an ERROR line is returned as the Error,
+// a "<call>() failed: <reason>" message is kept whole.
+// Files that clamd skipped are reported without a status,
+// as in "<filename>: Excluded" or "<filename>: Symbolic link",
+// those lines are returned as ERROR responses with the
+// message as the Error. Other lines without a status are
+// invalid.
+// Replies that are not about a file, such as
+// "INSTREAM size limit exceeded. ERROR", are returned as
+// a *ServerError.
+func ParseResponse(line string) (rs *Response, err error) {
+	var status Status
+	var name, sig, msg string
+
+	raw := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\x00")
+
+	switch {
+	case strings.HasSuffix(raw, fieldSep+okStatus):
+		name, status = strings.TrimSuffix(raw, fieldSep+okStatus), okStatus
+	case strings.HasSuffix(raw, " "+foundStatus):
+		status = foundStatus
+		name, sig = splitLast(strings.TrimSuffix(raw, " "+foundStatus))
+	case strings.HasSuffix(raw, " "+errorStatus):
+		status = errorStatus
+		name, msg = splitError(strings.TrimSuffix(raw, " "+errorStatus))
+	default:
+		// Files that are skipped, such as excluded files
+		// and symbolic links, are reported without a status
+		if name, msg = splitLast(raw); skipped(msg) {
+			status = errorStatus
+		}
+	}
+
+	if status == "" || name == "" || (status == foundStatus && sig == "") || (status == errorStatus && msg == "") {
+		err = responseError(raw)
+		return
+	}
+
+	rs = &Response{
+		Filename:  name,
+		Signature: sig,
+		Status:    status,
+		Error:     msg,
+		Raw:       raw,
+	}
+
+	return
+}
+
+// skipped returns true for the messages of the
+// files that clamd does not scan
+func skipped(msg string) bool {
+	switch strings.TrimSuffix(msg, ".") {
+	case excludedMsg, excludedFSMsg, symlinkMsg, accessDeniedMsg:
+		return true
+	}
+
+	return false
+}
+
+// splitLast splits s at the last ": "
+func splitLast(s string) (name, value string) {
+	if i := strings.LastIndex(s, fieldSep); i >= 0 {
+		name, value = s[:i], s[i+len(fieldSep):]
+	}
+
+	return
+}
+
+// splitError splits an error line at the last ": " that
+// does not follow a failed call
+func splitError(s string) (name, msg string) {
+	for end := len(s); ; {
+		i := strings.LastIndex(s[:end], fieldSep)
+		if i < 0 {
+			return
+		}
+
+		if !strings.HasSuffix(s[:i], failedOp) {
+			name, msg = s[:i], s[i+len(fieldSep):]
+			return
+		}
+
+		end = i
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+type parseResponseTestKey struct {
+	in        string
+	filename  string
+	signature string
+	message   string
+	status    Status
+	raw       string
+	err       error
+}
+
+var TestParseResponses = []parseResponseTestKey{
+	// Plain replies
+	{"/tmp/file: OK", "/tmp/file", "", "", "OK", "/tmp/file: OK", nil},
+	{"/tmp/file: OK\n", "/tmp/file", "", "", "OK", "/tmp/file: OK", nil},
+	{"/tmp/file: OK\x00", "/tmp/file", "", "", "OK", "/tmp/file: OK", nil},
+	{"stream: Eicar-Signature FOUND", "stream", "Eicar-Signature", "", "FOUND", "stream: Eicar-Signature FOUND", nil},
+	{"stream: Win.Test.EICAR_HDB-1 FOUND\n", "stream", "Win.Test.EICAR_HDB-1", "", "FOUND", "stream: Win.Test.EICAR_HDB-1 FOUND", nil},
+	{"/tmp/file: Access denied. ERROR", "/tmp/file", "", "Access denied.", "ERROR", "/tmp/file: Access denied. ERROR", nil},
+	// Filenames with colons
+	{`C:\Users\x\file.exe: OK`, `C:\Users\x\file.exe`, "", "", "OK", `C:\Users\x\file.exe: OK`, nil},
+	{`C:\Users\x\file.exe: Eicar-Signature FOUND`, `C:\Users\x\file.exe`, "Eicar-Signature", "", "FOUND", `C:\Users\x\file.exe: Eicar-Signature FOUND`, nil},
+	{"http://example.com:8080/a.bin: OK", "http://example.com:8080/a.bin", "", "", "OK", "http://example.com:8080/a.bin: OK", nil},
+	{"/tmp/a: b: OK", "/tmp/a: b", "", "", "OK", "/tmp/a: b: OK", nil},
+	{"/tmp/a: b: Eicar-Signature FOUND", "/tmp/a: b", "Eicar-Signature", "", "FOUND", "/tmp/a: b: Eicar-Signature FOUND", nil},
+	{"/tmp/a:b: Access denied. ERROR", "/tmp/a:b", "", "Access denied.", "ERROR", "/tmp/a:b: Access denied. ERROR", nil},
+	// Signatures with colons
+	{"stream: YARA.rule:sub.UNOFFICIAL FOUND", "stream", "YARA.rule:sub.UNOFFICIAL", "", "FOUND", "stream: YARA.rule:sub.UNOFFICIAL FOUND", nil},
+	// Filenames with spaces
+	{"/tmp/my file.txt: OK", "/tmp/my file.txt", "", "", "OK", "/tmp/my file.txt: OK", nil},
+	{"/tmp/my file FOUND.txt: Eicar-Signature FOUND", "/tmp/my file FOUND.txt", "Eicar-Signature", "", "FOUND", "/tmp/my file FOUND.txt: Eicar-Signature FOUND", nil},
+	{"/tmp/ OK: OK", "/tmp/ OK", "", "", "OK", "/tmp/ OK: OK", nil},
+	// Filenames with newlines in z replies
+	{"/tmp/a\nb: OK\x00", "/tmp/a\nb", "", "", "OK", "/tmp/a\nb: OK", nil},
+	{"/tmp/a\nb: Eicar-Signature FOUND\x00", "/tmp/a\nb", "Eicar-Signature", "", "FOUND", "/tmp/a\nb: Eicar-Signature FOUND", nil},
+	// Session ids are part of the filename
+	{"1: stream: OK", "1: stream", "", "", "OK", "1: stream: OK", nil},
+	// Errors with a failed call
+	{"/tmp/x: lstat() failed: No such file or directory. ERROR", "/tmp/x", "", "lstat() failed: No such file or directory.", "ERROR", "/tmp/x: lstat() failed: No such file or directory. ERROR", nil},
+	{"/tmp/a: b: lstat() failed: Permission denied. ERROR", "/tmp/a: b", "", "lstat() failed: Permission denied.", "ERROR", "/tmp/a: b: lstat() failed: Permission denied. ERROR", nil},
+	{"/tmp/x: open() failed: lstat() failed: x. ERROR", "/tmp/x", "", "open() failed: lstat() failed: x.", "ERROR", "/tmp/x: open() failed: lstat() failed: x. ERROR", nil},
+	// Files that were not scanned
+	{"/tmp/file: Excluded", "/tmp/file", "", "Excluded", "ERROR", "/tmp/file: Excluded", nil},
+	{"/tmp/link: Symbolic link", "/tmp/link", "", "Symbolic link", "ERROR", "/tmp/link: Symbolic link", nil},
+	{"/tmp/a: b: Excluded\n", "/tmp/a: b", "", "Excluded", "ERROR", "/tmp/a: b: Excluded", nil},
+	{"/tmp/dir: Excluded (another filesystem)", "/tmp/dir", "", "Excluded (another filesystem)", "ERROR", "/tmp/dir: Excluded (another filesystem)", nil},
+	{"/tmp/file: Access denied", "/tmp/file", "", "Access denied", "ERROR", "/tmp/file: Access denied", nil},
+	// Invalid replies
+	{"", "", "", "", "", "", ErrInvalidResponse},
+	{"\n", "", "", "", "", "", ErrInvalidResponse},
+	{"garbage", "", "", "", "", "", ErrInvalidResponse},
+	{"PONG", "", "", "", "", "", ErrInvalidResponse},
+	{": OK", "", "", "", "", "", ErrInvalidResponse},
+	{"OK", "", "", "", "", "", ErrInvalidResponse},
+	{"/tmp/file:OK", "", "", "", "", "", ErrInvalidResponse},
+	{"/tmp/file: FOUND", "", "", "", "", "", ErrInvalidResponse},
+	{"/tmp/file Eicar FOUND", "", "", "", "", "", ErrInvalidResponse},
+	{"/tmp/file: Eicar FOUND extra", "", "", "", "", "", ErrInvalidResponse},
+	{"/tmp/file: ok", "", "", "", "", "", ErrInvalidResponse},
+	{"stream: some garbled reply", "", "", "", "", "", ErrInvalidResponse},
+	{": Excluded", "", "", "", "", "", ErrInvalidResponse},
+	{"UNKNOWN COMMAND", "", "", "", "", "", ErrUnknownCommand},
+	{"COMMAND READ TIMED OUT", "", "", "", "", "", ErrCommandReadTimedOut},
+	{"INSTREAM size limit exceeded. ERROR", "", "", "", "", "", ErrSizeLimitExceeded},
+	{"lstat() failed: x. ERROR", "", "", "", "", "", nil},
+}
+
+func TestParseResponse(t *testing.T) {
+	for _, tt := range TestParseResponses {
+		t.Run(tt.in, func(t *testing.T) {
+			rs, e := ParseResponse(tt.in)
+			if tt.status == "" {
+				if e == nil {
+					t.Fatalf("An error should be returned, got %v", rs)
+				}
+				if rs != nil {
+					t.Errorf("A response should not be returned, got %v", rs)
+				}
+				var se *ServerError
+				if tt.err == nil && !errors.As(e, &se) {
+					t.Errorf("Expected a *ServerError got %v", e)
+				}
+				if tt.err != nil && !errors.Is(e, tt.err) {
+					t.Errorf("Expected %v got %v", tt.err, e)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("An error should not be returned: %s", e)
+			}
+			if rs.Filename != tt.filename {
+				t.Errorf("Filename: expected %q got %q", tt.filename, rs.Filename)
+			}
+			if rs.Signature != tt.signature {
+				t.Errorf("Signature: expected %q got %q", tt.signature, rs.Signature)
+			}
+			if rs.Error != tt.message {
+				t.Errorf("Error: expected %q got %q", tt.message, rs.Error)
+			}
+			if rs.Status != tt.status {
+				t.Errorf("Status: expected %q got %q", tt.status, rs.Status)
+			}
+			if rs.Raw != tt.raw {
+				t.Errorf("Raw: expected %q got %q", tt.raw, rs.Raw)
+			}
+		})
+	}
+}
+
+func TestPerFileErrors(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+
+	srv.InjectFault("CONTSCAN", clamdtest.Fault{
+		Reply: "/srv/a: lstat() failed: Permission denied. ERROR\n/srv/b: Eicar-Signature FOUND\n/srv/c: Access denied. ERROR\n/srv/d: Excluded\n/srv/e: Symbolic link",
+	})
+	r, e := c.ContScan(ctx, "/srv")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 5 {
+		t.Fatalf("Expected 5 responses got %v", r)
+	}
+	if r[0].Filename != "/srv/a" || r[0].Status != "ERROR" || r[0].Error != "lstat() failed: Permission denied." || r[0].Signature != "" {
+		t.Errorf("Unexpected result %v", r[0])
+	}
+	if r[1].Filename != "/srv/b" || r[1].Status != "FOUND" || r[1].Error != "" {
+		t.Errorf("Unexpected result %v", r[1])
+	}
+	if r[2].Filename != "/srv/c" || r[2].Status != "ERROR" || r[2].Error != "Access denied." {
+		t.Errorf("Unexpected result %v", r[2])
+	}
+	if r[3].Filename != "/srv/d" || r[3].Status != "ERROR" || r[3].Error != "Excluded" {
+		t.Errorf("Unexpected result %v", r[3])
+	}
+	if r[4].Filename != "/srv/e" || r[4].Status != "ERROR" || r[4].Error != "Symbolic link" {
+		t.Errorf("Unexpected result %v", r[4])
+	}
+	srv.ClearFaults()
+
+	// A missing file is reported in the responses
+	if r, e = c.Scan(ctx, "/nonexistent/file"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "ERROR" || r[0].Error != "lstat() failed: No such file or directory." {
+		t.Errorf("Unexpected result %v", r)
+	}
+
+	ss, e := c.IDSession(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer ss.End()
+	if r, e = ss.Scan(ctx, "/nonexistent/file"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "ERROR" || r[0].Filename != "/nonexistent/file" {
+		t.Errorf("Unexpected result %v", r)
+	}
+
+	// Protocol errors still end the reply
+	srv.InjectFault("MULTISCAN", clamdtest.Fault{
+		Reply: "/srv/a: OK\nCOMMAND READ TIMED OUT",
+	})
+	if _, e = c.MultiScan(ctx, "/srv"); !errors.Is(e, ErrCommandReadTimedOut) {
+		t.Errorf("Expected %v got %v", ErrCommandReadTimedOut, e)
+	}
+	srv.InjectFault("MULTISCAN", clamdtest.Fault{
+		Reply: "/srv/a: OK\ngarbage",
+	})
+	if _, e = c.MultiScan(ctx, "/srv"); !errors.Is(e, ErrInvalidResponse) {
+		t.Errorf("Expected %v got %v", ErrInvalidResponse, e)
+	}
+}
+
+func TestScanColonFilename(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	eicar, e := ioutil.ReadFile("examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	dir, e := ioutil.TempDir("", "clamd: test")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "a: b FOUND.txt")
+	if e = ioutil.WriteFile(fn, eicar, 0644); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	r, e := c.Scan(context.Background(), fn)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != fn || r[0].Signature != clamdtest.EicarSignature || r[0].Status != "FOUND" {
+		t.Errorf("Unexpected result %v", r[0])
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		infected bool
+		clean    bool
+		failed   bool
+	}{
+		{"/tmp/file: OK", false, true, false},
+		{"/tmp/file: Eicar-Signature FOUND", true, false, false},
+		{"/tmp/file: Access denied. ERROR", false, false, true},
+	} {
+		rs, e := ParseResponse(tt.in)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if rs.Infected() != tt.infected || rs.Clean() != tt.clean || rs.Failed() != tt.failed {
+			t.Errorf("%q: expected %t %t %t got %t %t %t", tt.in, tt.infected, tt.clean, tt.failed, rs.Infected(), rs.Clean(), rs.Failed())
+		}
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	rs, e := ParseResponse("/tmp/file: Eicar-Signature FOUND")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	b, e := json.Marshal(rs)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := `{"filename":"/tmp/file","signature":"Eicar-Signature","status":"FOUND","raw":"/tmp/file: Eicar-Signature FOUND"}`
+	if string(b) != expected {
+		t.Errorf("Expected %s got %s", expected, b)
+	}
+
+	var d Response
+	if e = json.Unmarshal(b, &d); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !reflect.DeepEqual(&d, rs) {
+		t.Errorf("Expected %+v got %+v", rs, d)
+	}
+
+	// The status is not case sensitive
+	if e = json.Unmarshal([]byte(`{"filename":"/tmp/file","status":"error","error":"Access denied."}`), &d); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !d.Failed() || d.Error != "Access denied." {
+		t.Errorf("Unexpected result %+v", d)
+	}
+
+	if e = json.Unmarshal([]byte(`{"filename":"/tmp/file","status":"CLEAN"}`), &d); !errors.Is(e, ErrInvalidResponse) {
+		t.Errorf("Expected %v got %v", ErrInvalidResponse, e)
+	}
+
+	// Zero values round trip
+	for _, v := range []interface{}{&Response{Filename: "x"}, &Verdict{}} {
+		if b, e = json.Marshal(v); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		z := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if e = json.Unmarshal(b, z); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if !reflect.DeepEqual(z, v) {
+			t.Errorf("Expected %+v got %+v", v, z)
+		}
+	}
+	if b, _ = json.Marshal(&Verdict{}); string(b) != `{"status":""}` {
+		t.Errorf("Unexpected result %s", b)
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	parse := func(lines ...string) (r []*Response) {
+		for _, l := range lines {
+			rs, e := ParseResponse(l)
+			if e != nil {
+				t.Fatalf("An error should not be returned: %s", e)
+			}
+			r = append(r, rs)
+		}
+		return
+	}
+
+	for _, tt := range []struct {
+		name     string
+		r        []*Response
+		expected Verdict
+	}{
+		{"none", nil, Verdict{Status: StatusError, Error: noResponsesErr}},
+		{"clean", parse("/a: OK", "/b: OK"), Verdict{Status: StatusOK}},
+		{"error", parse("/a: OK", "/b: Access denied. ERROR", "/c: Can't allocate memory ERROR"), Verdict{Status: StatusError, Error: "Access denied."}},
+		{
+			"infected",
+			parse("/a: OK", "/b: Access denied. ERROR", "/c: Eicar-Signature FOUND", "/d: Win.Test.EICAR_HDB-1 FOUND"),
+			Verdict{Status: StatusFound, Filename: "/c", Signature: "Eicar-Signature", Error: "Access denied."},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerdict(tt.r)
+			if *v != tt.expected {
+				t.Errorf("Expected %+v got %+v", tt.expected, v)
+			}
+			if v.Infected() != (tt.expected.Status == StatusFound) || v.Clean() != (tt.expected.Status == StatusOK) || v.Failed() != (tt.expected.Status == StatusError) {
+				t.Errorf("Unexpected helpers for %+v", v)
+			}
+		})
+	}
+
+	b, e := json.Marshal(NewVerdict(parse("/c: Eicar-Signature FOUND")))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if expected := `{"status":"FOUND","filename":"/c","signature":"Eicar-Signature"}`; string(b) != expected {
+		t.Errorf("Expected %s got %s", expected, b)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+// FileResult is the result of a file, when clamd runs with
+// AllMatchScan a file may match several signatures
+type FileResult struct {
+	Filename string `json:"filename"`
+	// Signatures are the signatures matched in the order
+	// they were reported
+	Signatures []string `json:"signatures,omitempty"`
+	// Status is FOUND when a signature matched, ERROR when
+	// the file could not be scanned and OK otherwise
+	Status Status `json:"status"`
+	// Errors are the messages of the ERROR responses
+	Errors []string `json:"errors,omitempty"`
+}
+
+// FileResults groups the responses of each file in the order
+// the files were first reported
+func FileResults(r []*Response) (fr []*FileResult) {
+	files := make(map[string]*FileResult)
+
+	for _, rs := range r {
+		f, ok := files[rs.Filename]
+		if !ok {
+			f = &FileResult{
+				Filename: rs.Filename,
+				Status:   StatusOK,
+			}
+			files[rs.Filename] = f
+			fr = append(fr, f)
+		}
+
+		switch {
+		case rs.Infected():
+			f.Signatures = append(f.Signatures, rs.Signature)
+			f.Status = StatusFound
+		case rs.Failed():
+			f.Errors = append(f.Errors, rs.Error)
+			if f.Status == StatusOK {
+				f.Status = StatusError
+			}
+		}
+	}
+
+	return
+}
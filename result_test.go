@@ -0,0 +1,104 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestFileResults(t *testing.T) {
+	if fr := FileResults(nil); fr != nil {
+		t.Errorf("Expected no results got %v", fr)
+	}
+
+	var r []*Response
+	for _, l := range []string{
+		"/srv/a: Eicar-Signature FOUND",
+		"/srv/b: OK",
+		"/srv/a: Win.Test.EICAR_HDB-1 FOUND",
+		"/srv/c: lstat() failed: Permission denied. ERROR",
+		"/srv/d: Eicar-Signature FOUND",
+		"/srv/d: Can't allocate memory ERROR",
+		"/srv/a: YARA.rule:sub.UNOFFICIAL FOUND",
+	} {
+		rs, e := ParseResponse(l)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		r = append(r, rs)
+	}
+
+	expected := []*FileResult{
+		{
+			Filename:   "/srv/a",
+			Signatures: []string{"Eicar-Signature", "Win.Test.EICAR_HDB-1", "YARA.rule:sub.UNOFFICIAL"},
+			Status:     "FOUND",
+		},
+		{
+			Filename: "/srv/b",
+			Status:   "OK",
+		},
+		{
+			Filename: "/srv/c",
+			Status:   "ERROR",
+			Errors:   []string{"lstat() failed: Permission denied."},
+		},
+		{
+			Filename:   "/srv/d",
+			Signatures: []string{"Eicar-Signature"},
+			Status:     "FOUND",
+			Errors:     []string{"Can't allocate memory"},
+		},
+	}
+
+	fr := FileResults(r)
+	if len(fr) != len(expected) {
+		t.Fatalf("Expected %d results got %d", len(expected), len(fr))
+	}
+	for n := range expected {
+		if !reflect.DeepEqual(fr[n], expected[n]) {
+			t.Errorf("Expected %+v got %+v", expected[n], fr[n])
+		}
+	}
+}
+
+func TestFileResultsAllMatch(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	srv.InjectFault("CONTSCAN", clamdtest.Fault{
+		Reply: "/srv/a.zip: Eicar-Signature FOUND\n/srv/a.zip: Win.Test.EICAR_HDB-1 FOUND\n/srv/b.txt: Eicar-Signature FOUND",
+	})
+
+	r, e := c.ContScan(context.Background(), "/srv")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	fr := FileResults(r)
+	if len(fr) != 2 {
+		t.Fatalf("Expected 2 results got %v", fr)
+	}
+	if fr[0].Filename != "/srv/a.zip" || fr[0].Status != "FOUND" || !reflect.DeepEqual(fr[0].Signatures, []string{"Eicar-Signature", "Win.Test.EICAR_HDB-1"}) {
+		t.Errorf("Unexpected result %+v", fr[0])
+	}
+	if fr[1].Filename != "/srv/b.txt" || len(fr[1].Signatures) != 1 {
+		t.Errorf("Unexpected result %+v", fr[1])
+	}
+}
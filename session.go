@@ -0,0 +1,447 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/protocol"
+)
+
+const (
+	sessionClosedErr   = "The session is closed"
+	allMatchSessionErr = "Sessions can not be used with AllMatchScan"
+	statsEnd           = "END"
+)
+
+// A Session represents a Clamd IDSESSION, it keeps a single
+// connection open and multiplexes the commands sent on it, so
+// it is safe to use from multiple goroutines.
+type Session struct {
+	c       *Client
+	conn    net.Conn
+	w       *bufio.Writer
+	r       *bufio.Reader
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	cond    *sync.Cond
+	id      uint64
+	pending map[uint64]*sessionReq
+	closed  bool
+	err     error
+	done    chan struct{}
+}
+
+type sessionReq struct {
+	cmd   protocol.Command
+	lines []string
+	ch    chan sessionReply
+}
+
+type sessionReply struct {
+	s   string
+	err error
+}
+
+// IDSession starts a session, it returns ErrAllMatchSession
+// when SetAllMatch is set
+func (c *Client) IDSession(ctx context.Context) (s *Session, err error) {
+	var conn net.Conn
+
+	if c.allMatch {
+		err = ErrAllMatchSession
+		return
+	}
+
+	if conn, err = c.dial(ctx); err != nil {
+		return
+	}
+
+	s = &Session{
+		c:       c,
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		r:       bufio.NewReader(conn),
+		pending: make(map[uint64]*sessionReq),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	conn.SetWriteDeadline(time.Now().Add(c.cmdTimeout))
+	c.writeCmd(s.w, protocol.IDSession)
+	if err = s.w.Flush(); err != nil {
+		conn.Close()
+		s = nil
+		return
+	}
+
+	go s.readLoop()
+
+	return
+}
+
+// Ping sends a ping to the server
+func (s *Session) Ping(ctx context.Context) (b bool, err error) {
+	var r string
+	if r, err = s.send(ctx, protocol.Ping, "", nil); err != nil {
+		return
+	}
+
+	if err = checkError(r); err != nil {
+		return
+	}
+
+	b = r == pingResp
+
+	return
+}
+
+// Version returns the server version
+func (s *Session) Version(ctx context.Context) (v string, err error) {
+	if v, err = s.send(ctx, protocol.Version, "", nil); err != nil {
+		return
+	}
+
+	if v == "" {
+		err = errorf(ErrInvalidResponse, versionErr)
+		return
+	}
+
+	err = checkError(v)
+
+	return
+}
+
+// Stats returns server stats
+func (s *Session) Stats(ctx context.Context) (r string, err error) {
+	if r, err = s.send(ctx, protocol.Stats, "", nil); err != nil {
+		return
+	}
+
+	if r == "" {
+		err = errorf(ErrInvalidResponse, statsErr)
+		return
+	}
+
+	err = checkError(r)
+
+	return
+}
+
+// Scan a file or directory
+func (s *Session) Scan(ctx context.Context, p string) (r []*Response, err error) {
+	r, err = s.fileCmd(ctx, protocol.Scan, p)
+	return
+}
+
+// ScanReader scans an io.reader
+func (s *Session) ScanReader(ctx context.Context, i io.Reader) (r []*Response, err error) {
+	r, err = s.cmd(ctx, protocol.Instream, "", i)
+	return
+}
+
+// InStream scan a stream
+func (s *Session) InStream(ctx context.Context, p string) (r []*Response, err error) {
+	r, err = s.fileCmd(ctx, protocol.Instream, p)
+	return
+}
+
+// Fildes scan a FD
+func (s *Session) Fildes(ctx context.Context, p string) (r []*Response, err error) {
+	r, err = s.fileCmd(ctx, protocol.Fildes, p)
+	return
+}
+
+// End closes a session, it waits for the replies to
+// the commands already sent before closing the connection
+func (s *Session) End() (err error) {
+	s.wmu.Lock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.wmu.Unlock()
+		return
+	}
+	s.closed = true
+	failed := s.err != nil
+	s.mu.Unlock()
+
+	if !failed {
+		s.conn.SetWriteDeadline(time.Now().Add(s.c.cmdTimeout))
+		s.c.writeCmd(s.w, protocol.EndSession)
+		err = s.w.Flush()
+	}
+	s.wmu.Unlock()
+
+	s.mu.Lock()
+	for err == nil && s.err == nil && len(s.pending) > 0 {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+
+	s.conn.Close()
+	<-s.done
+
+	return
+}
+
+func (s *Session) fileCmd(ctx context.Context, cmd protocol.Command, p string) (r []*Response, err error) {
+	var f *os.File
+
+	if cmd == protocol.Fildes && s.c.network != "unix" && s.c.network != "unixpacket" {
+		err = ErrFildesUnsupported
+		return
+	}
+
+	if cmd == protocol.Instream {
+		if f, err = os.Open(p); err != nil {
+			return
+		}
+		defer f.Close()
+
+		r, err = s.cmd(ctx, cmd, "", f)
+		return
+	}
+
+	if cmd == protocol.Fildes {
+		if _, err = os.Stat(p); os.IsNotExist(err) {
+			return
+		}
+	}
+
+	r, err = s.cmd(ctx, cmd, p, nil)
+
+	return
+}
+
+func (s *Session) cmd(ctx context.Context, cmd protocol.Command, p string, f io.Reader) (r []*Response, err error) {
+	var l string
+	var rs *Response
+
+	if l, err = s.send(ctx, cmd, p, f); err != nil {
+		return
+	}
+
+	if rs, err = ParseResponse(l); err != nil {
+		return
+	}
+
+	r = append(r, rs)
+
+	return
+}
+
+func (s *Session) send(ctx context.Context, cmd protocol.Command, p string, f io.Reader) (r string, err error) {
+	req := &sessionReq{
+		cmd: cmd,
+		ch:  make(chan sessionReply, 1),
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	s.wmu.Lock()
+	s.mu.Lock()
+	if s.closed || s.err != nil {
+		err = s.closedErr()
+		s.mu.Unlock()
+		s.wmu.Unlock()
+		return
+	}
+	s.id++
+	s.pending[s.id] = req
+	s.conn.SetReadDeadline(time.Now().Add(s.c.cmdTimeout))
+	s.mu.Unlock()
+
+	s.conn.SetWriteDeadline(s.c.deadline(ctx))
+	synced, err := s.write(ctx, cmd, p, f)
+	s.wmu.Unlock()
+
+	if err != nil && synced {
+		// The stream was terminated, the session can be used
+		return
+	}
+
+	if err != nil {
+		if writeFailed(err) {
+			// Use the reply clamd sends before closing a stream
+			<-s.done
+			if rep := <-req.ch; rep.err == nil {
+				r, err = rep.s, nil
+				return
+			}
+		}
+		s.fail(err)
+		return
+	}
+
+	select {
+	case rep := <-req.ch:
+		r, err = rep.s, rep.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// write sends a command, synced is false when the
+// connection is no longer in sync after an error
+func (s *Session) write(ctx context.Context, cmd protocol.Command, p string, f io.Reader) (synced bool, err error) {
+	switch cmd {
+	case protocol.Instream:
+		cw := s.c.newChunkWriter(ctx, s.w, s.conn)
+		err = cw.stream(cmd, f)
+		synced = !cw.broken
+	case protocol.Fildes:
+		err = s.c.fildesScan(s.w, s.conn, p)
+	default:
+		if cmd.RequiresParam() {
+			s.c.writeCmd(s.w, cmd, p)
+		} else {
+			s.c.writeCmd(s.w, cmd)
+		}
+		err = s.w.Flush()
+	}
+
+	return
+}
+
+func (s *Session) readLoop() {
+	var id uint64
+	var err error
+	var line string
+	var cur *sessionReq
+
+	defer close(s.done)
+
+	for {
+		if line, err = s.r.ReadString(s.c.delimiter()); err != nil {
+			break
+		}
+		line = strings.TrimRight(line, replyDelims)
+
+		s.mu.Lock()
+		if cur != nil {
+			cur.lines = append(cur.lines, line)
+			if line == statsEnd {
+				s.deliver(id, cur, strings.Join(cur.lines, "\n"))
+				cur = nil
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		var rs string
+		var req *sessionReq
+		if id, rs, err = splitSessionReply(line); err == nil {
+			if req = s.pending[id]; req == nil {
+				err = errorf(ErrInvalidResponse, invalidRespErr, line)
+			}
+		}
+		if err != nil {
+			s.mu.Unlock()
+			break
+		}
+
+		// A z mode STATS reply is a single message
+		if req.cmd == protocol.Stats && !s.c.zMode && rs != statsEnd && checkError(rs) == nil {
+			cur = req
+			cur.lines = append(cur.lines, rs)
+		} else {
+			s.deliver(id, req, rs)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	if s.closed || err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.mu.Unlock()
+	s.fail(err)
+}
+
+// deliver must be called with s.mu held
+func (s *Session) deliver(id uint64, req *sessionReq, r string) {
+	delete(s.pending, id)
+	req.ch <- sessionReply{s: r}
+
+	if len(s.pending) == 0 {
+		s.conn.SetReadDeadline(time.Time{})
+	} else {
+		s.conn.SetReadDeadline(time.Now().Add(s.c.cmdTimeout))
+	}
+	s.cond.Broadcast()
+}
+
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+
+	for id, req := range s.pending {
+		delete(s.pending, id)
+		req.ch <- sessionReply{err: s.err}
+	}
+
+	s.conn.Close()
+	s.cond.Broadcast()
+}
+
+func (s *Session) alive() (b bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b = !s.closed && s.err == nil
+
+	return
+}
+
+// closedErr must be called with s.mu held
+func (s *Session) closedErr() (err error) {
+	if s.err != nil {
+		err = s.err
+		return
+	}
+
+	err = ErrSessionClosed
+
+	return
+}
+
+func splitSessionReply(l string) (id uint64, r string, err error) {
+	p := strings.SplitN(l, ": ", 2)
+	if len(p) != 2 {
+		err = responseError(l)
+		return
+	}
+
+	if id, err = strconv.ParseUint(p[0], 10, 64); err != nil {
+		err = responseError(l)
+		return
+	}
+
+	r = p[1]
+
+	return
+}
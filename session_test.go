@@ -0,0 +1,247 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testVersion = "ClamAV 1.0.1/26850/Mon Mar 13 08:20:43 2023"
+	testStats   = "POOLS: 1\n\nSTATE: VALID PRIMARY\nTHREADS: live 1  idle 0 max 12 idle-timeout 30\nQUEUE: 0 items\n\tSTATS 0.000394 \n\nMEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1306.837M pools_total 1306.882M\nEND"
+)
+
+// sessionServer is a minimal IDSESSION speaking server, it
+// replies to commands in random order to exercise demultiplexing
+func sessionServer(t *testing.T) (network, address string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSession(conn)
+		}
+	}()
+
+	network = "tcp"
+	address = l.Addr().String()
+
+	return
+}
+
+func serveSession(conn net.Conn) {
+	var id int
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(id int, s string, delay time.Duration) {
+		defer wg.Done()
+		time.Sleep(delay)
+		wmu.Lock()
+		defer wmu.Unlock()
+		fmt.Fprintf(conn, "%d: %s\n", id, s)
+	}
+
+	if l, err := r.ReadString('\n'); err != nil || l != "nIDSESSION\n" {
+		return
+	}
+
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		id++
+		delay := time.Duration(rand.Intn(20)) * time.Millisecond
+		cmd := strings.TrimSpace(strings.TrimPrefix(l, "n"))
+		switch {
+		case cmd == "PING":
+			wg.Add(1)
+			go reply(id, pingResp, delay)
+		case cmd == "VERSION":
+			wg.Add(1)
+			go reply(id, testVersion, delay)
+		case cmd == "STATS":
+			wg.Add(1)
+			go reply(id, testStats, delay)
+		case strings.HasPrefix(cmd, "SCAN "):
+			wg.Add(1)
+			go reply(id, fmt.Sprintf("%s: OK", strings.TrimPrefix(cmd, "SCAN ")), delay)
+		case cmd == "INSTREAM":
+			var data bytes.Buffer
+			b := make([]byte, 4)
+			for {
+				if _, err = io.ReadFull(r, b); err != nil {
+					return
+				}
+				n := binary.BigEndian.Uint32(b)
+				if n == 0 {
+					break
+				}
+				if _, err = io.CopyN(&data, r, int64(n)); err != nil {
+					return
+				}
+			}
+			s := "stream: OK"
+			if bytes.Contains(data.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+				s = "stream: Eicar-Signature FOUND"
+			}
+			wg.Add(1)
+			go reply(id, s, delay)
+		case cmd == "END":
+			wg.Wait()
+			return
+		default:
+			wg.Add(1)
+			go reply(id, "UNKNOWN COMMAND", delay)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	var e error
+	var c *Client
+	var s *Session
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetCmdTimeout(5 * time.Second)
+
+	ctx := context.Background()
+	if s, e = c.IDSession(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 5 {
+			case 0:
+				if b, err := s.Ping(ctx); err != nil || !b {
+					errs <- fmt.Errorf("Ping: got %t, %v", b, err)
+				}
+			case 1:
+				if v, err := s.Version(ctx); err != nil || v != testVersion {
+					errs <- fmt.Errorf("Version: got %q, %v", v, err)
+				}
+			case 2:
+				if v, err := s.Stats(ctx); err != nil || v != testStats {
+					errs <- fmt.Errorf("Stats: got %q, %v", v, err)
+				}
+			case 3:
+				fn := fmt.Sprintf("/tmp/file-%d", i)
+				r, err := s.Scan(ctx, fn)
+				if err != nil || len(r) != 1 || r[0].Filename != fn || r[0].Status != "OK" {
+					errs <- fmt.Errorf("Scan: got %v, %v", r, err)
+				}
+			case 4:
+				r, err := s.InStream(ctx, "./examples/eicar.txt")
+				if err != nil || len(r) != 1 || r[0].Signature != "Eicar-Signature" {
+					errs <- fmt.Errorf("InStream: got %v, %v", r, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	r, e := s.ScanReader(ctx, strings.NewReader("clean data"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != "stream" || r[0].Status != "OK" {
+		t.Errorf("Expected stream: OK, got %v", r)
+	}
+
+	if _, e = s.Fildes(ctx, "./examples/eicar.txt"); e != ErrFildesUnsupported {
+		t.Errorf("Got %v want %q", e, ErrFildesUnsupported)
+	}
+
+	if e = s.End(); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if _, e = s.Ping(ctx); e != ErrSessionClosed {
+		t.Errorf("Got %v want %q", e, ErrSessionClosed)
+	}
+	if e = s.End(); e != nil {
+		t.Errorf("Calling End twice should not return an error: %s", e)
+	}
+}
+
+func TestSessionServerClose(t *testing.T) {
+	var e error
+	var c *Client
+	var s *Session
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Listen failed: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(conn)
+		r.ReadString('\n')
+		r.ReadString('\n')
+		fmt.Fprintf(conn, "COMMAND READ TIMED OUT\n")
+		conn.Close()
+	}()
+
+	if c, e = NewClient("tcp", l.Addr().String()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx := context.Background()
+	if s, e = c.IDSession(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = s.Ping(ctx); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if !errors.Is(e, ErrCommandReadTimedOut) {
+		t.Errorf("Expected ErrCommandReadTimedOut got %q", e)
+	}
+	if _, e = s.Version(ctx); e == nil {
+		t.Errorf("An error should be returned on a failed session")
+	}
+	s.End()
+}
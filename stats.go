@@ -0,0 +1,228 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statsPoolsPrefix    = "POOLS:"
+	statsStatePrefix    = "STATE:"
+	statsThreadsPrefix  = "THREADS:"
+	statsQueuePrefix    = "QUEUE:"
+	statsMemStatsPrefix = "MEMSTATS:"
+	statsNotAvailable   = "N/A"
+	statsPrimary        = "PRIMARY"
+	megabyte            = 1024 * 1024
+)
+
+// StatsResult is the parsed output of the STATS command,
+// Raw holds the unparsed output so fields not yet known
+// to this package can still be accessed.
+type StatsResult struct {
+	Pools       int
+	ThreadPools []*ThreadPool
+	MemStats    MemStats
+	Raw         string
+}
+
+// ThreadPool is the state of a clamd thread pool
+type ThreadPool struct {
+	State   string
+	Primary bool
+	Threads Threads
+	Queue   Queue
+}
+
+// Threads holds the thread counts of a thread pool
+type Threads struct {
+	Live        int
+	Idle        int
+	Max         int
+	IdleTimeout time.Duration
+}
+
+// Queue holds the scan queue of a thread pool
+type Queue struct {
+	Length int
+	Items  []*QueueItem
+}
+
+// QueueItem is a command that is queued or being processed
+type QueueItem struct {
+	Command string
+	Elapsed time.Duration
+	Target  string
+}
+
+// MemStats holds the memory usage of the server in bytes,
+// values the server reports as N/A are set to -1
+type MemStats struct {
+	Heap       int64
+	Mmap       int64
+	Used       int64
+	Free       int64
+	Releasable int64
+	Pools      int
+	PoolsUsed  int64
+	PoolsTotal int64
+}
+
+// StatsResult returns the parsed server stats
+func (c *Client) StatsResult(ctx context.Context) (r *StatsResult, err error) {
+	var s string
+
+	if s, err = c.Stats(ctx); err != nil {
+		return
+	}
+
+	r, err = ParseStats(s)
+
+	return
+}
+
+// ParseStats parses the output of the STATS command
+func ParseStats(s string) (r *StatsResult, err error) {
+	var tp *ThreadPool
+
+	s = strings.TrimRight(s, "\n")
+	if !strings.HasPrefix(s, statsPoolsPrefix) {
+		err = errorf(ErrInvalidResponse, invalidRespErr, s)
+		return
+	}
+
+	r = &StatsResult{
+		Raw: s,
+		MemStats: MemStats{
+			Heap:       -1,
+			Mmap:       -1,
+			Used:       -1,
+			Free:       -1,
+			Releasable: -1,
+			PoolsUsed:  -1,
+			PoolsTotal: -1,
+		},
+	}
+
+	for _, l := range strings.Split(s, "\n") {
+		switch {
+		case strings.HasPrefix(l, "\t"):
+			if tp == nil {
+				continue
+			}
+			if qi := parseQueueItem(l); qi != nil {
+				tp.Queue.Items = append(tp.Queue.Items, qi)
+			}
+		case strings.HasPrefix(l, statsPoolsPrefix):
+			if r.Pools, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(l, statsPoolsPrefix))); err != nil {
+				err = errorf(ErrInvalidResponse, invalidRespErr, l)
+				r = nil
+				return
+			}
+		case strings.HasPrefix(l, statsStatePrefix):
+			f := strings.Fields(strings.TrimPrefix(l, statsStatePrefix))
+			tp = &ThreadPool{}
+			if len(f) > 0 {
+				tp.State = f[0]
+			}
+			for _, v := range f[1:] {
+				if v == statsPrimary {
+					tp.Primary = true
+				}
+			}
+			r.ThreadPools = append(r.ThreadPools, tp)
+		case strings.HasPrefix(l, statsThreadsPrefix):
+			if tp == nil {
+				continue
+			}
+			kv := statsFields(strings.TrimPrefix(l, statsThreadsPrefix))
+			tp.Threads.Live = atoi(kv["live"])
+			tp.Threads.Idle = atoi(kv["idle"])
+			tp.Threads.Max = atoi(kv["max"])
+			tp.Threads.IdleTimeout = time.Duration(atoi(kv["idle-timeout"])) * time.Second
+		case strings.HasPrefix(l, statsQueuePrefix):
+			if tp == nil {
+				continue
+			}
+			if f := strings.Fields(strings.TrimPrefix(l, statsQueuePrefix)); len(f) > 0 {
+				tp.Queue.Length = atoi(f[0])
+			}
+		case strings.HasPrefix(l, statsMemStatsPrefix):
+			kv := statsFields(strings.TrimPrefix(l, statsMemStatsPrefix))
+			r.MemStats.Heap = parseMegabytes(kv["heap"])
+			r.MemStats.Mmap = parseMegabytes(kv["mmap"])
+			r.MemStats.Used = parseMegabytes(kv["used"])
+			r.MemStats.Free = parseMegabytes(kv["free"])
+			r.MemStats.Releasable = parseMegabytes(kv["releasable"])
+			r.MemStats.Pools = atoi(kv["pools"])
+			r.MemStats.PoolsUsed = parseMegabytes(kv["pools_used"])
+			r.MemStats.PoolsTotal = parseMegabytes(kv["pools_total"])
+		}
+	}
+
+	return
+}
+
+// statsFields parses a line of space separated key value pairs
+func statsFields(s string) (kv map[string]string) {
+	f := strings.Fields(s)
+	kv = make(map[string]string, len(f)/2)
+	for i := 0; i+1 < len(f); i += 2 {
+		kv[f[i]] = f[i+1]
+	}
+	return
+}
+
+func parseQueueItem(l string) (qi *QueueItem) {
+	f := strings.SplitN(strings.TrimSpace(l), " ", 3)
+	if len(f) < 2 {
+		return
+	}
+
+	secs, err := strconv.ParseFloat(f[1], 64)
+	if err != nil {
+		return
+	}
+
+	qi = &QueueItem{
+		Command: f[0],
+		Elapsed: time.Duration(secs * float64(time.Second)),
+	}
+	if len(f) == 3 {
+		qi.Target = strings.TrimSpace(f[2])
+	}
+
+	return
+}
+
+func parseMegabytes(s string) (n int64) {
+	n = -1
+	if s == "" || s == statsNotAvailable {
+		return
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "M"), 64)
+	if err != nil {
+		return
+	}
+
+	n = int64(v * megabyte)
+
+	return
+}
+
+func atoi(s string) (n int) {
+	n, _ = strconv.Atoi(s)
+	return
+}
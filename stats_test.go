@@ -0,0 +1,112 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testStatsOld = `POOLS: 1
+
+STATE: VALID PRIMARY
+THREADS: live 2  idle 0 max 10 idle-timeout 30
+QUEUE: 1 items
+	SCAN 0.012500 /var/spool/testfiles/install.log
+	STATS 0.000101
+
+MEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 565.999M
+END`
+
+func mb(f float64) int64 {
+	return int64(f * megabyte)
+}
+
+func TestParseStats(t *testing.T) {
+	r, e := ParseStats(testStats)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r.Raw != testStats {
+		t.Errorf("Expected the raw stats to be kept")
+	}
+	if r.Pools != 1 || len(r.ThreadPools) != 1 {
+		t.Fatalf("Expected 1 pool got %d %v", r.Pools, r.ThreadPools)
+	}
+	tp := r.ThreadPools[0]
+	if tp.State != "VALID" || !tp.Primary {
+		t.Errorf("Expected VALID PRIMARY got %q %t", tp.State, tp.Primary)
+	}
+	expected := Threads{Live: 1, Idle: 0, Max: 12, IdleTimeout: 30 * time.Second}
+	if tp.Threads != expected {
+		t.Errorf("Got %+v want %+v", tp.Threads, expected)
+	}
+	if tp.Queue.Length != 0 || len(tp.Queue.Items) != 1 {
+		t.Fatalf("Expected 1 queue item got %+v", tp.Queue)
+	}
+	qi := tp.Queue.Items[0]
+	if qi.Command != "STATS" || qi.Elapsed != 394*time.Microsecond || qi.Target != "" {
+		t.Errorf("Got %+v", qi)
+	}
+	m := r.MemStats
+	if m.Heap != -1 || m.Mmap != -1 || m.Used != -1 || m.Free != -1 || m.Releasable != -1 {
+		t.Errorf("Expected N/A values to be -1 got %+v", m)
+	}
+	if m.Pools != 1 || m.PoolsUsed != mb(1306.837) || m.PoolsTotal != mb(1306.882) {
+		t.Errorf("Got %+v", m)
+	}
+
+	if r, e = ParseStats(testStatsOld); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	tp = r.ThreadPools[0]
+	if tp.Threads.Live != 2 || tp.Queue.Length != 1 || len(tp.Queue.Items) != 2 {
+		t.Fatalf("Got %+v", tp)
+	}
+	qi = tp.Queue.Items[0]
+	if qi.Command != "SCAN" || qi.Elapsed != 12500*time.Microsecond || qi.Target != "/var/spool/testfiles/install.log" {
+		t.Errorf("Got %+v", qi)
+	}
+	m = r.MemStats
+	if m.Heap != mb(9.082) || m.Mmap != 0 || m.Used != mb(6.902) || m.Free != mb(2.184) || m.Releasable != mb(0.129) {
+		t.Errorf("Got %+v", m)
+	}
+
+	for _, s := range []string{"", "STATE: VALID", "POOLS: x"} {
+		if _, e = ParseStats(s); e == nil {
+			t.Errorf("An error should be returned for %q", s)
+		}
+	}
+	if _, e = ParseStats("POOLS: 0\nEND"); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+}
+
+func TestStatsResult(t *testing.T) {
+	var e error
+	var c *Client
+	var r *StatsResult
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{})
+	defer c.Close()
+
+	if r, e = c.StatsResult(context.Background()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r.Pools != 1 || r.ThreadPools[0].Threads.Max != 12 {
+		t.Errorf("Got %s", fmt.Sprint(r))
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A Sink stores the data scanned by ScanAndStore, Commit is
+// called when the data is clean and Discard when it is not or
+// the scan failed
+type Sink interface {
+	io.Writer
+	Commit() error
+	Discard() error
+}
+
+// A Quarantiner is a Sink that keeps infected data, Quarantine
+// is called instead of Discard when a virus is found
+type Quarantiner interface {
+	Sink
+	Quarantine(r []*Response) error
+}
+
+// ScanAndStore streams i to the server and writes it to s in a
+// single pass, s is committed only when every response is OK
+func (c *Client) ScanAndStore(ctx context.Context, i io.Reader, s Sink) (r []*Response, err error) {
+	r, err = scanAndStore(ctx, c.ScanReader, i, s)
+	return
+}
+
+// ScanAndStore streams i to an endpoint and writes it to s in a
+// single pass, the command is not retried
+func (cl *Cluster) ScanAndStore(ctx context.Context, i io.Reader, s Sink) (r []*Response, err error) {
+	r, err = scanAndStore(ctx, cl.ScanReader, i, s)
+	return
+}
+
+func scanAndStore(ctx context.Context, scan func(context.Context, io.Reader) ([]*Response, error), i io.Reader, s Sink) (r []*Response, err error) {
+	if r, err = scan(ctx, io.TeeReader(i, s)); err != nil {
+		s.Discard()
+		return
+	}
+
+	v := NewVerdict(r)
+	switch {
+	case v.Clean():
+		err = s.Commit()
+	case v.Infected():
+		if q, ok := s.(Quarantiner); ok {
+			err = q.Quarantine(r)
+		} else {
+			err = s.Discard()
+		}
+	default:
+		err = s.Discard()
+	}
+
+	return
+}
+
+// A FileSink writes to a temporary file in the directory of
+// its path, Commit renames it to the path
+type FileSink struct {
+	path       string
+	quarantine string
+	f          *os.File
+}
+
+// NewFileSink creates the temporary file of a FileSink
+func NewFileSink(path string) (s *FileSink, err error) {
+	var f *os.File
+
+	dir, base := filepath.Split(path)
+	if f, err = ioutil.TempFile(dir, "."+base+".*"); err != nil {
+		return
+	}
+
+	s = &FileSink{
+		path: path,
+		f:    f,
+	}
+
+	return
+}
+
+// SetQuarantineDir sets the directory infected files are
+// moved to, they are removed when it is not set
+func (s *FileSink) SetQuarantineDir(dir string) {
+	s.quarantine = dir
+}
+
+// Name returns the name of the temporary file
+func (s *FileSink) Name() string {
+	return s.f.Name()
+}
+
+// Write writes p to the temporary file
+func (s *FileSink) Write(p []byte) (n int, err error) {
+	n, err = s.f.Write(p)
+	return
+}
+
+// Commit syncs the temporary file and renames it to the path
+func (s *FileSink) Commit() (err error) {
+	if err = s.f.Sync(); err != nil {
+		s.Discard()
+		return
+	}
+
+	if err = s.f.Close(); err != nil {
+		os.Remove(s.f.Name())
+		return
+	}
+
+	if err = os.Rename(s.f.Name(), s.path); err != nil {
+		os.Remove(s.f.Name())
+	}
+
+	return
+}
+
+// Discard removes the temporary file
+func (s *FileSink) Discard() (err error) {
+	s.f.Close()
+	err = os.Remove(s.f.Name())
+
+	return
+}
+
+// Quarantine moves the temporary file to the quarantine
+// directory under a unique name based on the path
+func (s *FileSink) Quarantine(r []*Response) (err error) {
+	var q *os.File
+
+	if s.quarantine == "" {
+		err = s.Discard()
+		return
+	}
+
+	s.f.Close()
+	if q, err = ioutil.TempFile(s.quarantine, filepath.Base(s.path)+".*"); err != nil {
+		os.Remove(s.f.Name())
+		return
+	}
+	q.Close()
+
+	if err = os.Rename(s.f.Name(), q.Name()); err != nil {
+		os.Remove(s.f.Name())
+		os.Remove(q.Name())
+	}
+
+	return
+}
+
+// writerSink is the Sink returned by NewWriterSink
+type writerSink struct {
+	io.Writer
+	commit  func() error
+	discard func() error
+}
+
+// NewWriterSink returns a Sink that writes to w, commit is
+// called when the data is clean and discard otherwise,
+// either may be nil
+func NewWriterSink(w io.Writer, commit, discard func() error) Sink {
+	return &writerSink{
+		Writer:  w,
+		commit:  commit,
+		discard: discard,
+	}
+}
+
+func (s *writerSink) Commit() (err error) {
+	if s.commit != nil {
+		err = s.commit()
+	}
+
+	return
+}
+
+func (s *writerSink) Discard() (err error) {
+	if s.discard != nil {
+		err = s.discard()
+	}
+
+	return
+}
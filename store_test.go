@@ -0,0 +1,135 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+)
+
+func TestScanAndStore(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetChunkSize(1024)
+
+	eicar, e := ioutil.ReadFile("./examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	qdir := t.TempDir()
+	clean := bytes.Repeat([]byte("clean data "), 1000)
+
+	// Clean data is committed
+	fn := filepath.Join(dir, "clean.txt")
+	s, e := NewFileSink(fn)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	r, e := c.ScanAndStore(ctx, bytes.NewReader(clean), s)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "OK" {
+		t.Errorf("Got %v", r)
+	}
+	if b, e := ioutil.ReadFile(fn); e != nil || !bytes.Equal(b, clean) {
+		t.Errorf("Expected the clean data to be stored got %d bytes, %v", len(b), e)
+	}
+	if _, e = os.Stat(s.Name()); !os.IsNotExist(e) {
+		t.Errorf("Expected the temporary file to be renamed")
+	}
+
+	// Infected data is quarantined
+	fn = filepath.Join(dir, "eicar.txt")
+	if s, e = NewFileSink(fn); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	s.SetQuarantineDir(qdir)
+	if r, e = c.ScanAndStore(ctx, bytes.NewReader(eicar), s); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Status != "FOUND" {
+		t.Errorf("Got %v", r)
+	}
+	if _, e = os.Stat(fn); !os.IsNotExist(e) {
+		t.Errorf("Expected the infected data not to be stored")
+	}
+	qs, _ := filepath.Glob(filepath.Join(qdir, "eicar.txt.*"))
+	if len(qs) != 1 {
+		t.Fatalf("Expected the infected data to be quarantined got %v", qs)
+	}
+	if b, _ := ioutil.ReadFile(qs[0]); !bytes.Equal(b, eicar) {
+		t.Errorf("Expected the quarantined data to be intact")
+	}
+
+	// Infected data is removed without a quarantine directory
+	if s, e = NewFileSink(fn); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.ScanAndStore(ctx, bytes.NewReader(eicar), s); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if fs, _ := ioutil.ReadDir(dir); len(fs) != 1 {
+		t.Errorf("Expected only the clean file to be left got %d files", len(fs))
+	}
+
+	// A failed scan discards the data
+	c.SetStreamMaxLength(4096)
+	var buf bytes.Buffer
+	var committed, discarded bool
+	ws := NewWriterSink(&buf,
+		func() error { committed = true; return nil },
+		func() error { discarded = true; return nil },
+	)
+	if _, e = c.ScanAndStore(ctx, bytes.NewReader(clean), ws); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+	if committed || !discarded {
+		t.Errorf("Expected the data to be discarded got committed %t discarded %t", committed, discarded)
+	}
+
+	// The ERROR status is not clean
+	srv.InjectFault("INSTREAM", clamdtest.Fault{Reply: "stream: Can't allocate memory ERROR"})
+	committed, discarded = false, false
+	if _, e = c.ScanAndStore(ctx, strings.NewReader("data"), ws); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if committed || !discarded {
+		t.Errorf("Expected the data to be discarded got committed %t discarded %t", committed, discarded)
+	}
+}
+
+func TestClusterScanAndStore(t *testing.T) {
+	cl, _ := testCluster(t, 2, ClusterConfig{})
+
+	var buf bytes.Buffer
+	if _, e := cl.ScanAndStore(context.Background(), strings.NewReader("data"), NewWriterSink(&buf, nil, nil)); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if buf.String() != "data" {
+		t.Errorf("Expected data got %q", buf.String())
+	}
+}
@@ -0,0 +1,514 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/protocol"
+)
+
+const (
+	// MaxChunkSize is the largest INSTREAM chunk size, it is
+	// the default StreamMaxLength of clamd
+	MaxChunkSize    = 25 * 1024 * 1024
+	streamMaxErr    = "INSTREAM size limit of %d bytes exceeded"
+	streamClosedErr = "The stream writer is closed"
+)
+
+var zeroChunk = []byte{0, 0, 0, 0}
+
+// SetChunkSize sets the size of the INSTREAM chunks, it is
+// capped at MaxChunkSize and the stream max length. It is
+// not safe to call while scans are running, it should be
+// called before the client is used.
+func (c *Client) SetChunkSize(n int) {
+	if n <= 0 {
+		return
+	}
+
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+
+	c.chunkSize = n
+	c.bufs = newBufPool(n)
+}
+
+// SetStreamMaxLength sets the maximum size of a stream, it
+// should match the StreamMaxLength of the server. Streams
+// that are larger fail with ErrSizeLimitExceeded before the
+// excess is sent. Zero disables the check.
+func (c *Client) SetStreamMaxLength(n int64) {
+	if n < 0 {
+		n = 0
+	}
+
+	c.streamMaxLength = n
+}
+
+func newBufPool(n int) (p *sync.Pool) {
+	p = &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, n)
+			return &b
+		},
+	}
+
+	return
+}
+
+// chunkWriter frames the data written to it as INSTREAM chunks
+type chunkWriter struct {
+	c      *Client
+	ctx    context.Context
+	w      *bufio.Writer
+	conn   net.Conn
+	size   int
+	bufs   *sync.Pool
+	sent   int64
+	max    int64
+	hdr    [4]byte
+	wt     *watcher
+	broken bool
+}
+
+func (c *Client) newChunkWriter(ctx context.Context, w *bufio.Writer, conn net.Conn) (cw *chunkWriter) {
+	cw = &chunkWriter{
+		c:    c,
+		ctx:  ctx,
+		w:    w,
+		conn: conn,
+		size: c.chunkSize,
+		bufs: c.bufs,
+		max:  c.streamMaxLength,
+	}
+
+	if cw.max > 0 && int64(cw.size) > cw.max {
+		cw.size = int(cw.max)
+	}
+
+	return
+}
+
+// stream sends the command and f, the stream is terminated
+// when sending stops early unless a chunk was partially
+// written, the connection is then no longer in sync
+func (cw *chunkWriter) stream(cmd protocol.Command, f io.Reader) (err error) {
+	cw.c.writeCmd(cw.w, cmd)
+
+	err = cw.copy(f)
+	if err == nil || !cw.broken {
+		if e := cw.end(); e != nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// copy sends f as INSTREAM chunks
+func (cw *chunkWriter) copy(f io.Reader) (err error) {
+	switch r := f.(type) {
+	case *os.File:
+		_, err = cw.ReadFrom(r)
+	default:
+		_, err = io.Copy(cw, f)
+	}
+
+	return
+}
+
+// Write sends p in chunks of at most the chunk size
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := len(p)
+		if m > cw.size {
+			m = cw.size
+		}
+
+		if err = cw.chunk(p[:m]); err != nil {
+			return
+		}
+
+		n += m
+		p = p[m:]
+	}
+
+	return
+}
+
+// ReadFrom sends the content of r, regular files are sent
+// with sendfile when the connection supports it
+func (cw *chunkWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	var m int
+
+	if f, ok := r.(*os.File); ok {
+		var sent bool
+		if n, sent, err = cw.sendFile(f); sent {
+			return
+		}
+	}
+
+	bp := cw.buffer()
+	defer cw.bufs.Put(bp)
+	buf := (*bp)[:cw.size]
+
+	for {
+		m, err = io.ReadFull(r, buf)
+		if m > 0 {
+			if e := cw.chunk(buf[:m]); e != nil {
+				err = e
+				return
+			}
+			n += int64(m)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// buffer returns a pooled buffer of at least the chunk size,
+// smaller buffers of a previous chunk size are dropped
+func (cw *chunkWriter) buffer() (bp *[]byte) {
+	bp = cw.bufs.Get().(*[]byte)
+	if cap(*bp) < cw.size {
+		b := make([]byte, cw.size)
+		bp = &b
+	}
+
+	return
+}
+
+// sendFile sends a regular file using the io.ReaderFrom of
+// the connection, sent is false when it can not be used
+func (cw *chunkWriter) sendFile(f *os.File) (n int64, sent bool, err error) {
+	var off int64
+	var fi os.FileInfo
+
+	rf, ok := cw.conn.(io.ReaderFrom)
+	if !ok {
+		return
+	}
+
+	if fi, err = f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		err = nil
+		return
+	}
+
+	if off, err = f.Seek(0, io.SeekCurrent); err != nil {
+		err = nil
+		return
+	}
+
+	sent = true
+	remaining := fi.Size() - off
+	if err = cw.check(remaining); err != nil {
+		return
+	}
+
+	if err = cw.w.Flush(); err != nil {
+		cw.broken = true
+		return
+	}
+
+	for remaining > 0 {
+		var m int64
+
+		l := int64(cw.size)
+		if l > remaining {
+			l = remaining
+		}
+
+		// The deadline is set first so a watcher that
+		// fires after the check is not overridden
+		cw.conn.SetWriteDeadline(cw.c.deadline(cw.ctx))
+		if err = cw.ctx.Err(); err != nil {
+			return
+		}
+
+		binary.BigEndian.PutUint32(cw.hdr[:], uint32(l))
+		if _, err = cw.conn.Write(cw.hdr[:]); err != nil {
+			cw.broken = true
+			return
+		}
+
+		m, err = rf.ReadFrom(io.LimitReader(f, l))
+		n += m
+		cw.sent += m
+		if err == nil && m < l {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			cw.broken = true
+			return
+		}
+
+		remaining -= l
+	}
+
+	return
+}
+
+// chunk sends a chunk, small chunks are buffered and large
+// ones are written with the header in a single writev
+func (cw *chunkWriter) chunk(p []byte) (err error) {
+	if err = cw.check(int64(len(p))); err != nil {
+		return
+	}
+
+	cw.conn.SetWriteDeadline(cw.c.deadline(cw.ctx))
+	if err = cw.ctx.Err(); err != nil {
+		return
+	}
+
+	binary.BigEndian.PutUint32(cw.hdr[:], uint32(len(p)))
+
+	if len(p)+len(cw.hdr) <= cw.w.Available() {
+		cw.w.Write(cw.hdr[:])
+		cw.w.Write(p)
+	} else {
+		if err = cw.w.Flush(); err == nil {
+			bufs := net.Buffers{cw.hdr[:], p}
+			_, err = bufs.WriteTo(cw.conn)
+		}
+	}
+
+	if err != nil {
+		cw.broken = true
+		return
+	}
+
+	cw.sent += int64(len(p))
+
+	return
+}
+
+// check returns an error when sending n more bytes
+// exceeds the stream max length
+func (cw *chunkWriter) check(n int64) (err error) {
+	if cw.max > 0 && cw.sent+n > cw.max {
+		err = errorf(ErrSizeLimitExceeded, streamMaxErr, cw.max)
+	}
+
+	return
+}
+
+// end sends the terminating chunk, when ctx is done it is
+// sent with a short deadline
+func (cw *chunkWriter) end() (err error) {
+	if cw.wt != nil {
+		defer cw.wt.hold()()
+	}
+
+	t := cw.c.deadline(cw.ctx)
+	if cw.ctx.Err() != nil {
+		t = time.Now().Add(endStreamTimeout)
+	}
+	cw.conn.SetWriteDeadline(t)
+
+	cw.w.Write(zeroChunk)
+	if err = cw.w.Flush(); err != nil {
+		cw.broken = true
+	}
+
+	return
+}
+
+// A StreamWriter sends the data written to it to the server
+// as an INSTREAM stream, Close or Result ends the stream. Small
+// writes are buffered into chunks of the client chunk size. It
+// is not safe for concurrent use.
+type StreamWriter struct {
+	ctx  context.Context
+	c    *Client
+	conn net.Conn
+	tc   *textproto.Conn
+	cw   *chunkWriter
+	bp   *[]byte
+	buf  []byte
+	wt   *watcher
+	done bool
+	r    []*Response
+	err  error
+}
+
+// NewStreamWriter starts an INSTREAM scan of the data written
+// to the returned StreamWriter, it uses its own connection
+// even when the client has a connection pool
+func (c *Client) NewStreamWriter(ctx context.Context) (sw *StreamWriter, err error) {
+	var conn net.Conn
+
+	if conn, err = c.dial(ctx); err != nil {
+		return
+	}
+
+	tc := textproto.NewConn(conn)
+	sw = &StreamWriter{
+		ctx:  ctx,
+		c:    c,
+		conn: conn,
+		tc:   tc,
+		cw:   c.newChunkWriter(ctx, tc.W, conn),
+		wt:   watch(ctx, conn),
+	}
+	sw.cw.wt = sw.wt
+	sw.wt.streaming(true)
+	sw.bp = sw.cw.buffer()
+	sw.buf = (*sw.bp)[:0:sw.cw.size]
+
+	c.writeCmd(tc.W, protocol.Instream)
+
+	return
+}
+
+// Write sends p to the server
+func (sw *StreamWriter) Write(p []byte) (n int, err error) {
+	if sw.done {
+		err = sw.closedErr()
+		return
+	}
+
+	for len(p) > 0 {
+		if len(sw.buf) == 0 && len(p) >= cap(sw.buf) {
+			m := len(p) - len(p)%cap(sw.buf)
+			if _, err = sw.cw.Write(p[:m]); err != nil {
+				err = sw.fail(err)
+				return
+			}
+			n += m
+			p = p[m:]
+			continue
+		}
+
+		m := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+m]
+		n += m
+		p = p[m:]
+
+		if len(sw.buf) == cap(sw.buf) {
+			if err = sw.flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// ReadFrom sends the content of r to the server
+func (sw *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if sw.done {
+		err = sw.closedErr()
+		return
+	}
+
+	if err = sw.flush(); err != nil {
+		return
+	}
+
+	if n, err = sw.cw.ReadFrom(r); err != nil {
+		err = sw.fail(err)
+	}
+
+	return
+}
+
+// Close ends the stream and reads the result, the error
+// is that of the stream or of reading the result
+func (sw *StreamWriter) Close() (err error) {
+	var r []*Response
+
+	if sw.done {
+		err = sw.err
+		return
+	}
+
+	if err = sw.flush(); err != nil {
+		return
+	}
+
+	if err = sw.cw.end(); err != nil {
+		err = sw.fail(err)
+		return
+	}
+	sw.wt.streaming(false)
+
+	r, err = sw.c.processResponse(sw.ctx, sw.tc, sw.conn)
+	sw.finish(r, ctxError(sw.ctx, err))
+	err = sw.err
+
+	return
+}
+
+// Result ends the stream if it is not yet closed
+// and returns the server responses
+func (sw *StreamWriter) Result() (r []*Response, err error) {
+	sw.Close()
+
+	r, err = sw.r, sw.err
+
+	return
+}
+
+func (sw *StreamWriter) flush() (err error) {
+	if len(sw.buf) == 0 {
+		return
+	}
+
+	if err = sw.cw.chunk(sw.buf); err != nil {
+		err = sw.fail(err)
+		return
+	}
+	sw.buf = sw.buf[:0]
+
+	return
+}
+
+// fail ends the stream after a write error, the error
+// is replaced by the server reply when there is one
+func (sw *StreamWriter) fail(err error) error {
+	err = sw.c.streamError(sw.ctx, sw.tc, sw.conn, err)
+	sw.finish(nil, ctxError(sw.ctx, err))
+
+	return sw.err
+}
+
+func (sw *StreamWriter) finish(r []*Response, err error) {
+	sw.done = true
+	sw.r, sw.err = r, err
+	sw.wt.stop()
+	sw.tc.Close()
+	sw.cw.bufs.Put(sw.bp)
+	sw.bp, sw.buf = nil, nil
+}
+
+func (sw *StreamWriter) closedErr() (err error) {
+	if err = sw.err; err == nil {
+		err = ErrStreamClosed
+	}
+
+	return
+}
@@ -0,0 +1,454 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/clamd/clamdtest"
+	"github.com/baruwa-enterprise/clamd/protocol"
+)
+
+// streamResult is what a frameServer received on a connection
+type streamResult struct {
+	cmd    string
+	chunks []int
+	data   []byte
+	err    error
+}
+
+// frameServer decodes INSTREAM commands, when keep is set the
+// data and chunk sizes are sent on the returned channel
+func frameServer(tb testing.TB, network string, keep bool) (addr string, ch chan streamResult) {
+	var l net.Listener
+	var e error
+
+	switch network {
+	case "unix":
+		l, e = net.Listen(network, filepath.Join(tb.TempDir(), "frame.sock"))
+	default:
+		l, e = net.Listen(network, "127.0.0.1:0")
+	}
+	if e != nil {
+		tb.Fatalf("Listen failed: %s", e)
+	}
+	tb.Cleanup(func() { l.Close() })
+
+	addr = l.Addr().String()
+	ch = make(chan streamResult, 16)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var rs streamResult
+				var buf bytes.Buffer
+				var w io.Writer = ioutil.Discard
+				if keep {
+					w = &buf
+				}
+				r := bufio.NewReaderSize(conn, 64*1024)
+				rs.cmd, rs.err = r.ReadString('\n')
+				hdr := make([]byte, 4)
+				for rs.err == nil {
+					if _, rs.err = io.ReadFull(r, hdr); rs.err != nil {
+						break
+					}
+					n := binary.BigEndian.Uint32(hdr)
+					if n == 0 {
+						conn.Write([]byte("stream: OK\n"))
+						break
+					}
+					if keep {
+						rs.chunks = append(rs.chunks, int(n))
+					}
+					_, rs.err = io.CopyN(w, r, int64(n))
+				}
+				rs.data = buf.Bytes()
+				if keep {
+					ch <- rs
+				}
+			}()
+		}
+	}()
+
+	return
+}
+
+func sendStream(c *Client, network, addr string, f io.Reader) (err error) {
+	var conn net.Conn
+
+	if conn, err = net.Dial(network, addr); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	if err = c.streamCmd(context.Background(), w, protocol.Instream, f, conn, nil); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+
+	return
+}
+
+// plainReader hides the io.WriterTo of the underlying reader
+type plainReader struct {
+	r io.Reader
+}
+
+func (p *plainReader) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func TestChunkWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	fn := filepath.Join(t.TempDir(), "content")
+	if e := ioutil.WriteFile(fn, content, 0644); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	readers := map[string]func() io.Reader{
+		"bytes": func() io.Reader { return bytes.NewReader(content) },
+		"plain": func() io.Reader { return &plainReader{bytes.NewReader(content)} },
+		"file": func() io.Reader {
+			f, e := os.Open(fn)
+			if e != nil {
+				t.Fatalf("An error should not be returned: %s", e)
+			}
+			t.Cleanup(func() { f.Close() })
+			return f
+		},
+	}
+
+	for _, network := range []string{"unix", "tcp"} {
+		addr, ch := frameServer(t, network, true)
+		for name, newReader := range readers {
+			for _, size := range []int{100, 4096, ChunkSize, 1 << 20} {
+				t.Run(fmt.Sprintf("%s/%s/%d", network, name, size), func(t *testing.T) {
+					c := &Client{cmdTimeout: time.Minute}
+					c.SetChunkSize(size)
+					if e := sendStream(c, network, addr, newReader()); e != nil {
+						t.Fatalf("An error should not be returned: %s", e)
+					}
+					rs := <-ch
+					if rs.cmd != "nINSTREAM\n" {
+						t.Errorf("Got command %q", rs.cmd)
+					}
+					if !bytes.Equal(rs.data, content) {
+						t.Errorf("The content was not received intact got %d bytes", len(rs.data))
+					}
+					for i, n := range rs.chunks {
+						if n > size || (i < len(rs.chunks)-1 && n != size) {
+							t.Errorf("Unexpected chunk sizes %v", rs.chunks)
+							break
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	c, e := NewClient("tcp", "127.0.0.1:3310")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	if c.chunkSize != ChunkSize {
+		t.Errorf("Expected the default chunk size %d got %d", ChunkSize, c.chunkSize)
+	}
+	c.SetChunkSize(0)
+	if c.chunkSize != ChunkSize {
+		t.Errorf("Expected the chunk size to be unchanged got %d", c.chunkSize)
+	}
+	c.SetChunkSize(MaxChunkSize + 1)
+	if c.chunkSize != MaxChunkSize {
+		t.Errorf("Expected the chunk size to be capped got %d", c.chunkSize)
+	}
+	c.SetStreamMaxLength(1000)
+	if cw := c.newChunkWriter(context.Background(), nil, nil); cw.size != 1000 {
+		t.Errorf("Expected the chunk size to be capped at the stream max length got %d", cw.size)
+	}
+
+	// A buffer of a smaller chunk size returned to the
+	// pool after the chunk size changed is not used
+	c.SetStreamMaxLength(0)
+	c.SetChunkSize(100)
+	old := c.newChunkWriter(context.Background(), nil, nil)
+	bp := old.buffer()
+	c.SetChunkSize(4096)
+	c.bufs.Put(bp)
+	if bp = c.newChunkWriter(context.Background(), nil, nil).buffer(); cap(*bp) < 4096 {
+		t.Errorf("Expected a buffer of at least 4096 bytes got %d", cap(*bp))
+	}
+	old.bufs.Put(old.buffer())
+}
+
+func TestStreamMaxLength(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetChunkSize(1024)
+	c.SetStreamMaxLength(4096)
+
+	ctx := context.Background()
+	big := strings.Repeat("a", 8192)
+	if _, e = c.ScanReader(ctx, strings.NewReader(big)); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+	if r, e := c.ScanReader(ctx, strings.NewReader(big[:4096])); e != nil || len(r) != 1 {
+		t.Errorf("ScanReader: got %v, %v", r, e)
+	}
+
+	fn := filepath.Join(t.TempDir(), "big")
+	if e = ioutil.WriteFile(fn, []byte(big), 0644); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.InStream(ctx, fn); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+
+	ss, e := c.IDSession(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer ss.End()
+	if _, e = ss.ScanReader(ctx, strings.NewReader(big)); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+	if b, e := ss.Ping(ctx); e != nil || !b {
+		t.Errorf("Expected the session to be usable got %t, %v", b, e)
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	c, e := NewClient(srv.Network, srv.Address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetChunkSize(1024)
+
+	eicar, e := ioutil.ReadFile("./examples/eicar.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	content := append(bytes.Repeat([]byte("a"), 5000), eicar...)
+	ctx := context.Background()
+
+	for _, size := range []int{1, 76, 1024, 3000, len(content)} {
+		sw, e := c.NewStreamWriter(ctx)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		for p := content; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, e = sw.Write(p[:n]); e != nil {
+				t.Fatalf("An error should not be returned: %s", e)
+			}
+			p = p[n:]
+		}
+		r, e := sw.Result()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(r) != 1 || r[0].Signature != clamdtest.EicarSignature {
+			t.Errorf("Write size %d: got %v", size, r)
+		}
+		if e = sw.Close(); e != nil {
+			t.Errorf("Expected Close after Result to return nil got %v", e)
+		}
+		if _, e = sw.Write([]byte("a")); e != ErrStreamClosed {
+			t.Errorf("Expected %v got %v", ErrStreamClosed, e)
+		}
+	}
+
+	sw, e := c.NewStreamWriter(ctx)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sw.Write([]byte("clean "))
+	if _, e = io.Copy(sw, &plainReader{strings.NewReader("data")}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = sw.Close(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if r, _ := sw.Result(); len(r) != 1 || r[0].Status != "OK" {
+		t.Errorf("Got %v", r)
+	}
+
+	c.SetStreamMaxLength(2048)
+	if sw, e = c.NewStreamWriter(ctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = sw.Write(content); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+	if _, e = sw.Result(); !errors.Is(e, ErrSizeLimitExceeded) {
+		t.Errorf("Expected %v got %v", ErrSizeLimitExceeded, e)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	if sw, e = c.NewStreamWriter(cctx); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	sw.Write([]byte("partial"))
+	cancel()
+	if e = sw.Close(); e != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, e)
+	}
+}
+
+func TestStreamWriterChunks(t *testing.T) {
+	addr, ch := frameServer(t, "unix", true)
+	c := &Client{network: "unix", address: addr, cmdTimeout: time.Minute}
+	c.SetChunkSize(4096)
+
+	sw, e := c.NewStreamWriter(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	for i := 0; i < 1000; i++ {
+		sw.Write(bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	if _, e = sw.Result(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+
+	rs := <-ch
+	if len(rs.data) != 100000 {
+		t.Errorf("Expected 100000 bytes got %d", len(rs.data))
+	}
+	for i, n := range rs.chunks {
+		if i < len(rs.chunks)-1 && n != 4096 {
+			t.Errorf("Expected small writes to be sent as full chunks got %v", rs.chunks)
+			break
+		}
+	}
+}
+
+// legacyStream is the INSTREAM loop used before pooled
+// buffers, it is kept for comparison in the benchmarks
+func legacyStream(w *bufio.Writer, f io.Reader) (err error) {
+	var n int
+	var eof bool
+
+	fmt.Fprintf(w, "n%s\n", protocol.Instream)
+	b := make([]byte, 4)
+
+	for !eof {
+		buf := make([]byte, 1024)
+		if n, err = f.Read(buf); err != nil {
+			if err != io.EOF {
+				return
+			}
+			err = nil
+			eof = true
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint32(b, uint32(n))
+			w.Write(b)
+			w.Write(buf[0:n])
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	err = w.Flush()
+
+	return
+}
+
+func BenchmarkStream(b *testing.B) {
+	const size = 8 * 1024 * 1024
+
+	content := bytes.Repeat([]byte("a"), size)
+	fn := filepath.Join(b.TempDir(), "content")
+	if e := ioutil.WriteFile(fn, content, 0644); e != nil {
+		b.Fatalf("An error should not be returned: %s", e)
+	}
+
+	for _, network := range []string{"unix", "tcp"} {
+		addr, _ := frameServer(b, network, false)
+		c := &Client{cmdTimeout: time.Minute}
+		c.SetChunkSize(ChunkSize)
+
+		run := func(name string, f func() error) {
+			b.Run(network+"/"+name, func(b *testing.B) {
+				b.SetBytes(size)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if e := f(); e != nil {
+						b.Fatalf("An error should not be returned: %s", e)
+					}
+				}
+			})
+		}
+
+		run("legacy", func() (err error) {
+			var conn net.Conn
+			if conn, err = net.Dial(network, addr); err != nil {
+				return
+			}
+			defer conn.Close()
+			if err = legacyStream(bufio.NewWriter(conn), bytes.NewReader(content)); err != nil {
+				return
+			}
+			_, err = bufio.NewReader(conn).ReadString('\n')
+			return
+		})
+		run("reader", func() error {
+			return sendStream(c, network, addr, &plainReader{bytes.NewReader(content)})
+		})
+		run("bytes", func() error {
+			return sendStream(c, network, addr, bytes.NewReader(content))
+		})
+		run("file", func() (err error) {
+			var f *os.File
+			if f, err = os.Open(fn); err != nil {
+				return
+			}
+			defer f.Close()
+			return sendStream(c, network, addr, f)
+		})
+	}
+}
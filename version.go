@@ -0,0 +1,207 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	versionTimeLayout = time.ANSIC
+	engineVersionErr  = "Invalid engine version: %s"
+)
+
+// VersionInfo is the parsed output of the VERSION command,
+// DatabaseVersion is zero and DatabaseTime is the zero time
+// when the server has no signature database loaded.
+type VersionInfo struct {
+	Product         string
+	Engine          EngineVersion
+	DatabaseVersion int
+	DatabaseTime    time.Time
+	Raw             string
+}
+
+// EngineVersion is the version of the scanning engine, Extra holds
+// any pre-release suffix such as "rc" or "devel-20230313"
+type EngineVersion struct {
+	Major int
+	Minor int
+	Patch int
+	Extra string
+}
+
+// String returns the version in its usual dotted form
+func (v EngineVersion) String() (s string) {
+	s = fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Extra != "" {
+		s = s + "-" + v.Extra
+	}
+	return
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to
+// or greater than o, a pre-release is less than its release
+func (v EngineVersion) Compare(o EngineVersion) (r int) {
+	switch {
+	case v.Major != o.Major:
+		r = compareInt(v.Major, o.Major)
+	case v.Minor != o.Minor:
+		r = compareInt(v.Minor, o.Minor)
+	case v.Patch != o.Patch:
+		r = compareInt(v.Patch, o.Patch)
+	case v.Extra == o.Extra:
+		r = 0
+	case v.Extra == "":
+		r = 1
+	case o.Extra == "":
+		r = -1
+	default:
+		r = strings.Compare(v.Extra, o.Extra)
+	}
+	return
+}
+
+// Less reports whether v is older than o
+func (v EngineVersion) Less(o EngineVersion) bool {
+	return v.Compare(o) < 0
+}
+
+// DatabaseAge returns the age of the signature database at t
+func (v *VersionInfo) DatabaseAge(t time.Time) (d time.Duration) {
+	if v.DatabaseTime.IsZero() {
+		return
+	}
+
+	d = t.Sub(v.DatabaseTime)
+
+	return
+}
+
+// VersionInfo returns the parsed server version
+func (c *Client) VersionInfo(ctx context.Context) (v *VersionInfo, err error) {
+	var s string
+
+	if s, err = c.Version(ctx); err != nil {
+		return
+	}
+
+	v, err = ParseVersion(s)
+
+	return
+}
+
+// ParseVersion parses the output of the VERSION command
+// for example "ClamAV 1.0.1/26850/Mon Mar 13 08:20:43 2023",
+// the database time is returned in UTC.
+func ParseVersion(s string) (v *VersionInfo, err error) {
+	var e EngineVersion
+
+	s = strings.TrimSpace(s)
+	p := strings.SplitN(s, "/", 3)
+	f := strings.Fields(p[0])
+	if len(f) != 2 {
+		err = errorf(ErrInvalidResponse, invalidRespErr, s)
+		return
+	}
+
+	if e, err = ParseEngineVersion(f[1]); err != nil {
+		return
+	}
+
+	v = &VersionInfo{
+		Product: f[0],
+		Engine:  e,
+		Raw:     s,
+	}
+
+	if len(p) == 1 {
+		return
+	}
+
+	if v.DatabaseVersion, err = strconv.Atoi(p[1]); err != nil {
+		err = errorf(ErrInvalidResponse, invalidRespErr, s)
+		v = nil
+		return
+	}
+
+	if len(p) == 3 {
+		if v.DatabaseTime, err = time.Parse(versionTimeLayout, strings.TrimSpace(p[2])); err != nil {
+			err = errorf(ErrInvalidResponse, invalidRespErr, s)
+			v = nil
+			return
+		}
+	}
+
+	return
+}
+
+// ParseEngineVersion parses an engine version such as 0.103.8 or 1.1.0-rc
+func ParseEngineVersion(s string) (v EngineVersion, err error) {
+	var n int
+
+	o := s
+	if i := strings.IndexAny(s, "-~+"); i != -1 {
+		v.Extra = s[i+1:]
+		s = s[:i]
+	}
+
+	p := strings.Split(s, ".")
+	if len(p) < 2 || len(p) > 3 {
+		err = errorf(ErrInvalidResponse, engineVersionErr, o)
+		return
+	}
+
+	for i, x := range p {
+		if n, err = strconv.Atoi(x); err != nil || n < 0 {
+			err = errorf(ErrInvalidResponse, engineVersionErr, o)
+			return
+		}
+		switch i {
+		case 0:
+			v.Major = n
+		case 1:
+			v.Minor = n
+		case 2:
+			v.Patch = n
+		}
+	}
+
+	return
+}
+
+func parseVersionCmds(s string) (r []string, v *VersionInfo, err error) {
+	p := strings.Split(s, versionCmdsResp)
+	if len(p) != 2 {
+		err = errorf(ErrInvalidResponse, invalidRespErr, s)
+		return
+	}
+
+	if v, err = ParseVersion(strings.TrimRight(p[0], "| ")); err != nil {
+		return
+	}
+
+	r = strings.Split(p[1], " ")
+
+	return
+}
+
+func compareInt(a, b int) (r int) {
+	if a < b {
+		r = -1
+	} else if a > b {
+		r = 1
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package clamd Golang Clamd client
+Clamd - Golang clamd client
+*/
+package clamd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type versionTestKey struct {
+	in     string
+	engine EngineVersion
+	dbver  int
+	dbtime time.Time
+	err    bool
+}
+
+var TestVersions = []versionTestKey{
+	{testVersion, EngineVersion{1, 0, 1, ""}, 26850, time.Date(2023, 3, 13, 8, 20, 43, 0, time.UTC), false},
+	{"ClamAV 0.100.0/24802/Wed Aug  1 08:43:37 2018", EngineVersion{0, 100, 0, ""}, 24802, time.Date(2018, 8, 1, 8, 43, 37, 0, time.UTC), false},
+	{"ClamAV 1.1.0-rc/26900/Tue Apr 18 07:25:01 2023\n", EngineVersion{1, 1, 0, "rc"}, 26900, time.Date(2023, 4, 18, 7, 25, 1, 0, time.UTC), false},
+	{"ClamAV 0.103.8", EngineVersion{0, 103, 8, ""}, 0, time.Time{}, false},
+	{"ClamAV 0.103.8/26850", EngineVersion{0, 103, 8, ""}, 26850, time.Time{}, false},
+	{"ClamAV", EngineVersion{}, 0, time.Time{}, true},
+	{"ClamAV x.y/26850/Mon Mar 13 08:20:43 2023", EngineVersion{}, 0, time.Time{}, true},
+	{"ClamAV 1.0.1/abc/Mon Mar 13 08:20:43 2023", EngineVersion{}, 0, time.Time{}, true},
+	{"ClamAV 1.0.1/26850/yesterday", EngineVersion{}, 0, time.Time{}, true},
+}
+
+type engineCompareTestKey struct {
+	a   string
+	b   string
+	out int
+}
+
+var TestEngineCompare = []engineCompareTestKey{
+	{"1.0.1", "1.0.1", 0},
+	{"1.0.1", "1.0.2", -1},
+	{"0.103.8", "1.0.0", -1},
+	{"0.103.8", "0.99.4", 1},
+	{"1.1.0-rc", "1.1.0", -1},
+	{"1.1.0", "1.1.0-rc", 1},
+	{"1.1.0-beta", "1.1.0-rc", -1},
+	{"0.99", "0.99.0", 0},
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, tt := range TestVersions {
+		v, e := ParseVersion(tt.in)
+		if tt.err {
+			if e == nil {
+				t.Errorf("ParseVersion(%q) should return an error", tt.in)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("ParseVersion(%q) returned an error: %s", tt.in, e)
+			continue
+		}
+		if v.Product != "ClamAV" {
+			t.Errorf("ParseVersion(%q).Product = %q", tt.in, v.Product)
+		}
+		if v.Engine != tt.engine {
+			t.Errorf("ParseVersion(%q).Engine = %v, want %v", tt.in, v.Engine, tt.engine)
+		}
+		if v.DatabaseVersion != tt.dbver {
+			t.Errorf("ParseVersion(%q).DatabaseVersion = %d, want %d", tt.in, v.DatabaseVersion, tt.dbver)
+		}
+		if !v.DatabaseTime.Equal(tt.dbtime) {
+			t.Errorf("ParseVersion(%q).DatabaseTime = %s, want %s", tt.in, v.DatabaseTime, tt.dbtime)
+		}
+	}
+}
+
+func TestEngineVersion(t *testing.T) {
+	for _, tt := range TestEngineCompare {
+		a, e := ParseEngineVersion(tt.a)
+		if e != nil {
+			t.Fatalf("ParseEngineVersion(%q) returned an error: %s", tt.a, e)
+		}
+		b, e := ParseEngineVersion(tt.b)
+		if e != nil {
+			t.Fatalf("ParseEngineVersion(%q) returned an error: %s", tt.b, e)
+		}
+		if r := a.Compare(b); r != tt.out {
+			t.Errorf("%q.Compare(%q) = %d, want %d", tt.a, tt.b, r, tt.out)
+		}
+		if a.Less(b) != (tt.out < 0) {
+			t.Errorf("%q.Less(%q) = %t", tt.a, tt.b, a.Less(b))
+		}
+	}
+
+	v := EngineVersion{1, 1, 0, "rc"}
+	if s := v.String(); s != "1.1.0-rc" {
+		t.Errorf("Got %q want %q", s, "1.1.0-rc")
+	}
+	for _, s := range []string{"", "1", "1.x.0", "1.0.-1", "1.2.3.4"} {
+		if _, e := ParseEngineVersion(s); e == nil {
+			t.Errorf("ParseEngineVersion(%q) should return an error", s)
+		}
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	var e error
+	var c *Client
+	var v *VersionInfo
+
+	network, address := sessionServer(t)
+	if c, e = NewClient(network, address); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.SetPool(PoolConfig{})
+	defer c.Close()
+
+	if v, e = c.VersionInfo(context.Background()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if v.DatabaseVersion != 26850 || v.Raw != testVersion {
+		t.Errorf("Got %+v", v)
+	}
+	now := time.Date(2023, 3, 14, 8, 20, 43, 0, time.UTC)
+	if d := v.DatabaseAge(now); d != 24*time.Hour {
+		t.Errorf("Expected a database age of 24h got %s", d)
+	}
+	if d := (&VersionInfo{}).DatabaseAge(now); d != 0 {
+		t.Errorf("Expected a zero database age got %s", d)
+	}
+}
+
+func TestParseVersionCmds(t *testing.T) {
+	s := "ClamAV 0.100.0/24802/Wed Aug  1 08:43:37 2018| COMMANDS: SCAN QUIT RELOAD PING CONTSCAN VERSIONCOMMANDS VERSION END SHUTDOWN MULTISCAN FILDES STATS IDSESSION INSTREAM"
+	r, v, e := parseVersionCmds(s)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 14 || r[0] != "SCAN" || r[13] != "INSTREAM" {
+		t.Errorf("Got %q", r)
+	}
+	if v.DatabaseVersion != 24802 || v.Engine.Minor != 100 {
+		t.Errorf("Got %+v", v)
+	}
+	if _, _, e = parseVersionCmds("ClamAV 0.94"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}